@@ -16,7 +16,9 @@
 
 // If this doesn't come first, there will be compile errors.
 #include <winsock2.h>
+#include <ws2tcpip.h>
 #include <iostream>
+#include <vector>
 #include <iphlpapi.h>
 #include <fwpmtypes.h>
 #include <fwpmu.h>
@@ -25,6 +27,7 @@
 #pragma comment(lib, "iphlpapi.lib")
 #pragma comment(lib, "fwpuclnt.lib")
 #pragma comment(lib, "rpcrt4.lib")
+#pragma comment(lib, "ws2_32.lib")
 
 using namespace ::std;
 
@@ -37,18 +40,85 @@ PCWSTR SUBLAYER_NAME = L"DNS Unleak";
 UINT64 LOWER_FILTER_WEIGHT = 10;
 UINT64 HIGHER_FILTER_WEIGHT = 20;
 
-int main(int argc, char **argv) {
+// Addresses of the servers the proxy itself needs to reach on blocked ports.
+struct allowedAddr {
+  int family;
+  UINT32 v4;
+  FWP_BYTE_ARRAY16 v6;
+};
+
+int addFilter(HANDLE engine, const GUID &sublayerKey, const GUID &layerKey,
+              FWPM_FILTER_CONDITION0 *conditions, UINT32 numConditions, FWP_ACTION_TYPE action,
+              UINT64 *weight, UINT64 *filterId) {
+  FWPM_FILTER0 filter;
+  memset(&filter, 0, sizeof(filter));
+  filter.filterCondition = conditions;
+  filter.numFilterConditions = numConditions;
+  filter.displayData.name = (PWSTR)FILTER_PROVIDER_NAME;
+  filter.subLayerKey = sublayerKey;
+  filter.layerKey = layerKey;
+  filter.action.type = action;
+  filter.weight.type = FWP_UINT64;
+  filter.weight.uint64 = weight;
+  return FwpmFilterAdd0(engine, &filter, NULL, filterId);
+}
+
+// Usage: dnsunleak [-strict] [-app path] [-allow ip]...
+//
+// By default, UDP port 53 is blocked outside of the TAP device. With -strict,
+// TCP port 53 and ports 853 (DoT and DoQ) are blocked too. Traffic to the
+// addresses given with -allow, like the upstream servers of the proxy, is
+// permitted on the blocked ports for the program given with -app only, so
+// other processes can't use them to bypass the proxy.
+int wmain(int argc, wchar_t **argv) {
+  WSADATA wsaData;
+  WSAStartup(MAKEWORD(2, 2), &wsaData);
+
+  bool strict = false;
+  PCWSTR app = NULL;
+  vector<allowedAddr> allowed;
+  for (int i = 1; i < argc; i++) {
+    if (wcscmp(argv[i], L"-strict") == 0) {
+      strict = true;
+    } else if (wcscmp(argv[i], L"-app") == 0 && i + 1 < argc) {
+      i++;
+      app = argv[i];
+    } else if (wcscmp(argv[i], L"-allow") == 0 && i + 1 < argc) {
+      i++;
+      allowedAddr a;
+      memset(&a, 0, sizeof(a));
+      IN_ADDR in;
+      if (InetPtonW(AF_INET, argv[i], &in) == 1) {
+        a.family = AF_INET;
+        a.v4 = ntohl(in.S_un.S_addr);
+      } else if (InetPtonW(AF_INET6, argv[i], a.v6.byteArray16) == 1) {
+        a.family = AF_INET6;
+      } else {
+        wcerr << "invalid address: " << argv[i] << endl;
+        return 1;
+      }
+      allowed.push_back(a);
+    } else {
+      wcerr << "invalid argument: " << argv[i] << endl;
+      return 1;
+    }
+  }
+  if (!allowed.empty() && app == NULL) {
+    wcerr << "-allow requires -app" << endl;
+    return 1;
+  }
+
   // Lookup the interface index of NextDNS.
   PIP_ADAPTER_ADDRESSES adaptersAddresses =
       (IP_ADAPTER_ADDRESSES *)malloc(GET_ADAPTERS_ADDRESSES_BUFFER_SIZE);
-  DWORD result = GetAdaptersAddresses(AF_INET, 0, NULL, adaptersAddresses,
+  DWORD result = GetAdaptersAddresses(AF_UNSPEC, 0, NULL, adaptersAddresses,
                                       &GET_ADAPTERS_ADDRESSES_BUFFER_SIZE);
   if (result != NO_ERROR) {
     wcerr << "could not fetch network device list: " << result << endl;
     return 1;
   }
 
-  UINT32 interfaceIndex;
+  UINT32 interfaceIndex, ipv6InterfaceIndex;
   PIP_ADAPTER_ADDRESSES adapterAddress = adaptersAddresses;
   while (adapterAddress && wcscmp(TAP_DEVICE_NAME, adapterAddress->FriendlyName) != 0) {
     adapterAddress = adapterAddress->Next;
@@ -60,7 +130,9 @@ int main(int argc, char **argv) {
   }
 
   interfaceIndex = adapterAddress->IfIndex;
-  wcout << "found " << TAP_DEVICE_NAME << " at index " << interfaceIndex << endl;
+  ipv6InterfaceIndex = adapterAddress->Ipv6IfIndex;
+  wcout << "found " << TAP_DEVICE_NAME << " at index " << interfaceIndex << " (IPv6 "
+        << ipv6InterfaceIndex << ")" << endl;
 
   // Connect to the filtering engine. By using a dynamic session, all of our changes are
   // *non-destructive* and will vanish on exit/crash/whatever.
@@ -76,6 +148,16 @@ int main(int argc, char **argv) {
   }
   wcout << "connected to filtering engine" << endl;
 
+  // Lookup the application identifier the allowed addresses are restricted to.
+  FWP_BYTE_BLOB *appId = NULL;
+  if (app != NULL) {
+    result = FwpmGetAppIdFromFileName0(app, &appId);
+    if (result != ERROR_SUCCESS) {
+      wcerr << "could not get the application id of " << app << ": " << result << endl;
+      return 1;
+    }
+  }
+
   // Create our own sublayer.
   //
   // This is recommended by the API documentation to avoid weird interactions with other
@@ -100,71 +182,121 @@ int main(int argc, char **argv) {
   }
   wcout << "created filtering sublayer" << endl;
 
-  // Create our filters:
-  //  - The first blocks all UDP traffic bound for port 53.
-  //  - The second whitelists all traffic on the TAP device.
+  // Create our filters, for both IPv4 and IPv6:
+  //  - The first ones block all UDP traffic bound for port 53, and in strict mode TCP port 53
+  //    and ports 853 too.
+  //  - The next ones whitelist the traffic of the -app program to the allowed addresses on
+  //    each blocked port, and all traffic on the TAP device.
   //
-  // Crucially, the second has a higher weight.
+  // Crucially, the whitelists have a higher weight.
   //
   // Note:
-  //  - Since OutlineService adds a blanket block on all IPv6 traffic, we only need to create IPv4
-  //    filters.
+  //  - IPv6 filters are needed as dual-stack machines otherwise send queries to the router
+  //    advertised IPv6 resolvers.
   //  - Thanks to the simplicity of the filters and how they will be automatically destroyed on
   //    exit, there's no need to use a transaction here.
+  const GUID layerKeys[] = {FWPM_LAYER_ALE_AUTH_CONNECT_V4, FWPM_LAYER_ALE_AUTH_CONNECT_V6};
+  PCWSTR layerNames[] = {L"IPv4", L"IPv6"};
+  UINT32 interfaceIndexes[] = {interfaceIndex, ipv6InterfaceIndex};
+  int families[] = {AF_INET, AF_INET6};
+  struct {
+    UINT8 proto;
+    UINT16 port;
+    bool strict;
+  } blocked[] = {
+      {IPPROTO_UDP, 53, false},
+      {IPPROTO_TCP, 53, true},
+      {IPPROTO_TCP, 853, true},
+      {IPPROTO_UDP, 853, true},
+  };
+  for (int i = 0; i < 2; i++) {
+    UINT64 filterId;
+    for (auto &b : blocked) {
+      if (b.strict && !strict) {
+        continue;
+      }
+      FWPM_FILTER_CONDITION0 blockConditions[2];
+      blockConditions[0].fieldKey = FWPM_CONDITION_IP_PROTOCOL;
+      blockConditions[0].matchType = FWP_MATCH_EQUAL;
+      blockConditions[0].conditionValue.type = FWP_UINT8;
+      blockConditions[0].conditionValue.uint8 = b.proto;
+      blockConditions[1].fieldKey = FWPM_CONDITION_IP_REMOTE_PORT;
+      blockConditions[1].matchType = FWP_MATCH_EQUAL;
+      blockConditions[1].conditionValue.type = FWP_UINT16;
+      blockConditions[1].conditionValue.uint16 = b.port;
 
-  // Blanket UDP port 53 block.
-  FWPM_FILTER_CONDITION0 udpBlockConditions[2];
-  udpBlockConditions[0].fieldKey = FWPM_CONDITION_IP_PROTOCOL;
-  udpBlockConditions[0].matchType = FWP_MATCH_EQUAL;
-  udpBlockConditions[0].conditionValue.type = FWP_UINT8;
-  udpBlockConditions[0].conditionValue.uint16 = IPPROTO_UDP;
-  udpBlockConditions[1].fieldKey = FWPM_CONDITION_IP_REMOTE_PORT;
-  udpBlockConditions[1].matchType = FWP_MATCH_EQUAL;
-  udpBlockConditions[1].conditionValue.type = FWP_UINT16;
-  udpBlockConditions[1].conditionValue.uint16 = 53;
-
-  FWPM_FILTER0 udpBlockFilter;
-  memset(&udpBlockFilter, 0, sizeof(udpBlockFilter));
-  udpBlockFilter.filterCondition = udpBlockConditions;
-  udpBlockFilter.numFilterConditions = 2;
-  udpBlockFilter.displayData.name = (PWSTR)FILTER_PROVIDER_NAME;
-  udpBlockFilter.subLayerKey = sublayer.subLayerKey;
-  udpBlockFilter.layerKey = FWPM_LAYER_ALE_AUTH_CONNECT_V4;
-  udpBlockFilter.action.type = FWP_ACTION_BLOCK;
-  udpBlockFilter.weight.type = FWP_UINT64;
-  udpBlockFilter.weight.uint64 = &LOWER_FILTER_WEIGHT;
-  UINT64 filterId;
-  result = FwpmFilterAdd0(engine, &udpBlockFilter, NULL, &filterId);
-  if (result != ERROR_SUCCESS) {
-    wcerr << "could not block port 53: " << result << endl;
-    return 1;
+      PCWSTR protoName = b.proto == IPPROTO_UDP ? L"UDP" : L"TCP";
+      result = addFilter(engine, sublayer.subLayerKey, layerKeys[i], blockConditions, 2,
+                         FWP_ACTION_BLOCK, &LOWER_FILTER_WEIGHT, &filterId);
+      if (result != ERROR_SUCCESS) {
+        wcerr << "could not block " << protoName << " port " << b.port << " over "
+              << layerNames[i] << ": " << result << endl;
+        return 1;
+      }
+      wcout << protoName << " port " << b.port << " blocked over " << layerNames[i]
+            << " with filter " << filterId << endl;
+
+      // Whitelist the traffic of the application to the allowed addresses of this family,
+      // on this blocked port only.
+      for (auto &a : allowed) {
+        if (a.family != families[i]) {
+          continue;
+        }
+        FWPM_FILTER_CONDITION0 addrWhitelistConditions[4];
+        addrWhitelistConditions[0] = blockConditions[0];
+        addrWhitelistConditions[1] = blockConditions[1];
+        addrWhitelistConditions[2].fieldKey = FWPM_CONDITION_IP_REMOTE_ADDRESS;
+        addrWhitelistConditions[2].matchType = FWP_MATCH_EQUAL;
+        if (a.family == AF_INET) {
+          addrWhitelistConditions[2].conditionValue.type = FWP_UINT32;
+          addrWhitelistConditions[2].conditionValue.uint32 = a.v4;
+        } else {
+          addrWhitelistConditions[2].conditionValue.type = FWP_BYTE_ARRAY16_TYPE;
+          addrWhitelistConditions[2].conditionValue.byteArray16 = &a.v6;
+        }
+        addrWhitelistConditions[3].fieldKey = FWPM_CONDITION_ALE_APP_ID;
+        addrWhitelistConditions[3].matchType = FWP_MATCH_EQUAL;
+        addrWhitelistConditions[3].conditionValue.type = FWP_BYTE_BLOB_TYPE;
+        addrWhitelistConditions[3].conditionValue.byteBlob = appId;
+        result = addFilter(engine, sublayer.subLayerKey, layerKeys[i], addrWhitelistConditions, 4,
+                           FWP_ACTION_PERMIT, &HIGHER_FILTER_WEIGHT, &filterId);
+        if (result != ERROR_SUCCESS) {
+          wcerr << "could not whitelist " << layerNames[i] << " address on " << protoName
+                << " port " << b.port << ": " << result << endl;
+          return 1;
+        }
+        wcout << "whitelisted " << layerNames[i] << " address on " << protoName << " port "
+              << b.port << " with filter " << filterId << endl;
+      }
+    }
+
+    // Whitelist all traffic on the TAP device, if enabled for this family.
+    if (interfaceIndexes[i] == 0) {
+      continue;
+    }
+    FWPM_FILTER_CONDITION0 tapDeviceWhitelistCondition[1];
+    tapDeviceWhitelistCondition[0].fieldKey = FWPM_CONDITION_LOCAL_INTERFACE_INDEX;
+    tapDeviceWhitelistCondition[0].matchType = FWP_MATCH_EQUAL;
+    tapDeviceWhitelistCondition[0].conditionValue.type = FWP_UINT32;
+    tapDeviceWhitelistCondition[0].conditionValue.uint32 = interfaceIndexes[i];
+
+    result = addFilter(engine, sublayer.subLayerKey, layerKeys[i], tapDeviceWhitelistCondition, 1,
+                       FWP_ACTION_PERMIT, &HIGHER_FILTER_WEIGHT, &filterId);
+    if (result != ERROR_SUCCESS) {
+      wcerr << "could not whitelist " << layerNames[i] << " traffic on " << TAP_DEVICE_NAME << ": "
+            << result << endl;
+      return 1;
+    }
+    wcout << "whitelisted " << layerNames[i] << " traffic on " << TAP_DEVICE_NAME << " with filter "
+          << filterId << endl;
   }
-  wcout << "port 53 blocked with filter " << filterId << endl;
-
-  // Whitelist all traffic on the TAP device.
-  FWPM_FILTER_CONDITION0 tapDeviceWhitelistCondition[1];
-  tapDeviceWhitelistCondition[0].fieldKey = FWPM_CONDITION_LOCAL_INTERFACE_INDEX;
-  tapDeviceWhitelistCondition[0].matchType = FWP_MATCH_EQUAL;
-  tapDeviceWhitelistCondition[0].conditionValue.type = FWP_UINT32;
-  tapDeviceWhitelistCondition[0].conditionValue.uint32 = interfaceIndex;
-
-  FWPM_FILTER0 tapDeviceWhitelistFilter;
-  memset(&tapDeviceWhitelistFilter, 0, sizeof(tapDeviceWhitelistFilter));
-  tapDeviceWhitelistFilter.filterCondition = tapDeviceWhitelistCondition;
-  tapDeviceWhitelistFilter.numFilterConditions = 1;
-  tapDeviceWhitelistFilter.displayData.name = (PWSTR)FILTER_PROVIDER_NAME;
-  tapDeviceWhitelistFilter.subLayerKey = sublayer.subLayerKey;
-  tapDeviceWhitelistFilter.layerKey = FWPM_LAYER_ALE_AUTH_CONNECT_V4;
-  tapDeviceWhitelistFilter.action.type = FWP_ACTION_PERMIT;
-  tapDeviceWhitelistFilter.weight.type = FWP_UINT64;
-  tapDeviceWhitelistFilter.weight.uint64 = &HIGHER_FILTER_WEIGHT;
-
-  result = FwpmFilterAdd0(engine, &tapDeviceWhitelistFilter, NULL, &filterId);
-  if (result != ERROR_SUCCESS) {
-    wcerr << "could not whitelist traffic on " << TAP_DEVICE_NAME << ": " << result << endl;
-    return 1;
+
+  if (appId != NULL) {
+    FwpmFreeMemory0((void **)&appId);
   }
-  wcout << "whitelisted traffic on " << TAP_DEVICE_NAME << " with filter " << filterId << endl;
+
+  // Tell the service the rules are in place.
+  wcout << "ready" << endl;
 
   // Wait forever.
   system("pause");
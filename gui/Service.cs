@@ -52,6 +52,12 @@ namespace NextDNS
 
             [DataMember]
             public string updateChannel;
+
+            [DataMember(EmitDefaultValue = false)]
+            public string url;
+
+            [DataMember(EmitDefaultValue = false)]
+            public long latencyMs;
         }
         class Client
         {
@@ -34,6 +34,7 @@
             this.systrayContextMenu = new System.Windows.Forms.ContextMenuStrip(this.components);
             this.toggle = new System.Windows.Forms.ToolStripMenuItem();
             this.settings = new System.Windows.Forms.ToolStripMenuItem();
+            this.flushCache = new System.Windows.Forms.ToolStripMenuItem();
             this.toolStripSeparator1 = new System.Windows.Forms.ToolStripSeparator();
             this.quit = new System.Windows.Forms.ToolStripMenuItem();
             this.configurationLabel = new System.Windows.Forms.Label();
@@ -47,9 +48,14 @@
             this.cancel = new System.Windows.Forms.Button();
             this.status = new System.Windows.Forms.Label();
             this.statusGroupBox = new System.Windows.Forms.GroupBox();
+            this.upstreamGroupBox = new System.Windows.Forms.GroupBox();
+            this.upstreamURL = new System.Windows.Forms.TextBox();
+            this.checkUpstream = new System.Windows.Forms.Button();
+            this.upstreamResult = new System.Windows.Forms.Label();
             this.systrayContextMenu.SuspendLayout();
             this.generalGroupBox.SuspendLayout();
             this.statusGroupBox.SuspendLayout();
+            this.upstreamGroupBox.SuspendLayout();
             this.SuspendLayout();
             // 
             // systray
@@ -66,10 +72,11 @@
             this.systrayContextMenu.Items.AddRange(new System.Windows.Forms.ToolStripItem[] {
             this.toggle,
             this.settings,
+            this.flushCache,
             this.toolStripSeparator1,
             this.quit});
             this.systrayContextMenu.Name = "systrayContextMenu";
-            this.systrayContextMenu.Size = new System.Drawing.Size(192, 124);
+            this.systrayContextMenu.Size = new System.Drawing.Size(192, 162);
             // 
             // toggle
             // 
@@ -85,6 +92,13 @@
             this.settings.Text = "Settings...";
             this.settings.Click += new System.EventHandler(this.settings_Click);
             // 
+            // flushCache
+            // 
+            this.flushCache.Name = "flushCache";
+            this.flushCache.Size = new System.Drawing.Size(191, 38);
+            this.flushCache.Text = "Flush DNS Cache";
+            this.flushCache.Click += new System.EventHandler(this.flushCache_Click);
+            // 
             // toolStripSeparator1
             // 
             this.toolStripSeparator1.Name = "toolStripSeparator1";
@@ -179,7 +193,7 @@
             // 
             // save
             // 
-            this.save.Location = new System.Drawing.Point(574, 550);
+            this.save.Location = new System.Drawing.Point(574, 700);
             this.save.Margin = new System.Windows.Forms.Padding(6);
             this.save.Name = "save";
             this.save.Size = new System.Drawing.Size(150, 44);
@@ -191,7 +205,7 @@
             // cancel
             // 
             this.cancel.DialogResult = System.Windows.Forms.DialogResult.Cancel;
-            this.cancel.Location = new System.Drawing.Point(412, 550);
+            this.cancel.Location = new System.Drawing.Point(412, 700);
             this.cancel.Margin = new System.Windows.Forms.Padding(6);
             this.cancel.Name = "cancel";
             this.cancel.Size = new System.Drawing.Size(150, 44);
@@ -219,13 +233,55 @@
             this.statusGroupBox.TabStop = false;
             this.statusGroupBox.Text = "Status";
             // 
+            // upstreamGroupBox
+            // 
+            this.upstreamGroupBox.Controls.Add(this.upstreamResult);
+            this.upstreamGroupBox.Controls.Add(this.checkUpstream);
+            this.upstreamGroupBox.Controls.Add(this.upstreamURL);
+            this.upstreamGroupBox.Location = new System.Drawing.Point(13, 510);
+            this.upstreamGroupBox.Name = "upstreamGroupBox";
+            this.upstreamGroupBox.Size = new System.Drawing.Size(711, 170);
+            this.upstreamGroupBox.TabIndex = 10;
+            this.upstreamGroupBox.TabStop = false;
+            this.upstreamGroupBox.Text = "Test Upstream";
+            // 
+            // upstreamURL
+            // 
+            this.upstreamURL.AccessibleName = "Upstream URL";
+            this.upstreamURL.BorderStyle = System.Windows.Forms.BorderStyle.FixedSingle;
+            this.upstreamURL.Location = new System.Drawing.Point(11, 50);
+            this.upstreamURL.Margin = new System.Windows.Forms.Padding(4);
+            this.upstreamURL.Name = "upstreamURL";
+            this.upstreamURL.Size = new System.Drawing.Size(520, 31);
+            this.upstreamURL.TabIndex = 0;
+            // 
+            // checkUpstream
+            // 
+            this.checkUpstream.Location = new System.Drawing.Point(545, 43);
+            this.checkUpstream.Margin = new System.Windows.Forms.Padding(6);
+            this.checkUpstream.Name = "checkUpstream";
+            this.checkUpstream.Size = new System.Drawing.Size(150, 44);
+            this.checkUpstream.TabIndex = 1;
+            this.checkUpstream.Text = "Test";
+            this.checkUpstream.UseVisualStyleBackColor = true;
+            this.checkUpstream.Click += new System.EventHandler(this.checkUpstream_Click);
+            // 
+            // upstreamResult
+            // 
+            this.upstreamResult.AutoSize = true;
+            this.upstreamResult.Location = new System.Drawing.Point(7, 110);
+            this.upstreamResult.Name = "upstreamResult";
+            this.upstreamResult.Size = new System.Drawing.Size(0, 25);
+            this.upstreamResult.TabIndex = 2;
+            // 
             // SettingsForm
             // 
             this.AcceptButton = this.save;
             this.AutoScaleDimensions = new System.Drawing.SizeF(12F, 25F);
             this.AutoScaleMode = System.Windows.Forms.AutoScaleMode.Font;
             this.CancelButton = this.cancel;
-            this.ClientSize = new System.Drawing.Size(736, 609);
+            this.ClientSize = new System.Drawing.Size(736, 759);
+            this.Controls.Add(this.upstreamGroupBox);
             this.Controls.Add(this.statusGroupBox);
             this.Controls.Add(this.cancel);
             this.Controls.Add(this.save);
@@ -241,6 +297,8 @@
             this.generalGroupBox.PerformLayout();
             this.statusGroupBox.ResumeLayout(false);
             this.statusGroupBox.PerformLayout();
+            this.upstreamGroupBox.ResumeLayout(false);
+            this.upstreamGroupBox.PerformLayout();
             this.ResumeLayout(false);
             this.FormClosing += SettingsForm_FormClosing;
         }
@@ -251,6 +309,7 @@
         private System.Windows.Forms.ContextMenuStrip systrayContextMenu;
         private System.Windows.Forms.ToolStripMenuItem toggle;
         private System.Windows.Forms.ToolStripMenuItem settings;
+        private System.Windows.Forms.ToolStripMenuItem flushCache;
         private System.Windows.Forms.ToolStripSeparator toolStripSeparator1;
         private System.Windows.Forms.ToolStripMenuItem quit;
         private System.Windows.Forms.Label configurationLabel;
@@ -264,6 +323,10 @@
         private System.Windows.Forms.Label updateChannelLabel;
         private System.Windows.Forms.Label status;
         private System.Windows.Forms.GroupBox statusGroupBox;
+        private System.Windows.Forms.GroupBox upstreamGroupBox;
+        private System.Windows.Forms.TextBox upstreamURL;
+        private System.Windows.Forms.Button checkUpstream;
+        private System.Windows.Forms.Label upstreamResult;
     }
 }
 
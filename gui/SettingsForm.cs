@@ -117,6 +117,22 @@ namespace NextDNS
                         MessageBox.Show(e.data.error, "NextDNS Error", MessageBoxButtons.OK, MessageBoxIcon.Error);
                     }
                     break;
+                case "checkUpstream":
+                    if (e.data.url != upstreamURL.Text)
+                    {
+                        // Result of a previous test
+                        break;
+                    }
+                    checkUpstream.Enabled = true;
+                    if (e.data.error != null && e.data.error != "")
+                    {
+                        upstreamResult.Text = "Failed: " + e.data.error;
+                    }
+                    else
+                    {
+                        upstreamResult.Text = String.Format("OK, answered in {0} ms", e.data.latencyMs);
+                    }
+                    break;
                 default:
                     break;
             }
@@ -160,6 +176,37 @@ namespace NextDNS
             WindowState = FormWindowState.Normal;
         }
 
+        async private void flushCache_Click(object sender, EventArgs e)
+        {
+            try
+            {
+                await service.SendAsync(new Service.Event("flushCache")).ConfigureAwait(false);
+            }
+            catch (Exception)
+            {
+                // Not connected to the service, nothing to flush
+            }
+        }
+
+        async private void checkUpstream_Click(object sender, EventArgs e)
+        {
+            var check = new Service.Event("checkUpstream");
+            check.data = new Service.EventData();
+            check.data.url = upstreamURL.Text;
+            checkUpstream.Enabled = false;
+            upstreamResult.Text = "Testing...";
+            try
+            {
+                // The result comes back as a checkUpstream event.
+                await service.SendAsync(check);
+            }
+            catch (Exception)
+            {
+                checkUpstream.Enabled = true;
+                upstreamResult.Text = "Not connected to the service";
+            }
+        }
+
         private void toggle_Click(object sender, EventArgs e)
         {
             Properties.Settings.Default.Enabled = State == StateStopped;
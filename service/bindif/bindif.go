@@ -0,0 +1,3 @@
+// Package bindif binds sockets to a network interface so their traffic goes
+// out of it whatever the routing table says.
+package bindif
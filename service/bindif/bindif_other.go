@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package bindif
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Control returns a net.Dialer Control function binding the sockets to the
+// interface with the given name.
+func Control(name string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("not implemented")
+	}
+}
@@ -0,0 +1,46 @@
+package bindif
+
+import (
+	"fmt"
+	"math/bits"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// unicastIf is the IP_UNICAST_IF and IPV6_UNICAST_IF socket option, setting
+// the interface the unicast traffic of a socket is sent on.
+const unicastIf = 31
+
+// Control returns a net.Dialer Control function binding the sockets to the
+// interface with the given name, its friendly name like "Ethernet". The
+// interface is looked up at each dial as its index changes when it is
+// reinstalled.
+func Control(name string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			return fmt.Errorf("interface %s: %v", name, err)
+		}
+		var serr error
+		err = c.Control(func(fd uintptr) {
+			h := windows.Handle(fd)
+			switch network {
+			case "tcp4", "udp4":
+				// The IPv4 option takes the index in network byte order.
+				idx := bits.ReverseBytes32(uint32(ifi.Index))
+				serr = windows.SetsockoptInt(h, windows.IPPROTO_IP, unicastIf, int(idx))
+			case "tcp6", "udp6":
+				serr = windows.SetsockoptInt(h, windows.IPPROTO_IPV6, unicastIf, ifi.Index)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if serr != nil {
+			return fmt.Errorf("bind to interface %s: %v", name, serr)
+		}
+		return nil
+	}
+}
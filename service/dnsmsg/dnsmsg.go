@@ -0,0 +1,342 @@
+// Package dnsmsg parses and edits DNS messages in wire format in place,
+// without decoding them entirely. All the functions accept malformed messages:
+// they report them as such instead of panicking.
+package dnsmsg
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// HeaderLen is the length of the DNS message header.
+const HeaderLen = 12
+
+// Record types.
+const (
+	TypeA     = 1
+	TypeCNAME = 5
+	TypeSOA   = 6
+	TypePTR   = 12
+	TypeAAAA  = 28
+	TypeOPT   = 41
+	TypeSVCB  = 64
+	TypeHTTPS = 65
+	TypeANY   = 255
+)
+
+// ClassIN is the Internet class.
+const ClassIN = 1
+
+// Response codes.
+const (
+	RCodeNoError  = 0
+	RCodeServFail = 2
+	RCodeNXDomain = 3
+	RCodeRefused  = 5
+)
+
+// Sections holding resource records.
+const (
+	SectionAnswer = iota
+	SectionAuthority
+	SectionAdditional
+)
+
+// ID returns the ID of msg, or 0 if msg is too short.
+func ID(msg []byte) uint16 {
+	if len(msg) < 2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(msg)
+}
+
+// SetID sets the ID of msg if it is long enough to have one.
+func SetID(msg []byte, id uint16) {
+	if len(msg) >= 2 {
+		binary.BigEndian.PutUint16(msg, id)
+	}
+}
+
+// RCode returns the response code of msg, or -1 if msg is too short.
+func RCode(msg []byte) int {
+	if len(msg) < HeaderLen {
+		return -1
+	}
+	return int(msg[3] & 0xf)
+}
+
+// Truncated reports if the TC flag of msg is set.
+func Truncated(msg []byte) bool {
+	return len(msg) >= HeaderLen && msg[2]&0x2 != 0
+}
+
+// SetTruncated sets the TC flag of msg.
+func SetTruncated(msg []byte) {
+	if len(msg) >= HeaderLen {
+		msg[2] |= 0x2
+	}
+}
+
+// AuthenticData reports if the AD flag of msg is set.
+func AuthenticData(msg []byte) bool {
+	return len(msg) >= HeaderLen && msg[3]&0x20 != 0
+}
+
+// ClearAuthenticData clears the AD flag of msg.
+func ClearAuthenticData(msg []byte) {
+	if len(msg) >= HeaderLen {
+		msg[3] &^= 0x20
+	}
+}
+
+// CheckingDisabled reports if the CD flag of msg is set.
+func CheckingDisabled(msg []byte) bool {
+	return len(msg) >= HeaderLen && msg[3]&0x10 != 0
+}
+
+// DNSSECOK reports if the DO flag of the OPT record of msg is set.
+func DNSSECOK(msg []byte) bool {
+	opt, ok := FindOPT(msg)
+	// The TTL holds the extended rcode, the version and the flags, DO
+	// being the highest bit.
+	return ok && msg[opt.TTLOff+2]&0x80 != 0
+}
+
+// SetAuthoritative sets the AA flag of msg.
+func SetAuthoritative(msg []byte) {
+	if len(msg) >= HeaderLen {
+		msg[2] |= 0x4
+	}
+}
+
+// Count returns the number of records of msg in section.
+func Count(msg []byte, section int) int {
+	if len(msg) < HeaderLen || section < SectionAnswer || section > SectionAdditional {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(msg[6+2*section:]))
+}
+
+// QuestionCount returns the number of questions of msg.
+func QuestionCount(msg []byte) int {
+	if len(msg) < HeaderLen {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(msg[4:]))
+}
+
+// SkipName returns the offset following the name starting at off, or -1 if
+// the name is malformed.
+func SkipName(msg []byte, off int) int {
+	for off >= 0 && off < len(msg) {
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1
+		case l&0xc0 == 0xc0:
+			// Compression pointer, the name ends here.
+			if off+2 > len(msg) {
+				return -1
+			}
+			return off + 2
+		case l&0xc0 != 0:
+			return -1
+		}
+		off += 1 + l
+	}
+	return -1
+}
+
+// ParseQuestion parses the first question of msg and returns its lower-cased
+// name, type and class. The returned offset points right after the question.
+func ParseQuestion(msg []byte) (name string, qtype, qclass uint16, off int, ok bool) {
+	if len(msg) < HeaderLen || binary.BigEndian.Uint16(msg[4:6]) == 0 {
+		return "", 0, 0, 0, false
+	}
+	qn := &strings.Builder{}
+	off = HeaderLen
+	for {
+		if off >= len(msg) {
+			return "", 0, 0, 0, false
+		}
+		l := int(msg[off])
+		if l == 0 {
+			off++
+			break
+		}
+		if l&0xc0 != 0 || off+1+l > len(msg) {
+			// Compression is not expected in the question of a query.
+			return "", 0, 0, 0, false
+		}
+		qn.Write(msg[off+1 : off+1+l])
+		qn.WriteByte('.')
+		off += 1 + l
+	}
+	if off+4 > len(msg) {
+		return "", 0, 0, 0, false
+	}
+	qtype = binary.BigEndian.Uint16(msg[off:])
+	qclass = binary.BigEndian.Uint16(msg[off+2:])
+	return strings.ToLower(qn.String()), qtype, qclass, off + 4, true
+}
+
+// Question is a question of a DNS message.
+type Question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// Questions parses all the questions of msg, in the ParseQuestion form. ok is
+// false if one of them is malformed.
+func Questions(msg []byte) (qs []Question, ok bool) {
+	off := HeaderLen
+	for i := QuestionCount(msg); i > 0; i-- {
+		name, ok := ReadName(msg, off)
+		if off = SkipName(msg, off); !ok || off < 0 || off+4 > len(msg) {
+			return nil, false
+		}
+		qs = append(qs, Question{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(msg[off:]),
+			Class: binary.BigEndian.Uint16(msg[off+2:]),
+		})
+		off += 4
+	}
+	return qs, len(qs) > 0
+}
+
+// ReadName returns the lower-cased name starting at off in msg, following
+// compression pointers, in the ParseQuestion form. ok is false if the name is
+// malformed.
+func ReadName(msg []byte, off int) (name string, ok bool) {
+	const maxPointers = 16
+	n := &strings.Builder{}
+	pointers := 0
+	for off >= 0 && off < len(msg) {
+		l := int(msg[off])
+		switch l & 0xc0 {
+		case 0:
+			if l == 0 {
+				return strings.ToLower(n.String()), true
+			}
+			if off+1+l > len(msg) {
+				return "", false
+			}
+			n.Write(msg[off+1 : off+1+l])
+			n.WriteByte('.')
+			off += 1 + l
+		case 0xc0:
+			if off+2 > len(msg) || pointers >= maxPointers {
+				return "", false
+			}
+			pointers++
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// QName returns the name of the first question of msg as is. Unlike
+// ParseQuestion, it follows compression pointers and returns what could be
+// parsed of a malformed name, which makes it suited for logging.
+func QName(msg []byte) string {
+	const maxPointers = 16
+	qn := &strings.Builder{}
+	pointers := 0
+	for n := HeaderLen; n < len(msg) && msg[n] != 0; {
+		l := int(msg[n])
+		switch l & 0xc0 {
+		case 0:
+		case 0xc0:
+			if n+2 > len(msg) || pointers >= maxPointers {
+				// invalid pointer, stop parsing
+				return qn.String()
+			}
+			pointers++
+			n = int(binary.BigEndian.Uint16(msg[n:]) & 0x3fff)
+			continue
+		default:
+			// reserved label type, stop parsing
+			return qn.String()
+		}
+		end := n + 1 + l
+		if end > len(msg) {
+			// invalid qname, stop parsing
+			break
+		}
+		qn.Write(msg[n+1 : end])
+		qn.WriteByte('.')
+		n = end
+	}
+	return qn.String()
+}
+
+// RR describes a resource record found while walking a DNS message.
+type RR struct {
+	Type     uint16
+	Class    uint16
+	Section  int
+	Off      int // offset of the record in the message
+	TTLOff   int // offset of the TTL field in the message
+	RDataOff int // offset of the record data in the message
+	RDataLen int
+}
+
+// End returns the offset following r in the message.
+func (r RR) End() int {
+	return r.RDataOff + r.RDataLen
+}
+
+// WalkRRs calls fn for each resource record of the answer, authority and
+// additional sections of msg. It returns false if msg is malformed.
+func WalkRRs(msg []byte, fn func(r RR)) bool {
+	if len(msg) < HeaderLen {
+		return false
+	}
+	off := HeaderLen
+	for i := binary.BigEndian.Uint16(msg[4:6]); i > 0; i-- {
+		if off = SkipName(msg, off); off < 0 || off+4 > len(msg) {
+			return false
+		}
+		off += 4
+	}
+	for section := SectionAnswer; section <= SectionAdditional; section++ {
+		count := int(binary.BigEndian.Uint16(msg[6+2*section:]))
+		for i := 0; i < count; i++ {
+			start := off
+			if off = SkipName(msg, off); off < 0 || off+10 > len(msg) {
+				return false
+			}
+			r := RR{
+				Type:     binary.BigEndian.Uint16(msg[off:]),
+				Class:    binary.BigEndian.Uint16(msg[off+2:]),
+				Section:  section,
+				Off:      start,
+				TTLOff:   off + 4,
+				RDataOff: off + 10,
+				RDataLen: int(binary.BigEndian.Uint16(msg[off+8:])),
+			}
+			off = r.End()
+			if off > len(msg) {
+				return false
+			}
+			fn(r)
+		}
+	}
+	return true
+}
+
+// FindOPT returns the OPT pseudo-record of msg. The class of the record holds
+// the UDP payload size of the sender. If msg has no OPT record or is
+// malformed, ok is false.
+func FindOPT(msg []byte) (opt RR, ok bool) {
+	valid := WalkRRs(msg, func(r RR) {
+		if !ok && r.Type == TypeOPT && r.Section == SectionAdditional {
+			opt, ok = r, true
+		}
+	})
+	return opt, valid && ok
+}
@@ -0,0 +1,239 @@
+package dnsmsg
+
+import "testing"
+
+// query is an A query for example.com with an OPT record setting DO.
+var query = []byte{
+	0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 1,
+	7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, TypeA, 0, ClassIN,
+	0, 0, TypeOPT, 0x10, 0, 0, 0, 0x80, 0, 0, 0,
+}
+
+// response is the response to query with a CNAME and an A record using
+// compression pointers, and an OPT record not setting DO.
+var response = []byte{
+	0x12, 0x34, 0x81, 0x80, 0, 1, 0, 2, 0, 0, 0, 1,
+	7, 'E', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, TypeA, 0, ClassIN,
+	0xc0, 12, 0, TypeCNAME, 0, ClassIN, 0, 0, 0, 60, 0, 6,
+	3, 'w', 'w', 'w', 0xc0, 12,
+	0xc0, 41, 0, TypeA, 0, ClassIN, 0, 0, 0, 60, 0, 4, 192, 0, 2, 1,
+	0, 0, TypeOPT, 0x04, 0xd0, 0, 0, 0, 0, 0, 0,
+}
+
+func TestHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		msg    []byte
+		id     uint16
+		rcode  int
+		qcount int
+	}{
+		{"empty", nil, 0, -1, 0},
+		{"id only", []byte{0x12, 0x34}, 0x1234, -1, 0},
+		{"truncated header", query[:HeaderLen-1], 0x1234, -1, 0},
+		{"header only", query[:HeaderLen], 0x1234, RCodeNoError, 1},
+		{"query", query, 0x1234, RCodeNoError, 1},
+		{"refused", append([]byte{0, 1, 0x81, 0x85}, make([]byte, 8)...), 1, RCodeRefused, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if id := ID(tt.msg); id != tt.id {
+				t.Errorf("ID() = %#x, want %#x", id, tt.id)
+			}
+			if rcode := RCode(tt.msg); rcode != tt.rcode {
+				t.Errorf("RCode() = %d, want %d", rcode, tt.rcode)
+			}
+			if n := QuestionCount(tt.msg); n != tt.qcount {
+				t.Errorf("QuestionCount() = %d, want %d", n, tt.qcount)
+			}
+			if len(tt.msg) < HeaderLen {
+				// None of them may touch a short message.
+				msg := append([]byte(nil), tt.msg...)
+				SetTruncated(msg)
+				ClearAuthenticData(msg)
+				SetAuthoritative(msg)
+				if Truncated(msg) || AuthenticData(msg) || CheckingDisabled(msg) || DNSSECOK(msg) {
+					t.Error("flag reported on a truncated header")
+				}
+				if string(msg) != string(tt.msg) {
+					t.Error("truncated header modified")
+				}
+			}
+		})
+	}
+}
+
+func TestParseQuestion(t *testing.T) {
+	tests := []struct {
+		name  string
+		msg   []byte
+		qname string
+		qtype uint16
+		off   int
+		ok    bool
+	}{
+		{"query", query, "example.com.", TypeA, 29, true},
+		{"lower-cased", response, "example.com.", TypeA, 29, true},
+		{"truncated header", query[:HeaderLen-1], "", 0, 0, false},
+		{"no question", append([]byte{0, 1, 1, 0, 0, 0}, make([]byte, 6)...), "", 0, 0, false},
+		{"label past the end", query[:15], "", 0, 0, false},
+		{"no root label", query[:24], "", 0, 0, false},
+		{"truncated type", query[:27], "", 0, 0, false},
+		{"pointer", []byte{0, 1, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xc0, 12, 0, 1, 0, 1}, "", 0, 0, false},
+		{"reserved label type", []byte{0, 1, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0x40, 0, 0, 1, 0, 1}, "", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, qtype, _, off, ok := ParseQuestion(tt.msg)
+			if name != tt.qname || qtype != tt.qtype || off != tt.off || ok != tt.ok {
+				t.Errorf("ParseQuestion() = %q, %d, %d, %v, want %q, %d, %d, %v",
+					name, qtype, off, ok, tt.qname, tt.qtype, tt.off, tt.ok)
+			}
+		})
+	}
+}
+
+func TestReadName(t *testing.T) {
+	loop := append([]byte(nil), response[:HeaderLen]...)
+	loop = append(loop, 0xc0, 12)
+	loop2 := append([]byte(nil), response[:HeaderLen]...)
+	loop2 = append(loop2, 1, 'a', 0xc0, 16, 1, 'b', 0xc0, 12)
+	tests := []struct {
+		name  string
+		msg   []byte
+		off   int
+		want  string
+		ok    bool
+		qname string
+	}{
+		{"question", response, 12, "example.com.", true, "Example.com."},
+		{"pointer", response, 29, "example.com.", true, "Example.com."},
+		{"label and pointer", response, 41, "www.example.com.", true, "Example.com."},
+		{"label past the end", response[:16], 12, "", false, ""},
+		{"truncated pointer", response[:30], 29, "", false, "Example.com."},
+		{"offset past the end", response, len(response), "", false, "Example.com."},
+		{"negative offset", response, -1, "", false, "Example.com."},
+		{"pointer past the end", append(append([]byte(nil), response[:HeaderLen]...), 0xc0, 0xff), 12, "", false, ""},
+		{"pointer loop", loop, 12, "", false, ""},
+		{"pointer cycle", loop2, 12, "", false, "a.b.a.b.a.b.a.b.a.b.a.b.a.b.a.b.a."},
+		{"reserved label type", append(append([]byte(nil), response[:HeaderLen]...), 0x80, 0), 12, "", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, ok := ReadName(tt.msg, tt.off)
+			if name != tt.want || ok != tt.ok {
+				t.Errorf("ReadName() = %q, %v, want %q, %v", name, ok, tt.want, tt.ok)
+			}
+			if qname := QName(tt.msg); qname != tt.qname {
+				t.Errorf("QName() = %q, want %q", qname, tt.qname)
+			}
+		})
+	}
+}
+
+func TestWalkRRs(t *testing.T) {
+	// rdlenOverflow has an A record claiming more data than the message has.
+	rdlenOverflow := append([]byte(nil), response[:63]...)
+	rdlenOverflow[58] = 0xff
+	tests := []struct {
+		name  string
+		msg   []byte
+		types []uint16
+		ok    bool
+	}{
+		{"query", query, []uint16{TypeOPT}, true},
+		{"response", response, []uint16{TypeCNAME, TypeA, TypeOPT}, true},
+		{"truncated header", response[:HeaderLen-1], nil, false},
+		{"truncated question", response[:27], nil, false},
+		{"truncated record header", response[:38], nil, false},
+		{"truncated rdata", response[:45], nil, false},
+		{"rdlength overflow", rdlenOverflow, []uint16{TypeCNAME}, false},
+		{"missing records", response[:63], []uint16{TypeCNAME, TypeA}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var types []uint16
+			ok := WalkRRs(tt.msg, func(r RR) {
+				if r.End() > len(tt.msg) {
+					t.Errorf("record %d ends past the message at %d", r.Type, r.End())
+				}
+				types = append(types, r.Type)
+			})
+			if ok != tt.ok || len(types) != len(tt.types) {
+				t.Fatalf("WalkRRs() = %v with types %v, want %v with types %v", ok, types, tt.ok, tt.types)
+			}
+			for i := range types {
+				if types[i] != tt.types[i] {
+					t.Errorf("WalkRRs() types %v, want %v", types, tt.types)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestDNSSECOK(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  []byte
+		want bool
+	}{
+		{"do", query, true},
+		{"no do", response, false},
+		{"no opt", query[:29], false},
+		{"short ttl", query[:len(query)-5], false},
+		{"short rdlength", query[:len(query)-1], false},
+		{"truncated header", query[:HeaderLen-1], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DNSSECOK(tt.msg); got != tt.want {
+				t.Errorf("DNSSECOK() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindOPT(t *testing.T) {
+	opt, ok := FindOPT(response)
+	if !ok || opt.Class != 1232 || opt.Off != 63 {
+		t.Errorf("FindOPT() = %+v, %v, want class 1232 at 63", opt, ok)
+	}
+	// An OPT record out of the additional section is not the one of the
+	// message.
+	msg := append([]byte(nil), query...)
+	msg[7], msg[11] = 1, 0
+	if _, ok := FindOPT(msg); ok {
+		t.Error("FindOPT() found an OPT record in the answer section")
+	}
+}
+
+// FuzzParse checks the parsing functions do not panic on malformed
+// messages, and that the records reported by WalkRRs are within msg.
+func FuzzParse(f *testing.F) {
+	for _, msg := range [][]byte{query, response, query[:20], response[:50]} {
+		f.Add(msg)
+	}
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		ParseQuestion(msg)
+		Questions(msg)
+		QName(msg)
+		for off := 0; off < len(msg); off++ {
+			ReadName(msg, off)
+			SkipName(msg, off)
+		}
+		WalkRRs(msg, func(r RR) {
+			if r.Off < HeaderLen || r.End() > len(msg) {
+				t.Fatalf("record %+v out of the message of %d bytes", r, len(msg))
+			}
+		})
+		FindOPT(msg)
+		DNSSECOK(msg)
+		if len(msg) > 0 {
+			SetTruncated(msg)
+			ClearAuthenticData(msg)
+			SetAuthoritative(msg)
+			SetID(msg, 1)
+		}
+	})
+}
@@ -1,13 +1,33 @@
 module github.com/nextdns/windows
 
-go 1.13
+go 1.22
 
 require (
 	github.com/Microsoft/go-winio v0.4.19
 	github.com/denisbrodbeck/machineid v1.0.1
-	github.com/lucas-clemente/quic-go v0.21.0 // indirect
 	github.com/nextdns/nextdns v1.32.4-0.20210609225858-e676abf58c20
-	golang.org/x/crypto v0.0.0-20210513164829-c07d793c2f9a // indirect
-	golang.org/x/net v0.0.0-20210525063256-abc453219eb5 // indirect
-	golang.org/x/sys v0.0.0-20210608053332-aa57babbf139
+	github.com/quic-go/quic-go v0.48.2
+	golang.org/x/crypto v0.26.0
+	golang.org/x/net v0.28.0
+	golang.org/x/sys v0.23.0
+)
+
+require (
+	github.com/cheekybits/genny v1.0.0 // indirect
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
+	github.com/golang/mock v1.6.0 // indirect
+	github.com/google/pprof v0.0.0-20210720184732-4bb14d4b1be1 // indirect
+	github.com/lucas-clemente/quic-go v0.21.0 // indirect
+	github.com/marten-seemann/qpack v0.2.1 // indirect
+	github.com/marten-seemann/qtls-go1-15 v0.1.4 // indirect
+	github.com/marten-seemann/qtls-go1-16 v0.1.3 // indirect
+	github.com/marten-seemann/qtls-go1-17 v0.1.0-alpha.1 // indirect
+	github.com/onsi/ginkgo v1.16.4 // indirect
+	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
+	github.com/quic-go/qpack v0.5.1 // indirect
+	go.uber.org/mock v0.4.0 // indirect
+	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842 // indirect
+	golang.org/x/mod v0.17.0 // indirect
+	golang.org/x/text v0.17.0 // indirect
+	golang.org/x/tools v0.21.1-0.20240508182429-e35e4ccd0d2d // indirect
 )
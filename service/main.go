@@ -8,11 +8,14 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/denisbrodbeck/machineid"
 
 	"github.com/nextdns/windows/ctl"
+	"github.com/nextdns/windows/netchange"
 	"github.com/nextdns/windows/proxy"
 	"github.com/nextdns/windows/settings"
 	"github.com/nextdns/windows/svc"
@@ -29,9 +32,59 @@ type impl interface {
 	Stop() error
 }
 
+// statsProvider is implemented by impls exposing query statistics.
+type statsProvider interface {
+	Stats() proxy.Stats
+	ResetStats()
+}
+
+// cacheFlusher is implemented by impls caching responses.
+type cacheFlusher interface {
+	FlushCache(name string)
+}
+
+// pauser is implemented by impls able to toggle the protection without
+// stopping.
+type pauser interface {
+	Pause() error
+	Resume() error
+}
+
+// userAgentSetter is implemented by impls sending a User-Agent upstream.
+type userAgentSetter interface {
+	SetUserAgent(ua string)
+}
+
+// recentQueriesProvider is implemented by impls keeping the last queries.
+type recentQueriesProvider interface {
+	RecentQueries() []proxy.RecentQuery
+}
+
+// upstreamChecker is implemented by impls able to test an upstream.
+type upstreamChecker interface {
+	CheckUpstream(u string) (time.Duration, error)
+}
+
+// logLevelSetter is implemented by impls with leveled logs.
+type logLevelSetter interface {
+	SetLogLevel(l proxy.LogLevel)
+}
+
+// blocklistReloader is implemented by impls with a local blocklist.
+type blocklistReloader interface {
+	ReloadBlocklist() error
+}
+
+// networkChangeHandler is implemented by impls needing to know about network
+// changes.
+type networkChangeHandler interface {
+	NetworkChanged()
+}
+
 type nextdnsSvc struct {
 	impl impl
 	ctl  ctl.Server
+	net  netchange.Watcher
 	log  svc.Logger
 }
 
@@ -39,6 +92,12 @@ func (s *nextdnsSvc) Start(log svc.Logger) error {
 	s.log = log
 	log.Info("Service starting")
 	defer log.Info("Service started")
+	if h, ok := s.impl.(networkChangeHandler); ok {
+		s.net.OnChange = h.NetworkChanged
+		if err := s.net.Start(); err != nil {
+			log.Error(fmt.Sprintf("network change watcher: %v", err))
+		}
+	}
 	return s.ctl.Start()
 }
 
@@ -46,6 +105,7 @@ func (s *nextdnsSvc) Stop(log svc.Logger) error {
 	s.log = log
 	log.Info("Service stopping")
 	defer log.Info("Service stopped")
+	s.net.Stop()
 	if err := s.impl.Stop(); err != nil {
 		return err
 	}
@@ -129,14 +189,28 @@ func run(debug bool) error {
 					} else {
 						s.impl.SetDeviceInfo("", "", "", vers)
 					}
+					if uas, ok := s.impl.(userAgentSetter); ok {
+						// An empty one restores the default.
+						uas.SetUserAgent(stg.UserAgent)
+					}
 					up.SetAutoRun(stg.CheckUpdates)
 
-					// Switch connection status
+					// Switch connection status. Once started, pause instead
+					// of stopping to not go through the driver stop path.
 					var err error
-					if stg.Enabled {
+					pr, canPause := s.impl.(pauser)
+					canPause = canPause && s.impl.State() != proxy.StateStopped
+					switch {
+					case stg.Enabled && canPause:
+						s.log.Info("Resuming service")
+						err = pr.Resume()
+					case stg.Enabled:
 						s.log.Info("Starting service")
 						err = s.impl.Start()
-					} else {
+					case canPause:
+						s.log.Info("Pausing service")
+						err = pr.Pause()
+					default:
 						s.log.Info("Stopping service")
 						err = s.impl.Stop()
 					}
@@ -145,6 +219,80 @@ func run(debug bool) error {
 							"state": s.impl.State(),
 							"error": err.Error(),
 						})
+					} else if canPause {
+						broadcast("status", map[string]interface{}{
+							"state":  s.impl.State(),
+							"paused": !stg.Enabled,
+						})
+					}
+				case "stats":
+					sp, ok := s.impl.(statsProvider)
+					if !ok {
+						return
+					}
+					if reset, _ := e.Data["reset"].(bool); reset {
+						sp.ResetStats()
+					}
+					broadcast("stats", statsData(sp.Stats()))
+				case "flushCache":
+					cf, ok := s.impl.(cacheFlusher)
+					if !ok {
+						return
+					}
+					name, _ := e.Data["name"].(string)
+					cf.FlushCache(name)
+				case "recentQueries":
+					rp, ok := s.impl.(recentQueriesProvider)
+					if !ok {
+						return
+					}
+					// Not through broadcast to keep the names out of the
+					// service log.
+					err := s.ctl.Broadcast(ctl.Event{
+						Name: "recentQueries",
+						Data: map[string]interface{}{"queries": rp.RecentQueries()},
+					})
+					if err != nil {
+						s.log.Error(fmt.Sprintf("send event error: %v", err))
+					}
+				case "checkUpstream":
+					uc, ok := s.impl.(upstreamChecker)
+					if !ok {
+						return
+					}
+					u, _ := e.Data["url"].(string)
+					// The check takes up to the query timeout, do not hold
+					// the other events meanwhile.
+					go func() {
+						data := map[string]interface{}{"url": u}
+						if latency, err := uc.CheckUpstream(u); err != nil {
+							data["error"] = err.Error()
+						} else {
+							data["latencyMs"] = latency.Milliseconds()
+						}
+						broadcast("checkUpstream", data)
+					}()
+				case "logLevel":
+					// Lets support turn the debug messages on without a new
+					// build, until the service restarts.
+					ls, ok := s.impl.(logLevelSetter)
+					if !ok {
+						return
+					}
+					name, _ := e.Data["level"].(string)
+					l, err := proxy.ParseLogLevel(name)
+					if err != nil {
+						s.log.Error(err.Error())
+						return
+					}
+					ls.SetLogLevel(l)
+				case "reloadBlocklist":
+					br, ok := s.impl.(blocklistReloader)
+					if !ok {
+						return
+					}
+					if err := br.ReloadBlocklist(); err != nil {
+						s.log.Error(fmt.Sprintf("blocklist: %v", err))
 					}
 				default:
 					s.log.Error(fmt.Sprintf("invalid event: %v", e))
@@ -160,26 +308,40 @@ func run(debug bool) error {
 			},
 		}
 	} else {
-		s.impl = &proxy.Proxy{
+		ex, _ := os.Executable()
+		p := &proxy.Proxy{
+			UserAgent:         proxy.DefaultUserAgent + "/" + vers,
+			RecentQueriesSize: 100,
+			Cache: &proxy.Cache{
+				Path: filepath.Join(filepath.Dir(ex), "cache.dat"),
+			},
+			Blocklist: &proxy.Blocklist{
+				Path: filepath.Join(filepath.Dir(ex), "blocklist.txt"),
+			},
 			// Bootstrap with a fake transport that avoid DNS lookup
 			OnStateChange: func(state string) {
 				broadcast("status", map[string]interface{}{"state": state})
 			},
+			OnLeakProtectionChange: func(protected bool) {
+				broadcast("status", map[string]interface{}{"leakProtection": protected})
+			},
 			// QueryLog: func(msgID uint16, qname string) {
 			// 	s.log.Info(fmt.Sprintf("resolve %x %s", msgID, qname))
 			// },
-			InfoLog: func(msg string) {
-				s.log.Info(msg)
-			},
-			ErrorLog: func(err error) {
-				s.log.Error(fmt.Sprint(err))
-			},
+			Logger: proxyLogger{s},
+		}
+		if debug {
+			p.SetLogLevel(proxy.LogLevelDebug)
 		}
+		s.impl = p
 	}
 
 	s.ctl.ErrorLog = func(err error) {
 		s.log.Error(fmt.Sprint(err))
 	}
+	s.net.ErrorLog = func(err error) {
+		s.log.Error(fmt.Sprint(err))
+	}
 	up.OnUpgrade = func(newVersion string) {
 		s.log.Info(fmt.Sprintf("upgrading from %s to %s", updater.CurrentVersion(), newVersion))
 	}
@@ -194,6 +356,57 @@ func run(debug bool) error {
 	return svc.Run(s, "NextDNSService", debug)
 }
 
+func statsData(st proxy.Stats) map[string]interface{} {
+	var lastHealthCheck int64
+	if !st.LastHealthCheck.IsZero() {
+		lastHealthCheck = st.LastHealthCheck.Unix()
+	}
+	return map[string]interface{}{
+		"queries":           st.Queries,
+		"cacheHits":         st.CacheHits,
+		"upstreamErrors":    st.UpstreamErrors,
+		"timeouts":          st.Timeouts,
+		"dedupDrops":        st.DedupDrops,
+		"limitDrops":        st.LimitDrops,
+		"rateLimited":       st.RateLimited,
+		"blocklisted":       st.Blocklisted,
+		"tunWriteDrops":     st.TunWriteDrops,
+		"bytesIn":           st.BytesIn,
+		"bytesOut":          st.BytesOut,
+		"upstreamLatencyMs": st.UpstreamLatency.Milliseconds(),
+		"lastHealthCheck":   lastHealthCheck,
+		"connection":        st.Connection,
+		"packetBuffers":     st.PacketBuffers,
+		"trippedUpstreams":  st.TrippedUpstreams,
+		"querySizes":        sizesData(st.QuerySizes),
+		"responseSizes":     sizesData(st.ResponseSizes),
+	}
+}
+
+func sizesData(h proxy.SizeHistogram) map[string]interface{} {
+	var avg uint64
+	if h.Count > 0 {
+		avg = h.Sum / h.Count
+	}
+	return map[string]interface{}{
+		"buckets": h.Buckets,
+		"count":   h.Count,
+		"avg":     avg,
+		"max":     h.Max,
+	}
+}
+
+// proxyLogger sends the proxy messages to the service log, the debug ones as
+// info as the event log has no such level.
+type proxyLogger struct {
+	s *nextdnsSvc
+}
+
+func (l proxyLogger) Debug(msg string) { l.s.log.Info(msg) }
+func (l proxyLogger) Info(msg string)  { l.s.log.Info(msg) }
+func (l proxyLogger) Warn(msg string)  { l.s.log.Warn(msg) }
+func (l proxyLogger) Error(msg string) { l.s.log.Error(msg) }
+
 type writerFunc func(p []byte) (n int, err error)
 
 func (w writerFunc) Write(p []byte) (n int, err error) {
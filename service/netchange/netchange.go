@@ -0,0 +1,28 @@
+// Package netchange notifies about changes of the system network
+// configuration, like when resuming from standby or switching network.
+package netchange
+
+import "time"
+
+// settleDelay is the time to wait after a change before notifying, so the
+// burst of changes happening when an interface comes up is reported once.
+const settleDelay = time.Second
+
+// Watcher calls OnChange each time an IP address is added or removed on one of
+// the system interfaces.
+type Watcher struct {
+	OnChange func()
+
+	// ErrorLog specifies an optional log function for errors. If not set,
+	// errors are not reported.
+	ErrorLog func(error)
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (w *Watcher) logErr(err error) {
+	if err != nil && w.ErrorLog != nil {
+		w.ErrorLog(err)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package netchange
+
+import "errors"
+
+// Start starts watching for changes.
+func (w *Watcher) Start() error {
+	return errors.New("not implemented")
+}
+
+// Stop stops watching for changes.
+func (w *Watcher) Stop() error {
+	return nil
+}
@@ -0,0 +1,85 @@
+package netchange
+
+import (
+	"fmt"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	iphlpapi                 = windows.NewLazySystemDLL("iphlpapi.dll")
+	procNotifyAddrChange     = iphlpapi.NewProc("NotifyAddrChange")
+	procCancelIPChangeNotify = iphlpapi.NewProc("CancelIPChangeNotify")
+)
+
+// Start starts watching for changes.
+func (w *Watcher) Start() error {
+	if err := procNotifyAddrChange.Find(); err != nil {
+		return err
+	}
+	changed, err := windows.CreateEvent(nil, 0, 0, nil)
+	if err != nil {
+		return err
+	}
+	stop, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		windows.CloseHandle(changed)
+		return err
+	}
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
+	go w.run(changed, stop)
+	go func() {
+		select {
+		case <-w.stop:
+			windows.SetEvent(stop)
+			<-w.done
+		case <-w.done:
+		}
+		windows.CloseHandle(changed)
+		windows.CloseHandle(stop)
+	}()
+	return nil
+}
+
+// Stop stops watching for changes.
+func (w *Watcher) Stop() error {
+	if w.stop == nil {
+		return nil
+	}
+	close(w.stop)
+	<-w.done
+	w.stop = nil
+	return nil
+}
+
+func (w *Watcher) run(changed, stop windows.Handle) {
+	defer close(w.done)
+	for {
+		o := windows.Overlapped{HEvent: changed}
+		var h windows.Handle
+		r, _, _ := procNotifyAddrChange.Call(uintptr(unsafe.Pointer(&h)), uintptr(unsafe.Pointer(&o)))
+		if errno := windows.Errno(r); errno != windows.ERROR_IO_PENDING {
+			w.logErr(fmt.Errorf("NotifyAddrChange: %v", errno))
+			return
+		}
+		ev, err := windows.WaitForMultipleObjects([]windows.Handle{changed, stop}, false, windows.INFINITE)
+		if err != nil || ev != windows.WAIT_OBJECT_0 {
+			procCancelIPChangeNotify.Call(uintptr(unsafe.Pointer(&o)))
+			if err != nil {
+				w.logErr(fmt.Errorf("wait: %v", err))
+			}
+			return
+		}
+		select {
+		case <-time.After(settleDelay):
+		case <-w.stop:
+			return
+		}
+		if w.OnChange != nil {
+			w.OnChange()
+		}
+	}
+}
@@ -0,0 +1,2 @@
+// Package procinfo finds the processes owning local sockets.
+package procinfo
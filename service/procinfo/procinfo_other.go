@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package procinfo
+
+import (
+	"errors"
+	"net"
+)
+
+// UDPOwner returns the executable name of the process with a UDP socket bound
+// to the local address ip:port.
+func UDPOwner(ip net.IP, port uint16) (string, error) {
+	return "", errors.New("not implemented")
+}
+
+// TCPOwner returns the executable name of the process with a TCP socket bound
+// to the local address ip:port.
+func TCPOwner(ip net.IP, port uint16) (string, error) {
+	return "", errors.New("not implemented")
+}
@@ -0,0 +1,120 @@
+package procinfo
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	udpTableOwnerPID    = 1 // UDP_TABLE_OWNER_PID
+	tcpTableOwnerPIDAll = 5 // TCP_TABLE_OWNER_PID_ALL
+)
+
+var (
+	iphlpapi                       = windows.NewLazySystemDLL("iphlpapi.dll")
+	procGetExtendedUdpTable        = iphlpapi.NewProc("GetExtendedUdpTable")
+	procGetExtendedTcpTable        = iphlpapi.NewProc("GetExtendedTcpTable")
+	kernel32                       = windows.NewLazySystemDLL("kernel32.dll")
+	procQueryFullProcessImageNameW = kernel32.NewProc("QueryFullProcessImageNameW")
+)
+
+// Row layouts of the IPv4 and IPv6 *_OWNER_PID tables: the offsets of the
+// local address, the local port and the owning PID, and the row size.
+type rowLayout struct {
+	addr, port, pid, size int
+}
+
+var (
+	udp4Row = rowLayout{addr: 0, port: 4, pid: 8, size: 12}   // MIB_UDPROW_OWNER_PID
+	udp6Row = rowLayout{addr: 0, port: 20, pid: 24, size: 28} // MIB_UDP6ROW_OWNER_PID
+	tcp4Row = rowLayout{addr: 4, port: 8, pid: 20, size: 24}  // MIB_TCPROW_OWNER_PID
+	tcp6Row = rowLayout{addr: 0, port: 20, pid: 52, size: 56} // MIB_TCP6ROW_OWNER_PID
+)
+
+// UDPOwner returns the executable name of the process with a UDP socket bound
+// to the local address ip:port.
+func UDPOwner(ip net.IP, port uint16) (string, error) {
+	if ip.To4() != nil {
+		return owner(procGetExtendedUdpTable, windows.AF_INET, udpTableOwnerPID, udp4Row, ip.To4(), port)
+	}
+	return owner(procGetExtendedUdpTable, windows.AF_INET6, udpTableOwnerPID, udp6Row, ip.To16(), port)
+}
+
+// TCPOwner returns the executable name of the process with a TCP socket bound
+// to the local address ip:port.
+func TCPOwner(ip net.IP, port uint16) (string, error) {
+	if ip.To4() != nil {
+		return owner(procGetExtendedTcpTable, windows.AF_INET, tcpTableOwnerPIDAll, tcp4Row, ip.To4(), port)
+	}
+	return owner(procGetExtendedTcpTable, windows.AF_INET6, tcpTableOwnerPIDAll, tcp6Row, ip.To16(), port)
+}
+
+func owner(proc *windows.LazyProc, af, class uintptr, l rowLayout, ip net.IP, port uint16) (string, error) {
+	table, err := extendedTable(proc, af, class)
+	if err != nil {
+		return "", err
+	}
+	if len(table) < 4 {
+		return "", errors.New("invalid table")
+	}
+	n := int(binary.LittleEndian.Uint32(table))
+	rows := table[4:]
+	for i := 0; i < n && (i+1)*l.size <= len(rows); i++ {
+		row := rows[i*l.size : (i+1)*l.size]
+		// The port is stored in network byte order in the low 16 bits.
+		if binary.BigEndian.Uint16(row[l.port:]) != port {
+			continue
+		}
+		addr := net.IP(row[l.addr : l.addr+len(ip)])
+		if !addr.Equal(ip) && !addr.IsUnspecified() {
+			continue
+		}
+		return processName(binary.LittleEndian.Uint32(row[l.pid:]))
+	}
+	return "", errors.New("socket not found")
+}
+
+// extendedTable returns the table of class for the address family af.
+func extendedTable(proc *windows.LazyProc, af, class uintptr) ([]byte, error) {
+	size := uint32(4096)
+	for {
+		b := make([]byte, size)
+		r, _, _ := proc.Call(uintptr(unsafe.Pointer(&b[0])), uintptr(unsafe.Pointer(&size)), 0, af, class, 0)
+		switch windows.Errno(r) {
+		case 0:
+			return b[:size], nil
+		case windows.ERROR_INSUFFICIENT_BUFFER:
+			continue
+		default:
+			return nil, os.NewSyscallError(proc.Name, windows.Errno(r))
+		}
+	}
+}
+
+// processName returns the executable file name of the process pid.
+func processName(pid uint32) (string, error) {
+	switch pid {
+	case 0:
+		return "System Idle Process", nil
+	case 4:
+		return "System", nil
+	}
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return "", os.NewSyscallError("OpenProcess", err)
+	}
+	defer windows.CloseHandle(h)
+	buf := make([]uint16, windows.MAX_LONG_PATH)
+	size := uint32(len(buf))
+	r, _, err := procQueryFullProcessImageNameW.Call(uintptr(h), 0, uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)))
+	if r == 0 {
+		return "", os.NewSyscallError("QueryFullProcessImageName", err)
+	}
+	return filepath.Base(windows.UTF16ToString(buf[:size])), nil
+}
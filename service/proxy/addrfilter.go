@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"github.com/nextdns/windows/dnsmsg"
+)
+
+// AddressFilter defines the address family answered to the clients, to work
+// around networks with a broken IPv6 (or IPv4) connectivity making the
+// connections to dual-stack names slow or failing.
+type AddressFilter int
+
+const (
+	// AddressFilterNone returns the responses unchanged.
+	AddressFilterNone AddressFilter = iota
+
+	// AddressFilterIPv4Only answers the AAAA queries of existing names with
+	// an empty answer (NODATA) so clients only connect over IPv4.
+	AddressFilterIPv4Only
+
+	// AddressFilterIPv6Only answers the A queries of existing names with an
+	// empty answer (NODATA) so clients only connect over IPv6.
+	AddressFilterIPv6Only
+)
+
+// filterAddresses applies AddressFilter to the response msg to q. The upstream
+// is still queried so names that do not exist keep their NXDOMAIN.
+func (p *Proxy) filterAddresses(q, msg []byte) []byte {
+	var filtered uint16
+	switch p.AddressFilter {
+	case AddressFilterIPv4Only:
+		filtered = dnsmsg.TypeAAAA
+	case AddressFilterIPv6Only:
+		filtered = dnsmsg.TypeA
+	default:
+		return msg
+	}
+	_, qtype, qclass, _, ok := dnsmsg.ParseQuestion(q)
+	if !ok || qtype != filtered || qclass != dnsmsg.ClassIN || dnsmsg.RCode(msg) != dnsmsg.RCodeNoError {
+		return msg
+	}
+	return reply(q, dnsmsg.RCodeNoError)
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/nextdns/nextdns/resolver/endpoint"
+	"github.com/nextdns/windows/bindif"
+	"github.com/nextdns/windows/resolver"
+)
+
+// dialer returns the dialer of the upstream connections, bound to
+// OutboundInterface if set.
+func (p *Proxy) dialer() *net.Dialer {
+	d := &net.Dialer{Timeout: 5 * time.Second}
+	if p.OutboundInterface != "" {
+		d.Control = bindif.Control(p.OutboundInterface)
+	}
+	return d
+}
+
+// setupResolver configures the resolver r created with resolver.New for the
+// upstream URL u, like a route or a fallback upstream.
+func (p *Proxy) setupResolver(u string, r resolver.Resolver) {
+	switch r := r.(type) {
+	case *resolver.DOH:
+		p.setupDOH(r)
+		if p.OutboundInterface != "" && r.Transport == nil {
+			// The endpoint transports cannot be bound to an interface.
+			r.Transport = p.newDirectTransport(dohBootstrapAddrs(u), "")
+		}
+	case *resolver.DOT:
+		r.MaxIdleConns = p.MaxIdleConns
+		r.Pipeline = p.DOTPipeline
+		if p.OutboundInterface != "" {
+			r.Dialer = p.dialer()
+		}
+	case *resolver.DNS53:
+		if p.OutboundInterface != "" {
+			r.Dialer = p.dialer()
+		}
+	}
+}
+
+// dohBootstrapAddrs returns the host:port addresses of the bootstrap IPs of
+// the DoH URL u, if any.
+func dohBootstrapAddrs(u string) []string {
+	e, err := endpoint.New(u)
+	if err != nil {
+		return nil
+	}
+	doh, ok := e.(*endpoint.DOHEndpoint)
+	if !ok {
+		return nil
+	}
+	port := "443"
+	if _, pt, err := net.SplitHostPort(doh.Hostname); err == nil {
+		port = pt
+	}
+	addrs := make([]string, 0, len(doh.Bootstrap))
+	for _, ip := range doh.Bootstrap {
+		addrs = append(addrs, net.JoinHostPort(strings.Trim(ip, "[]"), port))
+	}
+	return addrs
+}
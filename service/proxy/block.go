@@ -0,0 +1,20 @@
+package proxy
+
+import "github.com/nextdns/windows/dnsmsg"
+
+// blockQType returns the locally synthesized response to q if its type is
+// found in BlockedQTypes.
+func (p *Proxy) blockQType(q []byte) ([]byte, bool) {
+	if len(p.BlockedQTypes) == 0 {
+		return nil, false
+	}
+	_, qtype, _, _, ok := dnsmsg.ParseQuestion(q)
+	if !ok || !p.BlockedQTypes[qtype] {
+		return nil, false
+	}
+	rcode := dnsmsg.RCodeNoError
+	if p.RefuseBlockedQTypes {
+		rcode = dnsmsg.RCodeRefused
+	}
+	return reply(q, rcode), true
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/nextdns/windows/dnsmsg"
+)
+
+// BlockedMode defines how the responses of names blocked by the upstream,
+// recognized by their sinkhole addresses, are returned to the clients. Some
+// applications hang on one kind of blocked response and handle the other
+// gracefully.
+type BlockedMode int
+
+const (
+	// BlockedPassthrough returns the responses unchanged.
+	BlockedPassthrough BlockedMode = iota
+
+	// BlockedNXDomain rewrites the blocked responses into NXDOMAIN.
+	BlockedNXDomain
+
+	// BlockedNullIP rewrites the blocked responses into 0.0.0.0 for A
+	// queries and :: for AAAA queries, and an empty answer for the others.
+	BlockedNullIP
+)
+
+// defaultSinkholeIPs are the addresses returned by NextDNS for blocked names.
+var defaultSinkholeIPs = []net.IP{net.IPv4zero, net.IPv6zero}
+
+// rewriteBlocked applies BlockedMode to the response msg to q if msg is a
+// blocked response.
+func (p *Proxy) rewriteBlocked(q, msg []byte) []byte {
+	if p.BlockedMode == BlockedPassthrough || !p.isBlocked(msg) {
+		return msg
+	}
+	if p.BlockedMode == BlockedNXDomain {
+		return reply(q, dnsmsg.RCodeNXDomain)
+	}
+	ttl, _ := minTTL(msg)
+	return nullIPReply(q, ttl)
+}
+
+// nullIPReply returns a response to q answering 0.0.0.0 for A queries and ::
+// for AAAA queries with ttl, and an empty answer for the others.
+func nullIPReply(q []byte, ttl uint32) []byte {
+	_, qtype, _, _, _ := dnsmsg.ParseQuestion(q)
+	res := reply(q, dnsmsg.RCodeNoError)
+	var rdata []byte
+	switch qtype {
+	case dnsmsg.TypeA:
+		rdata = net.IPv4zero.To4()
+	case dnsmsg.TypeAAAA:
+		rdata = net.IPv6zero
+	default:
+		return res
+	}
+	res = appendRR(res, dnsmsg.HeaderLen, qtype, ttl, rdata)
+	binary.BigEndian.PutUint16(res[6:], 1)
+	return res
+}
+
+// isBlocked reports if msg answers with addresses, all of them in
+// SinkholeIPs.
+func (p *Proxy) isBlocked(msg []byte) bool {
+	if dnsmsg.RCode(msg) != dnsmsg.RCodeNoError {
+		return false
+	}
+	sinkholes := p.SinkholeIPs
+	if len(sinkholes) == 0 {
+		sinkholes = defaultSinkholeIPs
+	}
+	addrs, blocked := 0, 0
+	valid := dnsmsg.WalkRRs(msg, func(r dnsmsg.RR) {
+		if r.Section != dnsmsg.SectionAnswer || (r.Type != dnsmsg.TypeA && r.Type != dnsmsg.TypeAAAA) {
+			return
+		}
+		addrs++
+		ip := net.IP(msg[r.RDataOff:r.End()])
+		for _, s := range sinkholes {
+			if s.Equal(ip) {
+				blocked++
+				return
+			}
+		}
+	})
+	return valid && addrs > 0 && blocked == addrs
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nextdns/windows/dnsmsg"
+)
+
+// blocklistTTL is the TTL of the null addresses answered for the names in
+// Blocklist.
+const blocklistTTL = time.Minute
+
+// Blocklist is a set of names, with their subdomains, answered locally as
+// blocked without querying the upstream, so they never leave the machine. It
+// can be reloaded while the proxy runs.
+type Blocklist struct {
+	// Path is the file the names are loaded from, in the hosts format, like
+	// "0.0.0.0 ads.example.com", or one name per line. Lines starting with #
+	// are ignored. A missing file is an empty list.
+	Path string
+
+	mu    sync.RWMutex
+	names map[string]struct{}
+}
+
+// Load replaces the names of the list with the ones read from Path. On
+// error, the current names are kept.
+func (b *Blocklist) Load() error {
+	f, err := os.Open(b.Path)
+	if os.IsNotExist(err) {
+		b.set(nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	names, err := parseBlocklist(f)
+	if err != nil {
+		return err
+	}
+	b.set(names)
+	return nil
+}
+
+// Len returns the number of names in the list.
+func (b *Blocklist) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.names)
+}
+
+func (b *Blocklist) set(names map[string]struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.names = names
+}
+
+// blocked returns true if name, as returned by dnsmsg.ParseQuestion, or one of
+// its parent domains is in the list.
+func (b *Blocklist) blocked(name string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.names) == 0 {
+		return false
+	}
+	for {
+		if _, found := b.names[name]; found {
+			return true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
+
+// parseBlocklist returns the names, lower-cased and fully qualified, listed in
+// the hosts file or list of names r.
+func parseBlocklist(r io.Reader) (map[string]struct{}, error) {
+	names := map[string]struct{}{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			// hosts format
+			fields = fields[1:]
+		}
+		for _, name := range fields {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if name == "" || name == "localhost" || net.ParseIP(name) != nil {
+				continue
+			}
+			names[name+"."] = struct{}{}
+		}
+	}
+	return names, s.Err()
+}
+
+// blocklist returns the locally synthesized response to q if its name is in
+// Blocklist: 0.0.0.0 or :: when BlockedMode is BlockedNullIP, an NXDOMAIN
+// otherwise.
+func (p *Proxy) blocklist(q []byte) ([]byte, bool) {
+	if p.Blocklist == nil {
+		return nil, false
+	}
+	name, _, _, _, ok := dnsmsg.ParseQuestion(q)
+	if !ok || !p.Blocklist.blocked(name) {
+		return nil, false
+	}
+	p.stats.incr(&p.stats.blocklisted)
+	if p.BlockedMode == BlockedNullIP {
+		return nullIPReply(q, uint32(blocklistTTL/time.Second)), true
+	}
+	return reply(q, dnsmsg.RCodeNXDomain), true
+}
+
+// ReloadBlocklist reloads the names of Blocklist from its file.
+func (p *Proxy) ReloadBlocklist() error {
+	if p.Blocklist == nil {
+		return nil
+	}
+	if err := p.Blocklist.Load(); err != nil {
+		return err
+	}
+	p.logInfo(fmt.Sprintf("Blocklist loaded: %d names", p.Blocklist.Len()))
+	return nil
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBreakerCooldown defines the default value for Proxy
+	// BreakerCooldown.
+	DefaultBreakerCooldown = 30 * time.Second
+
+	// breakerWindow is the period over which the error rate of an upstream
+	// is computed.
+	breakerWindow = 30 * time.Second
+
+	// breakerMinQueries is the number of queries sent to an upstream within
+	// breakerWindow before its error rate is considered.
+	breakerMinQueries = 10
+)
+
+// breaker is the circuit breaker of an upstream. It is closed while the
+// upstream works, open while it is skipped after too many errors, and lets a
+// single probe query through once the cooldown is over to close again.
+type breaker struct {
+	mu        sync.Mutex
+	start     time.Time // start of the current window
+	total     int
+	failed    int
+	openUntil time.Time // zero while closed
+	probe     time.Time // start of the probe in flight, if any
+}
+
+// allow reports if a query can be sent to the upstream. Once the cooldown is
+// over, it returns true for one probe query at a time, another one being let
+// through if the probe got no result within upstreamTimeout.
+func (b *breaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(b.openUntil) || now.Sub(b.probe) < upstreamTimeout {
+		return false
+	}
+	b.probe = now
+	return true
+}
+
+// open reports if the breaker is open or probing.
+func (b *breaker) open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openUntil.IsZero()
+}
+
+// cooling reports if the breaker is open and its cooldown is not over.
+func (b *breaker) cooling(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openUntil.IsZero() && now.Before(b.openUntil)
+}
+
+// record counts the result of a query sent to the upstream and returns
+// whether it opened the breaker or closed it.
+func (b *breaker) record(ok bool, now time.Time, threshold float64, cooldown time.Duration) (tripped, recovered bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.openUntil.IsZero() {
+		if !now.Before(b.openUntil) {
+			// Result of the probe.
+			b.probe = time.Time{}
+			if ok {
+				b.openUntil = time.Time{}
+				b.resetLocked(now)
+				return false, true
+			}
+			b.openUntil = now.Add(cooldown)
+		}
+		return false, false
+	}
+	if now.Sub(b.start) > breakerWindow {
+		b.resetLocked(now)
+	}
+	b.total++
+	if !ok {
+		b.failed++
+	}
+	if b.total >= breakerMinQueries && float64(b.failed)/float64(b.total) > threshold {
+		b.openUntil = now.Add(cooldown)
+		b.resetLocked(now)
+		return true, false
+	}
+	return false, false
+}
+
+func (b *breaker) resetLocked(now time.Time) {
+	b.start = now
+	b.total = 0
+	b.failed = 0
+}
+
+// breakerAllows reports if u can be sent queries according to its circuit
+// breaker, if any.
+func breakerAllows(u upstream) bool {
+	return u.breaker == nil || u.breaker.allow(time.Now())
+}
+
+// breakerRecord counts the result err of a query sent to u in its circuit
+// breaker, if any.
+func (p *Proxy) breakerRecord(u upstream, err error) {
+	if u.breaker == nil {
+		return
+	}
+	cooldown := p.BreakerCooldown
+	if cooldown <= 0 {
+		cooldown = DefaultBreakerCooldown
+	}
+	tripped, recovered := u.breaker.record(err == nil, time.Now(), p.BreakerThreshold, cooldown)
+	switch {
+	case tripped:
+		p.logWarn(fmt.Sprintf("Upstream %s failing, using the fallbacks for %v", u.name, cooldown))
+	case recovered:
+		p.logInfo(fmt.Sprintf("Upstream %s recovered", u.name))
+	}
+}
+
+// trippedUpstreams returns the names of the upstreams whose circuit breaker
+// is open.
+func (p *Proxy) trippedUpstreams() []string {
+	_, ups := p.currentUpstreams()
+	var names []string
+	for _, u := range ups {
+		if u.breaker != nil && u.breaker.open() {
+			names = append(names, u.name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// bufferPool is the pool of the packet buffers of a run. The buffers taken
+// out of it are counted in the proxy stats, so the ones held by piling up
+// packets or never returned show.
+type bufferPool struct {
+	pool   sync.Pool
+	proxy  *Proxy
+	warnAt int64 // number of buffers in use logging the next warning
+}
+
+// newBufferPool returns a pool of size bytes buffers, expecting at most
+// expected of them in use.
+func (p *Proxy) newBufferPool(size, expected int) *bufferPool {
+	return &bufferPool{
+		pool: sync.Pool{
+			New: func() interface{} {
+				b := make([]byte, size)
+				return &b
+			},
+		},
+		proxy:  p,
+		warnAt: int64(2 * expected),
+	}
+}
+
+// get returns a buffer of its full size. A warning is logged each time the
+// number of buffers in use doubles past twice the expected one.
+func (b *bufferPool) get() []byte {
+	n := atomic.AddInt64(&b.proxy.stats.packetBuffers, 1)
+	if w := atomic.LoadInt64(&b.warnAt); n >= w && atomic.CompareAndSwapInt64(&b.warnAt, w, 2*w) {
+		b.proxy.logWarn(fmt.Sprintf("%d packet buffers in use, packets are piling up or buffers are not returned", n))
+	}
+	buf := *b.pool.Get().(*[]byte)
+	return buf[:cap(buf)]
+}
+
+// put returns buf, taken with get, to the pool.
+func (b *bufferPool) put(buf []byte) {
+	atomic.AddInt64(&b.proxy.stats.packetBuffers, -1)
+	b.pool.Put(&buf)
+}
@@ -0,0 +1,455 @@
+package proxy
+
+import (
+	"container/heap"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nextdns/windows/dnsmsg"
+)
+
+const (
+	// DefaultCacheMaxEntries defines the default value for Cache MaxEntries.
+	DefaultCacheMaxEntries = 10000
+
+	// DefaultCacheMaxNegativeTTL defines the default value for Cache
+	// MaxNegativeTTL.
+	DefaultCacheMaxNegativeTTL = 5 * time.Minute
+)
+
+// Cache is an in-memory cache of DNS responses. Responses are stored as
+// returned by the upstream and served with their TTLs decremented by the time
+// spent in the cache. Concurrent lookups for the same key are coalesced into a
+// single upstream query.
+type Cache struct {
+	// MaxEntries is the maximum number of responses kept in the cache. When
+	// full, the entries the closest to expiration are evicted first. If zero,
+	// DefaultCacheMaxEntries is used.
+	MaxEntries int
+
+	// MaxNegativeTTL caps the time NXDOMAIN and NODATA responses are cached.
+	// Those are cached for the SOA minimum TTL (RFC 2308), or not at all if
+	// they don't come with a SOA. If zero, DefaultCacheMaxNegativeTTL is used.
+	MaxNegativeTTL time.Duration
+
+	// Path is an optional file the cache is saved to when the proxy stops and
+	// restored from when it starts, so restarting the service does not start
+	// with an empty cache.
+	Path string
+
+	// PrefetchRatio, when set, is the fraction of its TTL below which an
+	// entry served from the cache is refreshed in the background, like 0.1
+	// to refresh the entries queried during the last 10% of their TTL, so
+	// popular names never expire.
+	PrefetchRatio float64
+
+	// MaxStale, when set, is the time an expired entry is still served, with
+	// a zero TTL, while it is refreshed in the background.
+	MaxStale time.Duration
+
+	mu       sync.Mutex
+	entries  map[cacheKey]*cacheEntry
+	expiries cacheHeap
+	inflight map[cacheKey]*cacheCall
+}
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+
+	// The DNSSEC flags of the query change the response: DO asks for the
+	// signatures, CD for data failing validation, and AD for the
+	// validation status.
+	do, cd, ad bool
+}
+
+type cacheEntry struct {
+	key    cacheKey
+	msg    []byte
+	stored time.Time
+	expire time.Time
+	index  int // position in Cache.expiries
+}
+
+type cacheCall struct {
+	done   chan struct{}
+	msg    []byte
+	maxAge time.Duration
+	err    error
+}
+
+// cacheFetch gets the response to cache from the upstream.
+type cacheFetch func(ctx context.Context) (msg []byte, maxAge time.Duration, err error)
+
+// queryCacheKey returns the cache key for the DNS query q.
+func queryCacheKey(q []byte) (cacheKey, bool) {
+	if dnsmsg.QuestionCount(q) != 1 {
+		return cacheKey{}, false
+	}
+	name, qtype, qclass, _, ok := dnsmsg.ParseQuestion(q)
+	return cacheKey{
+		name:   name,
+		qtype:  qtype,
+		qclass: qclass,
+		do:     dnsmsg.DNSSECOK(q),
+		cd:     dnsmsg.CheckingDisabled(q),
+		ad:     dnsmsg.AuthenticData(q),
+	}, ok
+}
+
+// resolve returns the response for k with its ID set to id. The response is
+// served from the cache if a valid entry exists, otherwise fetch is called
+// with ctx to get it from the upstream. Only one fetch per key is in flight at
+// a time, other callers wait for its result. The hit return value reports if
+// the response was served from the cache. Entries to prefetch or served stale
+// are refreshed calling fetch in the background with a context not bound to
+// ctx. Along with the response, fetch returns the time it can be cached for
+// from the HTTP caching metadata of the upstream, or a negative duration if
+// the DNS TTLs alone apply.
+func (c *Cache) resolve(ctx context.Context, k cacheKey, id uint16, fetch cacheFetch) (msg []byte, hit bool, err error) {
+	now := time.Now()
+	c.mu.Lock()
+	if msg, refresh := c.getLocked(k, now); msg != nil {
+		if refresh && c.inflight[k] == nil {
+			call := c.startCallLocked(k)
+			go c.runCall(context.Background(), k, call, fetch)
+		}
+		c.mu.Unlock()
+		return withID(msg, id), true, nil
+	}
+	if call := c.inflight[k]; call != nil {
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		if call.err != nil {
+			return nil, false, call.err
+		}
+		return withID(copyMsg(call.msg), id), false, nil
+	}
+	call := c.startCallLocked(k)
+	c.mu.Unlock()
+
+	c.runCall(ctx, k, call, fetch)
+	if call.err != nil {
+		return nil, false, call.err
+	}
+	return withID(copyMsg(call.msg), id), false, nil
+}
+
+// Flush removes all the entries of the cache.
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+	c.expiries = nil
+}
+
+// FlushName removes the entries of the cache for name, whatever their type.
+func (c *Cache) FlushName(name string) {
+	name = strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if k.name == name {
+			c.removeLocked(e)
+		}
+	}
+}
+
+// configure changes the settings of the cache, evicting the entries over
+// maxEntries.
+func (c *Cache) configure(maxEntries int, maxNegativeTTL time.Duration, prefetchRatio float64, maxStale time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.MaxEntries = maxEntries
+	c.MaxNegativeTTL = maxNegativeTTL
+	c.PrefetchRatio = prefetchRatio
+	c.MaxStale = maxStale
+	max := c.MaxEntries
+	if max <= 0 {
+		max = DefaultCacheMaxEntries
+	}
+	for len(c.entries) > max {
+		c.removeLocked(c.expiries[0])
+	}
+}
+
+// startCallLocked registers a new fetch in flight for k.
+func (c *Cache) startCallLocked(k cacheKey) *cacheCall {
+	call := &cacheCall{done: make(chan struct{})}
+	if c.inflight == nil {
+		c.inflight = map[cacheKey]*cacheCall{}
+	}
+	c.inflight[k] = call
+	return call
+}
+
+// runCall calls fetch for the call in flight for k and stores its result.
+func (c *Cache) runCall(ctx context.Context, k cacheKey, call *cacheCall, fetch cacheFetch) {
+	call.msg, call.maxAge, call.err = fetch(ctx)
+	if call.err == nil && call.maxAge > 0 {
+		// Do not let the clients cache it longer than allowed either.
+		clampTTLs(call.msg, 0, uint32(call.maxAge/time.Second))
+	}
+
+	c.mu.Lock()
+	delete(c.inflight, k)
+	if call.err == nil {
+		c.setLocked(k, call.msg, call.maxAge, time.Now())
+	}
+	c.mu.Unlock()
+	close(call.done)
+}
+
+// getLocked returns a copy of the cached response for k with TTLs adjusted, or
+// nil if no valid entry is found. refresh reports if the entry should be
+// refreshed, because it is about to expire or is served stale.
+func (c *Cache) getLocked(k cacheKey, now time.Time) (msg []byte, refresh bool) {
+	e := c.entries[k]
+	if e == nil {
+		return nil, false
+	}
+	if !now.Before(e.expire) {
+		if c.MaxStale <= 0 || !now.Before(e.expire.Add(c.MaxStale)) {
+			c.removeLocked(e)
+			return nil, false
+		}
+		refresh = true
+	} else if c.PrefetchRatio > 0 {
+		ttl := e.expire.Sub(e.stored)
+		refresh = e.expire.Sub(now) < time.Duration(float64(ttl)*c.PrefetchRatio)
+	}
+	msg = copyMsg(e.msg)
+	decrementTTLs(msg, uint32(now.Sub(e.stored)/time.Second))
+	return msg, refresh
+}
+
+// stale returns the response cached for k with its ID set to id, even if
+// expired, or nil if there is none. Expired responses have their TTLs set to
+// zero.
+func (c *Cache) stale(k cacheKey, id uint16) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[k]
+	if e == nil {
+		return nil
+	}
+	msg := copyMsg(e.msg)
+	decrementTTLs(msg, uint32(time.Since(e.stored)/time.Second))
+	return withID(msg, id)
+}
+
+// setLocked stores msg for k if it is cacheable, for at most maxAge if not
+// negative.
+func (c *Cache) setLocked(k cacheKey, msg []byte, maxAge time.Duration, now time.Time) {
+	ttl, ok := c.ttl(msg)
+	if maxAge >= 0 {
+		if sec := uint32(maxAge / time.Second); sec < ttl {
+			ttl = sec
+		}
+	}
+	if !ok || ttl == 0 {
+		return
+	}
+	expire := now.Add(time.Duration(ttl) * time.Second)
+	if e := c.entries[k]; e != nil {
+		e.msg = copyMsg(msg)
+		e.stored = now
+		e.expire = expire
+		heap.Fix(&c.expiries, e.index)
+		return
+	}
+	c.insertLocked(&cacheEntry{
+		key:    k,
+		msg:    copyMsg(msg),
+		stored: now,
+		expire: expire,
+	})
+}
+
+// insertLocked adds the new entry e, evicting the entries the closest to
+// expiration if the cache is full.
+func (c *Cache) insertLocked(e *cacheEntry) {
+	if c.entries == nil {
+		c.entries = map[cacheKey]*cacheEntry{}
+	}
+	max := c.MaxEntries
+	if max <= 0 {
+		max = DefaultCacheMaxEntries
+	}
+	for len(c.entries) >= max {
+		c.removeLocked(c.expiries[0])
+	}
+	c.entries[e.key] = e
+	heap.Push(&c.expiries, e)
+}
+
+// ttl returns the time msg can be cached for.
+func (c *Cache) ttl(msg []byte) (uint32, bool) {
+	if len(msg) < dnsmsg.HeaderLen || dnsmsg.Truncated(msg) {
+		return 0, false
+	}
+	if ttl, ok := negativeTTL(msg); ok {
+		max := c.MaxNegativeTTL
+		if max <= 0 {
+			max = DefaultCacheMaxNegativeTTL
+		}
+		if maxSec := uint32(max / time.Second); ttl > maxSec {
+			ttl = maxSec
+		}
+		return ttl, true
+	}
+	if dnsmsg.RCode(msg) != dnsmsg.RCodeNoError {
+		return 0, false
+	}
+	return minTTL(msg)
+}
+
+// cacheFileVersion is the version of the format of the file written by save.
+// Version 2 added the DNSSEC flags of the keys.
+const cacheFileVersion = 2
+
+type cacheFile struct {
+	Version int
+	Entries []cacheFileEntry
+}
+
+type cacheFileEntry struct {
+	Name   string
+	Type   uint16
+	Class  uint16
+	DO     bool
+	CD     bool
+	AD     bool
+	Msg    []byte
+	Stored time.Time
+	Expire time.Time
+}
+
+// save writes the valid entries of the cache to c.Path. The file is written
+// atomically so an interrupted save does not corrupt the previous one.
+func (c *Cache) save() error {
+	now := time.Now()
+	f := cacheFile{Version: cacheFileVersion}
+	c.mu.Lock()
+	for k, e := range c.entries {
+		if !now.Before(e.expire) {
+			continue
+		}
+		f.Entries = append(f.Entries, cacheFileEntry{
+			Name:   k.name,
+			Type:   k.qtype,
+			Class:  k.qclass,
+			DO:     k.do,
+			CD:     k.cd,
+			AD:     k.ad,
+			Msg:    e.msg,
+			Stored: e.stored,
+			Expire: e.expire,
+		})
+	}
+	c.mu.Unlock()
+
+	tmp := c.Path + ".tmp"
+	w, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err = gob.NewEncoder(w).Encode(f); err == nil {
+		err = w.Close()
+	} else {
+		w.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, c.Path)
+}
+
+// load adds the entries saved in c.Path to the cache, discarding the ones
+// that expired in the meantime. If the file cannot be read entirely, nothing
+// is loaded.
+func (c *Cache) load() error {
+	r, err := os.Open(c.Path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	var f cacheFile
+	if err := gob.NewDecoder(r).Decode(&f); err != nil {
+		return err
+	}
+	if f.Version != cacheFileVersion {
+		return fmt.Errorf("unsupported cache file version %d", f.Version)
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, fe := range f.Entries {
+		k := cacheKey{name: fe.Name, qtype: fe.Type, qclass: fe.Class, do: fe.DO, cd: fe.CD, ad: fe.AD}
+		if !now.Before(fe.Expire) || len(fe.Msg) < dnsmsg.HeaderLen || c.entries[k] != nil {
+			continue
+		}
+		c.insertLocked(&cacheEntry{
+			key:    k,
+			msg:    fe.Msg,
+			stored: fe.Stored,
+			expire: fe.Expire,
+		})
+	}
+	return nil
+}
+
+func (c *Cache) removeLocked(e *cacheEntry) {
+	heap.Remove(&c.expiries, e.index)
+	delete(c.entries, e.key)
+}
+
+func copyMsg(msg []byte) []byte {
+	b := make([]byte, len(msg))
+	copy(b, msg)
+	return b
+}
+
+func withID(msg []byte, id uint16) []byte {
+	dnsmsg.SetID(msg, id)
+	return msg
+}
+
+// cacheHeap orders cache entries by expiration time so the entries the closest
+// to expiration (or already expired) are evicted first.
+type cacheHeap []*cacheEntry
+
+func (h cacheHeap) Len() int           { return len(h) }
+func (h cacheHeap) Less(i, j int) bool { return h[i].expire.Before(h[j].expire) }
+
+func (h cacheHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *cacheHeap) Push(x interface{}) {
+	e := x.(*cacheEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *cacheHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return e
+}
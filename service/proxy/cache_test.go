@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCacheSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache")
+	now := time.Now()
+	keys := []cacheKey{
+		{name: "example.com.", qtype: 1, qclass: 1},
+		{name: "example.com.", qtype: 1, qclass: 1, do: true},
+		{name: "example.com.", qtype: 1, qclass: 1, cd: true},
+		{name: "example.com.", qtype: 1, qclass: 1, do: true, cd: true, ad: true},
+	}
+	c := &Cache{Path: path}
+	for i, k := range keys {
+		msg := answerA(newTestQuery(0, k.name, k.do, k.cd), net.IPv4(192, 0, 2, byte(i)), k.do)
+		c.insertLocked(&cacheEntry{key: k, msg: msg, stored: now, expire: now.Add(time.Hour)})
+	}
+	c.insertLocked(&cacheEntry{
+		key:    cacheKey{name: "expired.example.", qtype: 1, qclass: 1},
+		msg:    answerA(newTestQuery(0, "expired.example.", false, false), net.IPv4(192, 0, 2, 9), false),
+		stored: now.Add(-time.Hour),
+		expire: now.Add(-time.Minute),
+	})
+	if err := c.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	l := &Cache{Path: path}
+	if err := l.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.entries) != len(keys) {
+		t.Errorf("%d entries loaded, want %d", len(l.entries), len(keys))
+	}
+	for _, k := range keys {
+		e := l.entries[k]
+		if e == nil {
+			t.Errorf("%+v not loaded", k)
+			continue
+		}
+		if want := c.entries[k]; !reflect.DeepEqual(e.msg, want.msg) || !e.expire.Equal(want.expire) {
+			t.Errorf("%+v loaded with a different response or expiry", k)
+		}
+	}
+}
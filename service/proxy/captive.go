@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nextdns/windows/dnsmsg"
+)
+
+const (
+	// captivePortalHost and captivePortalPath locate the Windows network
+	// connectivity status indicator probe, answering captivePortalContent
+	// when the Internet is reachable. Captive portals answer with a redirect
+	// to their login page instead.
+	captivePortalHost    = "www.msftconnecttest.com"
+	captivePortalPath    = "/connecttest.txt"
+	captivePortalContent = "Microsoft Connect Test"
+
+	// captivePortalTimeout is the time given to a probe.
+	captivePortalTimeout = 5 * time.Second
+
+	// captivePortalInterval is the minimum time between two probes, and the
+	// interval of the probes while the portal is bypassed.
+	captivePortalInterval = 10 * time.Second
+)
+
+// checkCaptivePortal asks the captive portal monitor to probe the network.
+func (p *Proxy) checkCaptivePortal() {
+	if !p.CaptivePortalDetection {
+		return
+	}
+	select {
+	case p.captiveCheck <- struct{}{}:
+	default:
+	}
+}
+
+// captivePortalBypassed reports if queries are forwarded to the system DNS
+// servers because a captive portal was detected.
+func (p *Proxy) captivePortalBypassed() bool {
+	return atomic.LoadInt32(&p.captiveBypass) == 1
+}
+
+// captivePortalMonitor probes the network when asked to by
+// checkCaptivePortal, like after a network change or upstream failures. When
+// a captive portal is detected, dnsunleak is suspended and queries are
+// forwarded to the system DNS servers so the portal can be reached. The probes
+// then continue until the Internet is reachable, when dnsunleak is resumed and
+// queries go to NextDNS again. It returns when ctx is done.
+func (p *Proxy) captivePortalMonitor(ctx context.Context) {
+	defer atomic.StoreInt32(&p.captiveBypass, 0)
+	for {
+		captive, err := p.probeCaptivePortal(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		bypassed := p.captivePortalBypassed()
+		switch {
+		case err != nil:
+			// Likely offline, keep the current state.
+			p.logWarn(fmt.Sprintf("Captive portal probe failed: %v", err))
+		case captive && !bypassed:
+			p.logInfo("Captive portal detected, forwarding queries to the system DNS servers")
+			p.suspendUnleak()
+			atomic.StoreInt32(&p.captiveBypass, 1)
+		case !captive && bypassed:
+			p.logInfo("Captive portal passed, forwarding queries to NextDNS")
+			atomic.StoreInt32(&p.captiveBypass, 0)
+			if err := p.resumeUnleak(); err != nil && p.RequireLeakProtection {
+				p.logInfo("Leak protection required, restarting")
+				go p.restart()
+			}
+		}
+
+		t := time.NewTimer(captivePortalInterval)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+		if p.captivePortalBypassed() {
+			continue
+		}
+		select {
+		case <-p.captiveCheck:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// probeCaptivePortal fetches the connectivity probe, resolved with the system
+// DNS servers, and reports if its content was altered by a captive portal.
+func (p *Proxy) probeCaptivePortal(ctx context.Context) (captive bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, captivePortalTimeout)
+	defer cancel()
+	u, ok := p.systemUpstream()
+	if !ok {
+		return false, errors.New("no system DNS server")
+	}
+	msg, err := u.resolver.Resolve(ctx, newQuery(0, captivePortalHost+".", dnsmsg.TypeA))
+	if err != nil {
+		return false, err
+	}
+	var ip net.IP
+	dnsmsg.WalkRRs(msg, func(r dnsmsg.RR) {
+		if ip == nil && r.Section == dnsmsg.SectionAnswer && r.Type == dnsmsg.TypeA &&
+			r.RDataLen == net.IPv4len {
+			ip = append(net.IP(nil), msg[r.RDataOff:r.End()]...)
+		}
+	})
+	if ip == nil {
+		return false, fmt.Errorf("%s: no address", captivePortalHost)
+	}
+	addr := net.JoinHostPort(ip.String(), "80")
+	c := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+captivePortalHost+captivePortalPath, nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+	if err != nil {
+		return false, err
+	}
+	return res.StatusCode != http.StatusOK || strings.TrimSpace(string(b)) != captivePortalContent, nil
+}
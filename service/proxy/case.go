@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+
+	"github.com/nextdns/windows/dnsmsg"
+)
+
+// errCaseMismatch is returned when the response to a query sent with a
+// randomized name case does not echo it.
+var errCaseMismatch = errors.New("response question case mismatch")
+
+// questionNameEnd returns the offset following the name of the first question
+// of msg, or -1 if it cannot be found.
+func questionNameEnd(msg []byte) int {
+	if len(msg) < dnsmsg.HeaderLen || msg[4] == 0 && msg[5] == 0 {
+		return -1
+	}
+	return dnsmsg.SkipName(msg, dnsmsg.HeaderLen)
+}
+
+// randomizeCase returns a copy of q with the case of the letters of its qname
+// randomized (draft-vixie-dnsext-dns0x20). ok is false if q has no parsable
+// question, in which case q is returned.
+func randomizeCase(q []byte) (nq []byte, ok bool) {
+	end := questionNameEnd(q)
+	if end < 0 {
+		return q, false
+	}
+	nq = append([]byte(nil), q...)
+	bits := make([]byte, end-dnsmsg.HeaderLen)
+	if _, err := rand.Read(bits); err != nil {
+		return q, false
+	}
+	for i := dnsmsg.HeaderLen; i < end; i++ {
+		c := nq[i]
+		if c|0x20 >= 'a' && c|0x20 <= 'z' {
+			if bits[i-dnsmsg.HeaderLen]&1 == 0 {
+				nq[i] = c | 0x20
+			} else {
+				nq[i] = c &^ 0x20
+			}
+		}
+	}
+	return nq, true
+}
+
+// restoreCase checks that the question of the response msg to the query nq,
+// sent with a randomized case, echoes its name exactly and then restores the
+// original case of q in msg.
+func restoreCase(msg, nq, q []byte) error {
+	end := questionNameEnd(nq)
+	if end < 0 || questionNameEnd(msg) != end || !bytes.Equal(msg[dnsmsg.HeaderLen:end], nq[dnsmsg.HeaderLen:end]) {
+		return errCaseMismatch
+	}
+	copy(msg[dnsmsg.HeaderLen:end], q[dnsmsg.HeaderLen:end])
+	return nil
+}
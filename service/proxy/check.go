@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/nextdns/windows/dnsmsg"
+	"github.com/nextdns/windows/resolver"
+)
+
+// CheckUpstream sends a single query for a test name to the upstream URL u,
+// in the FallbackUpstreams form, and returns the time it took to get the
+// response. The upstream is set up like the ones of the proxy, which does not
+// need to be started, so a custom upstream can be validated before being
+// used. SERVFAIL and REFUSED responses are reported as errors.
+func (p *Proxy) CheckUpstream(u string) (time.Duration, error) {
+	r, err := resolver.New(u)
+	if err != nil {
+		return 0, err
+	}
+	p.setupResolver(u, r)
+	defer closeIdleConnections(nil, []upstream{{name: u, resolver: r}})
+	timeout := p.QueryTimeout
+	if timeout <= 0 {
+		timeout = DefaultQueryTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	q := newQuery(uint16(rand.Uint32()), healthCheckName, dnsmsg.TypeA)
+	start := time.Now()
+	msg, err := r.Resolve(ctx, q)
+	latency := time.Since(start)
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, fmt.Errorf("no response within %v: %w", timeout, err)
+		}
+		return 0, err
+	}
+	if err := checkResponseID(msg, dnsmsg.ID(q)); err != nil {
+		return 0, err
+	}
+	switch dnsmsg.RCode(msg) {
+	case dnsmsg.RCodeServFail:
+		return 0, errors.New("SERVFAIL")
+	case dnsmsg.RCodeRefused:
+		return 0, errors.New("REFUSED")
+	}
+	return latency, nil
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+
+	"github.com/nextdns/windows/dnsmsg"
+)
+
+// maxCNAMEChain is the maximum number of CNAME records followed from the
+// queried name.
+const maxCNAMEChain = 8
+
+// completeCNAMEs returns the response msg to the A or AAAA query q completed
+// with the records of the target of its CNAME chain when CompleteCNAMEs is set
+// and the upstream did not include them, so the client does not have to query
+// the target itself. The added records are owned by the target and their TTL
+// is capped to the one of the chain, and AD is cleared as they were not
+// validated with the response. Queries with DO are left alone as the added
+// records would come without their signatures. In any other case, msg is
+// returned as is.
+func (p *Proxy) completeCNAMEs(ctx context.Context, q, msg []byte) []byte {
+	if !p.CompleteCNAMEs || dnsmsg.RCode(msg) != dnsmsg.RCodeNoError || dnsmsg.DNSSECOK(q) {
+		return msg
+	}
+	name, qtype, qclass, _, ok := dnsmsg.ParseQuestion(q)
+	if !ok || (qtype != dnsmsg.TypeA && qtype != dnsmsg.TypeAAAA) || qclass != dnsmsg.ClassIN {
+		return msg
+	}
+	type cname struct {
+		target    string
+		targetOff int
+		ttl       uint32
+	}
+	cnames := map[string]cname{}
+	answered := false
+	end := 0 // end of the answer section
+	valid := dnsmsg.WalkRRs(msg, func(r dnsmsg.RR) {
+		if r.Section != dnsmsg.SectionAnswer {
+			return
+		}
+		end = r.End()
+		switch r.Type {
+		case qtype:
+			answered = true
+		case dnsmsg.TypeCNAME:
+			owner, ok1 := dnsmsg.ReadName(msg, r.Off)
+			target, ok2 := dnsmsg.ReadName(msg, r.RDataOff)
+			if ok1 && ok2 {
+				ttl := binary.BigEndian.Uint32(msg[r.TTLOff:])
+				cnames[owner] = cname{target: target, targetOff: r.RDataOff, ttl: ttl}
+			}
+		}
+	})
+	if !valid || answered || len(cnames) == 0 {
+		return msg
+	}
+	var chainTTL uint32
+	targetOff := 0
+	for i := 0; i < maxCNAMEChain; i++ {
+		c, found := cnames[name]
+		if !found {
+			break
+		}
+		if targetOff == 0 || c.ttl < chainTTL {
+			chainTTL = c.ttl
+		}
+		name, targetOff = c.target, c.targetOff
+	}
+	if targetOff == 0 || targetOff > 0x3fff {
+		return msg
+	}
+	res, err := p.lookup(ctx, newQuery(dnsmsg.ID(q), name, qtype))
+	if err != nil || dnsmsg.RCode(res) != dnsmsg.RCodeNoError {
+		return msg
+	}
+	var rrs []byte
+	var count uint16
+	dnsmsg.WalkRRs(res, func(r dnsmsg.RR) {
+		if r.Section != dnsmsg.SectionAnswer || r.Type != qtype || r.Class != dnsmsg.ClassIN {
+			return
+		}
+		if owner, ok := dnsmsg.ReadName(res, r.Off); !ok || owner != name {
+			return
+		}
+		ttl := binary.BigEndian.Uint32(res[r.TTLOff:])
+		if ttl > chainTTL {
+			ttl = chainTTL
+		}
+		// Owned by the CNAME target.
+		rrs = appendRR(rrs, targetOff, qtype, ttl, res[r.RDataOff:r.End()])
+		count++
+	})
+	if count == 0 {
+		return msg
+	}
+	out := make([]byte, 0, len(msg)+len(rrs))
+	out = append(out, msg[:end]...)
+	out = append(out, rrs...)
+	out = append(out, msg[end:]...)
+	binary.BigEndian.PutUint16(out[6:], binary.BigEndian.Uint16(out[6:])+count)
+	dnsmsg.ClearAuthenticData(out)
+	return out
+}
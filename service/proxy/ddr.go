@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nextdns/windows/dnsmsg"
+	"github.com/nextdns/windows/resolver"
+)
+
+const (
+	// ddrName is the name queried for the designated resolvers (RFC 9462).
+	ddrName = "_dns.resolver.arpa."
+
+	// ddrTimeout is the time given to the discovery.
+	ddrTimeout = 5 * time.Second
+)
+
+// SVCB parameter keys (RFC 9460, RFC 9461).
+const (
+	svcParamALPN     = 1
+	svcParamPort     = 3
+	svcParamIPv4Hint = 4
+	svcParamIPv6Hint = 6
+	svcParamDOHPath  = 7
+)
+
+// ddrEndpoint is an encrypted resolver designated by a plain DNS resolver.
+type ddrEndpoint struct {
+	priority uint16
+	target   string
+	alpn     []string
+	port     uint16
+	hints    []net.IP
+	dohPath  string
+}
+
+// url returns the upstream URL of e, in the FallbackUpstreams form, preferring
+// DoH over DoT, or false if no supported protocol is offered. ip is used as
+// bootstrap IP when e has no address hint.
+func (e ddrEndpoint) url(ip net.IP) (string, bool) {
+	hints := e.hints
+	if len(hints) == 0 {
+		hints = []net.IP{ip}
+	}
+	ips := make([]string, 0, len(hints))
+	for _, ip := range hints {
+		ips = append(ips, ip.String())
+	}
+	host := strings.TrimSuffix(e.target, ".")
+	has := func(proto string) bool {
+		for _, a := range e.alpn {
+			if a == proto {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case has("h2") && e.dohPath != "" && (e.port == 0 || e.port == 443):
+		path := strings.SplitN(e.dohPath, "{", 2)[0] // strip the {?dns} variable
+		return fmt.Sprintf("https://%s%s#%s", host, path, strings.Join(ips, ",")), true
+	case has("dot"):
+		port := e.port
+		if port == 0 {
+			port = 853
+		}
+		return fmt.Sprintf("tls://%s#%s", net.JoinHostPort(host, strconv.Itoa(int(port))), strings.Join(ips, ",")), true
+	}
+	return "", false
+}
+
+// discoverDDR queries the plain DNS resolver DDRResolver for its designated
+// encrypted resolvers and returns the URL of the preferred one.
+func (p *Proxy) discoverDDR() (string, error) {
+	ip := net.ParseIP(p.DDRResolver)
+	if ip == nil {
+		return "", fmt.Errorf("invalid resolver IP %q", p.DDRResolver)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ddrTimeout)
+	defer cancel()
+	r := &resolver.DNS53{Addr: net.JoinHostPort(ip.String(), "53")}
+	msg, err := r.Resolve(ctx, newQuery(0, ddrName, dnsmsg.TypeSVCB))
+	if err != nil {
+		return "", err
+	}
+	if rcode := dnsmsg.RCode(msg); rcode != dnsmsg.RCodeNoError {
+		return "", fmt.Errorf("%s: %s", ddrName, rcodeString(rcode))
+	}
+	var endpoints []ddrEndpoint
+	dnsmsg.WalkRRs(msg, func(r dnsmsg.RR) {
+		if r.Section != dnsmsg.SectionAnswer || r.Type != dnsmsg.TypeSVCB {
+			return
+		}
+		if e, ok := parseSVCB(msg, r); ok && e.priority != 0 {
+			endpoints = append(endpoints, e)
+		}
+	})
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		return endpoints[i].priority < endpoints[j].priority
+	})
+	for _, e := range endpoints {
+		if u, ok := e.url(ip); ok {
+			return u, nil
+		}
+	}
+	return "", errors.New("no supported designated resolver")
+}
+
+// parseSVCB parses the SVCB record r of msg.
+func parseSVCB(msg []byte, r dnsmsg.RR) (e ddrEndpoint, ok bool) {
+	end := r.End()
+	if r.RDataLen < 3 {
+		return e, false
+	}
+	e.priority = binary.BigEndian.Uint16(msg[r.RDataOff:])
+	off := r.RDataOff + 2
+	if e.target, ok = dnsmsg.ReadName(msg, off); !ok || e.target == "" {
+		// The owner name as target is not a name to verify.
+		return e, false
+	}
+	if off = dnsmsg.SkipName(msg, off); off < 0 || off > end {
+		return e, false
+	}
+	for off < end {
+		if off+4 > end {
+			return e, false
+		}
+		key := binary.BigEndian.Uint16(msg[off:])
+		l := int(binary.BigEndian.Uint16(msg[off+2:]))
+		off += 4
+		if off+l > end {
+			return e, false
+		}
+		v := msg[off : off+l]
+		off += l
+		switch key {
+		case svcParamALPN:
+			for len(v) > 0 && int(v[0]) < len(v) {
+				e.alpn = append(e.alpn, string(v[1:1+v[0]]))
+				v = v[1+v[0]:]
+			}
+		case svcParamPort:
+			if len(v) == 2 {
+				e.port = binary.BigEndian.Uint16(v)
+			}
+		case svcParamIPv4Hint:
+			for ; len(v) >= net.IPv4len; v = v[net.IPv4len:] {
+				e.hints = append(e.hints, net.IP(append([]byte(nil), v[:net.IPv4len]...)))
+			}
+		case svcParamIPv6Hint:
+			for ; len(v) >= net.IPv6len; v = v[net.IPv6len:] {
+				e.hints = append(e.hints, net.IP(append([]byte(nil), v[:net.IPv6len]...)))
+			}
+		case svcParamDOHPath:
+			e.dohPath = string(v)
+		}
+	}
+	return e, true
+}
+
+// ddrUpstream returns the upstream of the designated resolver discovered on
+// start, or false if there is none. As required for verified discovery, the
+// certificate of the designated resolver must be valid for the IP of the
+// plain resolver.
+func (p *Proxy) ddrUpstream() (upstream, bool) {
+	if p.ddrURL == "" {
+		return upstream{}, false
+	}
+	r, err := resolver.New(p.ddrURL)
+	if err != nil {
+		p.logErr(fmt.Errorf("designated resolver %s: %v", p.ddrURL, err))
+		return upstream{}, false
+	}
+	ip := p.DDRResolver
+	verify := func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("no certificate")
+		}
+		return cs.PeerCertificates[0].VerifyHostname(ip)
+	}
+	p.setupResolver(p.ddrURL, r)
+	switch r := r.(type) {
+	case *resolver.DOH:
+		r.VerifyConnection = verify
+	case *resolver.DOT:
+		r.VerifyConnection = verify
+	}
+	return upstream{name: p.ddrURL, resolver: r}, true
+}
@@ -1,22 +1,91 @@
 package proxy
 
-// dedup is a ring buffer containing the last 128 ids used to check for
-// duplicates.
+import (
+	"sync"
+	"time"
+
+	"github.com/nextdns/windows/dnsmsg"
+)
+
+const (
+	// DefaultDedupWindow defines the default value for Proxy DedupWindow.
+	DefaultDedupWindow = 2 * time.Second
+
+	// DefaultDedupMaxEntries defines the default value for Proxy
+	// DedupMaxEntries.
+	DefaultDedupMaxEntries = 1024
+
+	// dedupSweepEntries is the number of tracked queries from which the
+	// expired ones are removed when a query is recorded. Below it, they are
+	// left until answered or replaced by a new query with the same key.
+	dedupSweepEntries = 128
+)
+
+// dedup tracks the queries in flight to drop the duplicates sent by clients
+// retransmitting a query before getting its response. Once a query is
+// answered, an identical query is not a duplicate anymore.
 type dedup struct {
-	ids [128]uint16
-	pos int
+	mu        sync.Mutex
+	inflight  map[dedupKey]dedupEntry
+	lastToken uint64
+}
+
+type dedupEntry struct {
+	start time.Time
+	token uint64 // identifies the query recorded under the key
+}
+
+type dedupKey struct {
+	id    uint16
+	name  string
+	qtype uint16
 }
 
-// IsDup returns true if id is present in the ring buffer. If not found, the id
-// is added to the ring. Call to this function is not thread safe.
-func (d *dedup) IsDup(id uint16) bool {
-	for _, id2 := range d.ids {
-		if id == id2 {
-			return true
+// queryDedupKey returns the dedup key of the query q.
+func queryDedupKey(id uint16, q []byte) dedupKey {
+	name, qtype, _, _, _ := dnsmsg.ParseQuestion(q)
+	return dedupKey{id: id, name: name, qtype: qtype}
+}
+
+// IsDup returns true if a query with the key k is in flight since less than
+// window. If not, k is recorded as in flight until Done is called with the
+// returned token, unless max queries are already tracked.
+func (d *dedup) IsDup(k dedupKey, window time.Duration, max int) (dup bool, token uint64) {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, found := d.inflight[k]; found && now.Sub(e.start) < window {
+		return true, 0
+	}
+	if d.inflight == nil {
+		d.inflight = map[dedupKey]dedupEntry{}
+	}
+	if len(d.inflight) >= dedupSweepEntries || len(d.inflight) >= max {
+		for k2, e := range d.inflight {
+			if now.Sub(e.start) >= window {
+				delete(d.inflight, k2)
+			}
 		}
 	}
-	d.ids[d.pos] = id
-	d.pos++
-	d.pos &= 127 // power of 2 modulo
-	return false
+	if len(d.inflight) >= max {
+		// Let it through untracked rather than evicting a query in flight.
+		return false, 0
+	}
+	d.lastToken++
+	d.inflight[k] = dedupEntry{start: now, token: d.lastToken}
+	return false, d.lastToken
+}
+
+// Done marks the query recorded with the key k and token as answered. A
+// query recorded with the same key after it expired is left tracked.
+func (d *dedup) Done(k dedupKey, token uint64) {
+	if token == 0 {
+		// Not tracked.
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, found := d.inflight[k]; found && e.token == token {
+		delete(d.inflight, k)
+	}
 }
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedup(t *testing.T) {
+	var d dedup
+	k := dedupKey{id: 1, name: "example.com.", qtype: 1}
+	const max = 10
+	dup, token := d.IsDup(k, time.Hour, max)
+	if dup || token == 0 {
+		t.Fatalf("IsDup() = %v, %d for a new query", dup, token)
+	}
+	if dup, _ := d.IsDup(k, time.Hour, max); !dup {
+		t.Error("retransmission not reported as a duplicate")
+	}
+	d.Done(k, token)
+	if dup, token := d.IsDup(k, time.Hour, max); dup {
+		t.Error("query answered still reported as a duplicate")
+	} else {
+		d.Done(k, token)
+	}
+
+	// A query outliving the window is replaced by the next one with the same
+	// key, which its answer must not untrack.
+	_, old := d.IsDup(k, 0, max)
+	dup, token = d.IsDup(k, 0, max)
+	if dup || token == old {
+		t.Fatalf("IsDup() = %v, %d after the window, want a new token", dup, token)
+	}
+	d.Done(k, old)
+	if dup, _ := d.IsDup(k, time.Hour, max); !dup {
+		t.Error("query untracked by the answer of the one it replaced")
+	}
+	d.Done(k, token)
+	if len(d.inflight) != 0 {
+		t.Errorf("%d queries left tracked", len(d.inflight))
+	}
+}
+
+func TestDedupMaxEntries(t *testing.T) {
+	var d dedup
+	const max = 2
+	for i := 0; i < max; i++ {
+		d.IsDup(dedupKey{id: uint16(i)}, time.Hour, max)
+	}
+	k := dedupKey{id: max}
+	if dup, token := d.IsDup(k, time.Hour, max); dup || token != 0 {
+		t.Errorf("IsDup() = %v, %d past max, want the query let through untracked", dup, token)
+	}
+	if dup, _ := d.IsDup(k, time.Hour, max); dup {
+		t.Error("untracked query reported as a duplicate")
+	}
+	d.Done(k, 0)
+	if len(d.inflight) != max {
+		t.Errorf("%d queries tracked, want %d", len(d.inflight), max)
+	}
+}
@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/nextdns/windows/dnsmsg"
+)
+
+// minTTL returns the smallest TTL found in msg records, ignoring the OPT
+// pseudo-record. If msg has no record or is malformed, ok is false.
+func minTTL(msg []byte) (ttl uint32, ok bool) {
+	found := false
+	valid := dnsmsg.WalkRRs(msg, func(r dnsmsg.RR) {
+		if r.Type == dnsmsg.TypeOPT {
+			return
+		}
+		t := binary.BigEndian.Uint32(msg[r.TTLOff:])
+		if !found || t < ttl {
+			ttl = t
+			found = true
+		}
+	})
+	return ttl, valid && found
+}
+
+// negativeTTL returns the TTL to cache the negative (NXDOMAIN or NODATA)
+// response msg for as defined by RFC 2308: the smallest of the SOA record TTL
+// and its MINIMUM field. If msg is not a negative response or has no SOA, ok is
+// false.
+func negativeTTL(msg []byte) (ttl uint32, ok bool) {
+	if len(msg) < dnsmsg.HeaderLen {
+		return 0, false
+	}
+	switch dnsmsg.RCode(msg) {
+	case dnsmsg.RCodeNXDomain:
+	case dnsmsg.RCodeNoError:
+		if dnsmsg.Count(msg, dnsmsg.SectionAnswer) != 0 {
+			return 0, false // not NODATA
+		}
+	default:
+		return 0, false
+	}
+	found := false
+	valid := dnsmsg.WalkRRs(msg, func(r dnsmsg.RR) {
+		if found || r.Type != dnsmsg.TypeSOA || r.Section != dnsmsg.SectionAuthority {
+			return
+		}
+		end := r.End()
+		off := dnsmsg.SkipName(msg, r.RDataOff) // MNAME
+		if off < 0 || off > end {
+			return
+		}
+		if off = dnsmsg.SkipName(msg, off); off < 0 || off+20 > end { // RNAME
+			return
+		}
+		ttl = binary.BigEndian.Uint32(msg[r.TTLOff:])
+		if min := binary.BigEndian.Uint32(msg[off+16:]); min < ttl {
+			ttl = min
+		}
+		found = true
+	})
+	return ttl, valid && found
+}
+
+// decrementTTLs subtracts age seconds from all TTLs of msg, without going
+// below zero.
+func decrementTTLs(msg []byte, age uint32) {
+	dnsmsg.WalkRRs(msg, func(r dnsmsg.RR) {
+		if r.Type == dnsmsg.TypeOPT {
+			return
+		}
+		t := binary.BigEndian.Uint32(msg[r.TTLOff:])
+		if t > age {
+			t -= age
+		} else {
+			t = 0
+		}
+		binary.BigEndian.PutUint32(msg[r.TTLOff:], t)
+	})
+}
+
+// clampTTLs sets the TTLs of the records of msg below min to min and above
+// max to max. A zero max does not cap the TTLs.
+func clampTTLs(msg []byte, min, max uint32) {
+	dnsmsg.WalkRRs(msg, func(r dnsmsg.RR) {
+		if r.Type == dnsmsg.TypeOPT {
+			return
+		}
+		t := binary.BigEndian.Uint32(msg[r.TTLOff:])
+		if t < min {
+			t = min
+		}
+		if max > 0 && t > max {
+			t = max
+		}
+		binary.BigEndian.PutUint32(msg[r.TTLOff:], t)
+	})
+}
+
+// queryName returns the name of the query q for logging, the names of all its
+// questions separated by commas if it has several.
+func queryName(q []byte) string {
+	if dnsmsg.QuestionCount(q) > 1 {
+		if qs, ok := dnsmsg.Questions(q); ok {
+			names := make([]string, 0, len(qs))
+			for _, q := range qs {
+				names = append(names, q.Name)
+			}
+			return strings.Join(names, ",")
+		}
+	}
+	return dnsmsg.QName(q)
+}
+
+// newQuery returns a recursive query for name and qtype in the IN class.
+func newQuery(id uint16, name string, qtype uint16) []byte {
+	q := make([]byte, dnsmsg.HeaderLen, dnsmsg.HeaderLen+len(name)+6)
+	binary.BigEndian.PutUint16(q, id)
+	q[2] = 0x1 // RD
+	q[5] = 1   // QDCOUNT
+	q = appendName(q, name)
+	q = append(q, byte(qtype>>8), byte(qtype), 0, dnsmsg.ClassIN)
+	return q
+}
+
+// appendRR appends to msg a resource record of the class IN with the type
+// qtype, the owner name at the offset namePtr of the message, compressed as a
+// pointer, the TTL ttl and the data rdata.
+func appendRR(msg []byte, namePtr int, qtype uint16, ttl uint32, rdata []byte) []byte {
+	var rr [12]byte
+	binary.BigEndian.PutUint16(rr[0:], 0xc000|uint16(namePtr))
+	binary.BigEndian.PutUint16(rr[2:], qtype)
+	binary.BigEndian.PutUint16(rr[4:], dnsmsg.ClassIN)
+	binary.BigEndian.PutUint32(rr[6:], ttl)
+	binary.BigEndian.PutUint16(rr[10:], uint16(len(rdata)))
+	msg = append(msg, rr[:]...)
+	return append(msg, rdata...)
+}
+
+// appendName appends the wire format of name to b.
+func appendName(b []byte, name string) []byte {
+	if name = strings.Trim(name, "."); name != "" {
+		for _, label := range strings.Split(name, ".") {
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0)
+}
+
+// servfail returns a SERVFAIL response to the query q.
+func servfail(q []byte) []byte {
+	return reply(q, dnsmsg.RCodeServFail)
+}
+
+// reply returns a response to the query q with the given rcode and no record.
+// The ID, opcode, RD and CD flags and question of q are preserved. AD is not
+// set as the response is not validated.
+func reply(q []byte, rcode int) []byte {
+	msg := make([]byte, dnsmsg.HeaderLen, dnsmsg.HeaderLen+len(q))
+	copy(msg, q)
+	msg[2] = 0x80 | msg[2]&0x79               // QR, opcode, RD
+	msg[3] = 0x80 | msg[3]&0x10 | byte(rcode) // RA, CD
+	for i := 4; i < dnsmsg.HeaderLen; i++ {
+		msg[i] = 0
+	}
+	if _, _, _, off, ok := dnsmsg.ParseQuestion(q); ok {
+		msg = append(msg, q[dnsmsg.HeaderLen:off]...)
+		msg[5] = 1 // QDCOUNT
+	}
+	return msg
+}
+
+// truncate returns msg reduced to its header and question with the TC bit set,
+// telling the client to retry over TCP to get the full response.
+func truncate(msg []byte) []byte {
+	if len(msg) < dnsmsg.HeaderLen {
+		return msg
+	}
+	t := reply(msg, dnsmsg.RCode(msg))
+	copy(t[2:4], msg[2:4])
+	dnsmsg.SetTruncated(t)
+	return t
+}
+
+// udpPayloadSize returns the maximum size of the UDP response accepted by the
+// client sending q: the payload size of its OPT record, or 512 bytes without
+// EDNS (RFC 6891).
+func udpPayloadSize(q []byte) int {
+	const minSize = 512
+	opt, ok := dnsmsg.FindOPT(q)
+	if !ok {
+		return minSize
+	}
+	size := int(opt.Class)
+	if size < minSize {
+		return minSize
+	}
+	return size
+}
+
+// removeOPT returns msg without its OPT pseudo-record.
+func removeOPT(msg []byte) []byte {
+	opt, ok := dnsmsg.FindOPT(msg)
+	if !ok {
+		return msg
+	}
+	msg = append(msg[:opt.Off], msg[opt.End():]...)
+	binary.BigEndian.PutUint16(msg[10:], binary.BigEndian.Uint16(msg[10:])-1)
+	return msg
+}
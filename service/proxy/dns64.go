@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/nextdns/windows/dnsmsg"
+)
+
+// DefaultDNS64Prefix is the well-known NAT64 prefix (RFC 6052).
+const DefaultDNS64Prefix = "64:ff9b::/96"
+
+// parseDNS64Prefix parses the NAT64 prefix s. Only the prefix lengths defined
+// by RFC 6052 are accepted.
+func parseDNS64Prefix(s string) (*net.IPNet, error) {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := n.Mask.Size()
+	if bits != 8*net.IPv6len || n.IP.To4() != nil {
+		return nil, fmt.Errorf("%s: not an IPv6 prefix", s)
+	}
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("%s: invalid NAT64 prefix length", s)
+	}
+	return n, nil
+}
+
+// synthesizeIPv6 returns the IPv4 address ip embedded in prefix as defined by
+// RFC 6052, skipping the reserved bits 64 to 71.
+func synthesizeIPv6(prefix *net.IPNet, ip net.IP) net.IP {
+	ones, _ := prefix.Mask.Size()
+	ip6 := make(net.IP, net.IPv6len)
+	copy(ip6, prefix.IP.To16())
+	pos := ones / 8
+	for _, b := range ip.To4() {
+		if pos == 8 {
+			pos++
+		}
+		ip6[pos] = b
+		pos++
+	}
+	return ip6
+}
+
+// dns64 returns the response to the AAAA query q synthesized from the A
+// records of its name when the response msg has no AAAA record (RFC 6147).
+// The synthesized records are owned by the queried name, flattening any CNAME
+// chain. Validating clients, setting DO and CD, get msg as is as they would
+// reject the synthesized records (RFC 6147 section 5.5). In any other case,
+// msg is returned as is.
+func (p *Proxy) dns64(ctx context.Context, q, msg []byte) []byte {
+	prefix := p.dns64Prefix
+	if prefix == nil || dnsmsg.RCode(msg) != dnsmsg.RCodeNoError ||
+		(dnsmsg.DNSSECOK(q) && dnsmsg.CheckingDisabled(q)) {
+		return msg
+	}
+	name, qtype, qclass, _, ok := dnsmsg.ParseQuestion(q)
+	if !ok || qtype != dnsmsg.TypeAAAA || qclass != dnsmsg.ClassIN {
+		return msg
+	}
+	hasAAAA := false
+	valid := dnsmsg.WalkRRs(msg, func(r dnsmsg.RR) {
+		if r.Section == dnsmsg.SectionAnswer && r.Type == dnsmsg.TypeAAAA {
+			hasAAAA = true
+		}
+	})
+	if !valid || hasAAAA {
+		return msg
+	}
+	maxTTL, capped := negativeTTL(msg)
+	a, err := p.lookup(ctx, newQuery(dnsmsg.ID(q), name, dnsmsg.TypeA))
+	if err != nil || dnsmsg.RCode(a) != dnsmsg.RCodeNoError {
+		return msg
+	}
+	res := reply(q, dnsmsg.RCodeNoError)
+	var count uint16
+	dnsmsg.WalkRRs(a, func(r dnsmsg.RR) {
+		if r.Section != dnsmsg.SectionAnswer || r.Type != dnsmsg.TypeA ||
+			r.Class != dnsmsg.ClassIN || r.RDataLen != net.IPv4len {
+			return
+		}
+		ttl := binary.BigEndian.Uint32(a[r.TTLOff:])
+		if capped && maxTTL < ttl {
+			ttl = maxTTL
+		}
+		rdata := synthesizeIPv6(prefix, net.IP(a[r.RDataOff:r.End()]))
+		res = appendRR(res, dnsmsg.HeaderLen, dnsmsg.TypeAAAA, ttl, rdata)
+		count++
+	})
+	if count == 0 {
+		return msg
+	}
+	binary.BigEndian.PutUint16(res[6:], count)
+	return res
+}
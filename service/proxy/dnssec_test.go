@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/nextdns/windows/dnsmsg"
+)
+
+// resolverFunc is a resolver.Resolver calling itself.
+type resolverFunc func(ctx context.Context, q []byte) ([]byte, error)
+
+func (f resolverFunc) Resolve(ctx context.Context, q []byte) ([]byte, error) {
+	return f(ctx, q)
+}
+
+// Header flags of the fourth byte.
+const (
+	flagAD = 0x20
+	flagCD = 0x10
+)
+
+// newTestQuery returns an A query for name with the given CD flag, and an
+// OPT record with the DO bit set when do is true.
+func newTestQuery(id uint16, name string, do, cd bool) []byte {
+	q := newQuery(id, name, dnsmsg.TypeA)
+	if cd {
+		q[3] |= flagCD
+	}
+	if do {
+		q = append(q, 0, 0, 41, 0x10, 0, 0, 0, 0x80, 0, 0, 0)
+		q[11] = 1 // ARCOUNT
+	}
+	return q
+}
+
+// answerA returns a response to q with an A record for ip, the flags of q
+// and ad as the AD flag. The additional section of q is copied.
+func answerA(q []byte, ip net.IP, ad bool) []byte {
+	_, _, _, off, ok := dnsmsg.ParseQuestion(q)
+	if !ok {
+		panic("invalid query")
+	}
+	msg := append([]byte(nil), q[:off]...)
+	msg[2] |= 0x80 // QR
+	msg[3] |= 0x80 // RA
+	if ad {
+		msg[3] |= flagAD
+	}
+	binary.BigEndian.PutUint16(msg[6:], 1)
+	msg = append(msg, 0xc0, dnsmsg.HeaderLen, 0, dnsmsg.TypeA, 0, dnsmsg.ClassIN, 0, 0, 1, 0x2c, 0, 4)
+	msg = append(msg, ip.To4()...)
+	return append(msg, q[off:]...)
+}
+
+func TestDNSSECFlagsPassthrough(t *testing.T) {
+	for _, cache := range []bool{false, true} {
+		var got []byte
+		p := &Proxy{}
+		if cache {
+			p.Cache = &Cache{}
+		}
+		p.upstreams = []upstream{{name: "test", resolver: resolverFunc(func(ctx context.Context, q []byte) ([]byte, error) {
+			got = append([]byte(nil), q...)
+			return answerA(q, net.IPv4(192, 0, 2, 1), dnsmsg.DNSSECOK(q)), nil
+		})}}
+		for _, tt := range []struct{ do, cd bool }{{false, false}, {true, false}, {false, true}, {true, true}} {
+			got = nil
+			q := newTestQuery(0x1234, "example.com.", tt.do, tt.cd)
+			msg, err := p.resolve(context.Background(), q)
+			if err != nil {
+				t.Fatalf("cache=%v do=%v cd=%v: %v", cache, tt.do, tt.cd, err)
+			}
+			if got == nil {
+				t.Errorf("cache=%v do=%v cd=%v: query not sent upstream", cache, tt.do, tt.cd)
+				continue
+			}
+			if got[2]&0x01 == 0 || dnsmsg.CheckingDisabled(got) != tt.cd || dnsmsg.DNSSECOK(got) != tt.do {
+				t.Errorf("cache=%v do=%v cd=%v: upstream got RD=%v CD=%v DO=%v", cache, tt.do, tt.cd,
+					got[2]&0x01 != 0, dnsmsg.CheckingDisabled(got), dnsmsg.DNSSECOK(got))
+			}
+			if msg[2]&0x01 == 0 || dnsmsg.CheckingDisabled(msg) != tt.cd || dnsmsg.AuthenticData(msg) != tt.do {
+				t.Errorf("cache=%v do=%v cd=%v: response RD=%v CD=%v AD=%v", cache, tt.do, tt.cd,
+					msg[2]&0x01 != 0, dnsmsg.CheckingDisabled(msg), dnsmsg.AuthenticData(msg))
+			}
+		}
+	}
+}
+
+func TestCacheKeyDNSSECFlags(t *testing.T) {
+	calls := 0
+	p := &Proxy{Cache: &Cache{}}
+	p.upstreams = []upstream{{name: "test", resolver: resolverFunc(func(ctx context.Context, q []byte) ([]byte, error) {
+		calls++
+		return answerA(q, net.IPv4(192, 0, 2, 1), dnsmsg.DNSSECOK(q)), nil
+	})}}
+	for i := 0; i < 2; i++ {
+		for _, tt := range []struct{ do, cd bool }{{false, false}, {true, false}, {false, true}, {true, true}} {
+			msg, err := p.resolve(context.Background(), newTestQuery(1, "example.com.", tt.do, tt.cd))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dnsmsg.AuthenticData(msg) != tt.do {
+				t.Errorf("do=%v cd=%v: AD=%v served from the cache", tt.do, tt.cd, dnsmsg.AuthenticData(msg))
+			}
+		}
+	}
+	if calls != 4 {
+		t.Errorf("%d upstream queries, want 4", calls)
+	}
+}
+
+func TestReplyFlags(t *testing.T) {
+	q := newTestQuery(1, "example.com.", true, true)
+	q[3] |= flagAD
+	msg := reply(q, dnsmsg.RCodeRefused)
+	if msg[2]&0x01 == 0 {
+		t.Error("RD not preserved")
+	}
+	if !dnsmsg.CheckingDisabled(msg) {
+		t.Error("CD not preserved")
+	}
+	if dnsmsg.AuthenticData(msg) {
+		t.Error("AD set on a local response")
+	}
+	if rc := dnsmsg.RCode(msg); rc != dnsmsg.RCodeRefused {
+		t.Errorf("rcode %d, want %d", rc, dnsmsg.RCodeRefused)
+	}
+}
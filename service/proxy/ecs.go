@@ -0,0 +1,43 @@
+package proxy
+
+// ECSMode defines how the EDNS0 Client Subnet option (RFC 7871) of queries is
+// handled before they are sent upstream.
+type ECSMode int
+
+const (
+	// ECSPassthrough forwards the queries unchanged.
+	ECSPassthrough ECSMode = iota
+
+	// ECSStrip removes the ECS option added by the client if any.
+	ECSStrip
+
+	// ECSDisable replaces the ECS option of the queries with a 0.0.0.0/0 one,
+	// telling the upstream not to use the client subnet. Queries sent without
+	// EDNS get an OPT record added, which is removed from the response.
+	ECSDisable
+)
+
+// ecsDisabled is a ECS option with a 0.0.0.0/0 source prefix.
+var ecsDisabled = []byte{
+	0, optionECS, // option code
+	0, 4, // option length
+	0, 1, // family: IPv4
+	0, // source prefix length
+	0, // scope prefix length
+}
+
+// rewriteQuery applies the mode to the query q. If q has to be changed, a new
+// slice is returned and q is left untouched. The addedOPT return value reports
+// if an OPT record was added to q.
+func (m ECSMode) rewriteQuery(q []byte) (nq []byte, addedOPT bool) {
+	if m == ECSPassthrough {
+		return q, false
+	}
+	return rewriteOptions(q, func(opts []byte) []byte {
+		opts = removeOption(opts, optionECS)
+		if m == ECSDisable {
+			opts = append(opts, ecsDisabled...)
+		}
+		return opts
+	})
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/nextdns/windows/dnsmsg"
+)
+
+// optionEDE is the Extended DNS Error EDNS option (RFC 8914).
+const optionEDE = 15
+
+// ExtendedError is an Extended DNS Error (RFC 8914) returned by the upstream
+// to explain a response, like why a name was blocked.
+type ExtendedError struct {
+	// Code is the INFO-CODE of the error, like 15 for Blocked, 16 for
+	// Censored or 17 for Filtered.
+	Code uint16
+
+	// Text is the optional EXTRA-TEXT of the error.
+	Text string
+}
+
+var extendedErrorNames = map[uint16]string{
+	0:  "Other",
+	1:  "Unsupported DNSKEY Algorithm",
+	2:  "Unsupported DS Digest Type",
+	3:  "Stale Answer",
+	4:  "Forged Answer",
+	5:  "DNSSEC Indeterminate",
+	6:  "DNSSEC Bogus",
+	7:  "Signature Expired",
+	8:  "Signature Not Yet Valid",
+	9:  "DNSKEY Missing",
+	10: "RRSIGs Missing",
+	11: "No Zone Key Bit Set",
+	12: "NSEC Missing",
+	13: "Cached Error",
+	14: "Not Ready",
+	15: "Blocked",
+	16: "Censored",
+	17: "Filtered",
+	18: "Prohibited",
+	19: "Stale NXDOMAIN Answer",
+	20: "Not Authoritative",
+	21: "Not Supported",
+	22: "No Reachable Authority",
+	23: "Network Error",
+	24: "Invalid Data",
+}
+
+func (e ExtendedError) String() string {
+	name, ok := extendedErrorNames[e.Code]
+	if !ok {
+		name = fmt.Sprintf("Code %d", e.Code)
+	}
+	if e.Text == "" {
+		return name
+	}
+	return name + ": " + e.Text
+}
+
+// extendedError returns the first Extended DNS Error of the OPT record of the
+// response msg, if any.
+func extendedError(msg []byte) (*ExtendedError, bool) {
+	opt, ok := dnsmsg.FindOPT(msg)
+	if !ok {
+		return nil, false
+	}
+	opts := msg[opt.RDataOff:opt.End()]
+	if !validOptions(opts) {
+		return nil, false
+	}
+	for len(opts) > 0 {
+		l := int(binary.BigEndian.Uint16(opts[2:]))
+		if binary.BigEndian.Uint16(opts) == optionEDE && l >= 2 {
+			data := opts[4 : 4+l]
+			return &ExtendedError{
+				Code: binary.BigEndian.Uint16(data),
+				Text: string(data[2:]),
+			}, true
+		}
+		opts = opts[4+l:]
+	}
+	return nil, false
+}
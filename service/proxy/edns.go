@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/nextdns/windows/dnsmsg"
+)
+
+const (
+	optionECS     = 8
+	optionPadding = 12
+
+	// ednsUDPSize is the UDP payload size advertised in the OPT records we
+	// add, the size assumed by clients not using EDNS.
+	ednsUDPSize = 512
+)
+
+// rewriteOptions returns q with the options of its OPT record replaced by the
+// ones returned by fn, called with the current options. If q has no OPT
+// record, fn is called with no option and an OPT record is added if it
+// returns some. If q has to be changed, a new slice is returned and q is left
+// untouched. Malformed queries are returned unchanged.
+func rewriteOptions(q []byte, fn func(opts []byte) []byte) (nq []byte, addedOPT bool) {
+	opt, ok := dnsmsg.FindOPT(q)
+	if !ok {
+		if !dnsmsg.WalkRRs(q, func(dnsmsg.RR) {}) {
+			return q, false
+		}
+		opts := fn(nil)
+		if len(opts) == 0 {
+			return q, false
+		}
+		nq = make([]byte, 0, len(q)+11+len(opts))
+		nq = append(nq, q...)
+		nq = append(nq,
+			0,                 // root name
+			0, dnsmsg.TypeOPT, // type
+			ednsUDPSize>>8, ednsUDPSize&0xff, // class: UDP payload size
+			0, 0, 0, 0, // TTL: extended rcode and flags
+			byte(len(opts)>>8), byte(len(opts)), // rdata length
+		)
+		nq = append(nq, opts...)
+		binary.BigEndian.PutUint16(nq[10:], binary.BigEndian.Uint16(nq[10:])+1)
+		return nq, true
+	}
+
+	end := opt.RDataOff + opt.RDataLen
+	cur := q[opt.RDataOff:end]
+	if !validOptions(cur) {
+		return q, false
+	}
+	opts := fn(append([]byte(nil), cur...))
+	if bytes.Equal(opts, cur) {
+		return q, false
+	}
+	nq = make([]byte, 0, len(q)-len(cur)+len(opts))
+	nq = append(nq, q[:opt.RDataOff]...)
+	nq = append(nq, opts...)
+	nq = append(nq, q[end:]...)
+	binary.BigEndian.PutUint16(nq[opt.RDataOff-2:], uint16(len(opts)))
+	return nq, false
+}
+
+// validOptions reports if opts is a well-formed sequence of EDNS options.
+func validOptions(opts []byte) bool {
+	for len(opts) > 0 {
+		if len(opts) < 4 {
+			return false
+		}
+		l := 4 + int(binary.BigEndian.Uint16(opts[2:]))
+		if l > len(opts) {
+			return false
+		}
+		opts = opts[l:]
+	}
+	return true
+}
+
+// removeOption returns the well-formed options opts without the ones with the
+// given code. opts is modified in place.
+func removeOption(opts []byte, code uint16) []byte {
+	out := opts[:0]
+	for len(opts) > 0 {
+		l := 4 + int(binary.BigEndian.Uint16(opts[2:]))
+		if binary.BigEndian.Uint16(opts) != code {
+			out = append(out, opts[:l]...)
+		}
+		opts = opts[l:]
+	}
+	return out
+}
+
+// queryPaddingBlock is the block size queries are padded to, as recommended
+// by RFC 8467.
+const queryPaddingBlock = 128
+
+// padQuery returns q padded to a multiple of queryPaddingBlock bytes using the
+// EDNS padding option (RFC 7830). If q has to be changed, a new slice is
+// returned and q is left untouched. The addedOPT return value reports if an
+// OPT record was added to q.
+func padQuery(q []byte) (nq []byte, addedOPT bool) {
+	pad := func(n int) func(opts []byte) []byte {
+		return func(opts []byte) []byte {
+			opts = removeOption(opts, optionPadding)
+			opts = append(opts, 0, optionPadding, byte(n>>8), byte(n))
+			return append(opts, make([]byte, n)...)
+		}
+	}
+	// Add an empty padding option first to know the size to pad.
+	nq, addedOPT = rewriteOptions(q, pad(0))
+	if n := len(nq) % queryPaddingBlock; n != 0 {
+		nq, _ = rewriteOptions(nq, pad(queryPaddingBlock-n))
+	}
+	return nq, addedOPT
+}
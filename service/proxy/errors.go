@@ -0,0 +1,42 @@
+package proxy
+
+import "fmt"
+
+// QueryError is reported to ErrorLog when a query could not be resolved. Err
+// is the last upstream error, like a resolver.StatusError, a
+// resolver.TransportError or ErrPinMismatch, and can be inspected with
+// errors.As and errors.Is. Timeout reports if the query did not get a
+// response within QueryTimeout.
+type QueryError struct {
+	MsgID   uint16
+	Name    string
+	Timeout bool
+	Err     error
+}
+
+func (e *QueryError) Error() string {
+	if e.Timeout {
+		return fmt.Sprintf("resolve: %x %s: timeout: %v", e.MsgID, e.Name, e.Err)
+	}
+	return fmt.Sprintf("resolve: %x %s: %v", e.MsgID, e.Name, e.Err)
+}
+
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+// UnleakError is reported to ErrorLog when dnsunleak could not be started or
+// exited, in which case DNS queries may leak outside of the proxy. It is also
+// returned by Start when RequireLeakProtection is set and dnsunleak is
+// missing.
+type UnleakError struct {
+	Err error
+}
+
+func (e *UnleakError) Error() string {
+	return fmt.Sprintf("cannot start dnsunleak: %v", e.Err)
+}
+
+func (e *UnleakError) Unwrap() error {
+	return e.Err
+}
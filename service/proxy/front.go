@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/nextdns/nextdns/resolver/endpoint"
+	"github.com/nextdns/windows/resolver"
+)
+
+// bootstrapAddrs returns the host:port addresses to connect to the NextDNS
+// upstream hostname on port: the Bootstrap IPs, or the anycast ones.
+func (p *Proxy) bootstrapAddrs(port string) []string {
+	ips := p.Bootstrap
+	if len(ips) == 0 {
+		ips = []net.IP{net.ParseIP("45.90.28.0"), net.ParseIP("2a07:a8c0::"),
+			net.ParseIP("45.90.30.0"), net.ParseIP("2a07:a8c1::")}
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	return addrs
+}
+
+// nextdnsFrontedUpstream returns the NextDNS DoH upstream sending UpstreamHost
+// as the request Host and UpstreamSNI as the TLS server name, each defaulting
+// to the upstream hostname. The endpoint steering is not used: connections go
+// to the Bootstrap IPs, or the anycast ones.
+func (p *Proxy) nextdnsFrontedUpstream() upstream {
+	host := stringOr(p.UpstreamHost, p.nextdnsHostname())
+	sni := stringOr(p.UpstreamSNI, host)
+	t := p.newDirectTransport(p.bootstrapAddrs("443"), sni)
+	// The request Host is the endpoint hostname when a transport is set.
+	e := endpoint.MustNew("https://" + host)
+	r := p.newDOH(func(ctx context.Context, action func(e endpoint.Endpoint) error) error {
+		return action(e)
+	})
+	r.Transport = t
+	return upstream{name: "NextDNS (" + sni + ")", resolver: r}
+}
+
+// newDirectTransport returns a transport connecting to addrs with
+// resolver.DialAddrs, racing IPv6 and IPv4, or to the address of the request
+// if addrs is empty, verifying the server certificate for serverName if not
+// empty.
+func (p *Proxy) newDirectTransport(addrs []string, serverName string) *http.Transport {
+	d := p.dialer()
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if len(addrs) == 0 {
+				return d.DialContext(ctx, network, addr)
+			}
+			return resolver.DialAddrs(ctx, d, network, addrs)
+		},
+		TLSClientConfig: &tls.Config{
+			ServerName:         serverName,
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		},
+		TLSHandshakeTimeout: 5 * time.Second,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: p.MaxIdleConns,
+		IdleConnTimeout:     p.IdleConnTimeout,
+	}
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+)
+
+// errDropped is returned by handle when QueryHook or ResponseHook dropped the
+// query, or when it cannot be answered.
+var errDropped = errors.New("query dropped")
+
+// handle returns the response to the query q, passing it through QueryHook
+// before resolve and the response through ResponseHook after.
+func (p *Proxy) handle(ctx context.Context, q []byte) ([]byte, error) {
+	if p.QueryHook != nil {
+		nq, msg := p.QueryHook(q)
+		if msg != nil {
+			return p.responseHook(q, msg)
+		}
+		if nq == nil {
+			return nil, errDropped
+		}
+		q = nq
+	}
+	msg, err := p.resolve(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return p.responseHook(q, msg)
+}
+
+func (p *Proxy) responseHook(q, msg []byte) ([]byte, error) {
+	if p.ResponseHook == nil {
+		return msg, nil
+	}
+	if msg = p.ResponseHook(q, msg); msg == nil {
+		return nil, errDropped
+	}
+	return msg, nil
+}
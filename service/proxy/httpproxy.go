@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// httpProxyURL parses HTTPProxy.
+func (p *Proxy) httpProxyURL() (*url.URL, error) {
+	u, err := url.Parse(p.HTTPProxy)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("%s: unsupported scheme", p.HTTPProxy)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("%s: missing host", p.HTTPProxy)
+	}
+	return u, nil
+}
+
+// httpProxyAddr returns the host:port address of the HTTP proxy u.
+func httpProxyAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// resolveHTTPProxy resolves the HTTPProxy host and stores its addresses in
+// p.proxyAddrs. On failure, the previous addresses are kept.
+func (p *Proxy) resolveHTTPProxy() {
+	u, err := p.httpProxyURL()
+	if err != nil {
+		return // reported when creating the transport
+	}
+	host, port, _ := net.SplitHostPort(httpProxyAddr(u))
+	if net.ParseIP(host) != nil {
+		p.proxyAddrs = []string{net.JoinHostPort(host, port)}
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		p.logErr(fmt.Errorf("http proxy: %v", err))
+		return
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip, port))
+	}
+	p.proxyAddrs = addrs
+}
+
+// newProxyTransport returns a transport sending the requests through
+// HTTPProxy.
+func (p *Proxy) newProxyTransport() (http.RoundTripper, error) {
+	u, err := p.httpProxyURL()
+	if err != nil {
+		return nil, err
+	}
+	addrs := p.proxyAddrs
+	if len(addrs) == 0 {
+		return nil, errors.New("could not resolve " + u.Hostname())
+	}
+	d := p.dialer()
+	return &http.Transport{
+		// The connections are tunneled through the proxy with CONNECT, the
+		// TLS handshake with the upstream made over the tunnel.
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialHTTPProxy(ctx, d, u, addrs, addr)
+		},
+		TLSClientConfig: &tls.Config{
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		},
+		TLSHandshakeTimeout: 5 * time.Second,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: p.MaxIdleConns,
+		IdleConnTimeout:     p.IdleConnTimeout,
+	}, nil
+}
+
+// dialHTTPProxy opens a tunnel to addr through the HTTP proxy u, dialed at
+// one of its resolved addresses proxyAddrs with d. The credentials of u, if
+// any, are sent once the proxy asks for them, with NTLM or basic
+// authentication, NTLM preferred.
+func dialHTTPProxy(ctx context.Context, d *net.Dialer, u *url.URL, proxyAddrs []string, addr string) (net.Conn, error) {
+	c, br, err := dialProxyConn(ctx, d, u, proxyAddrs)
+	if err != nil {
+		return nil, err
+	}
+	res, err := httpConnect(c, br, addr, "")
+	if err == nil && res.StatusCode == http.StatusProxyAuthRequired && u.User != nil {
+		scheme := proxyAuthScheme(res)
+		if scheme != "" && res.Close {
+			c.Close()
+			if c, br, err = dialProxyConn(ctx, d, u, proxyAddrs); err != nil {
+				return nil, err
+			}
+		}
+		switch scheme {
+		case "ntlm":
+			res, err = ntlmConnect(c, br, addr, u.User)
+		case "basic":
+			password, _ := u.User.Password()
+			auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+			res, err = httpConnect(c, br, addr, "Basic "+auth)
+		}
+	}
+	if err == nil && res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("http proxy: %s", res.Status)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	// The handshake is bound to ctx, not the tunnel.
+	_ = c.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: c, r: br}, nil
+	}
+	return c, nil
+}
+
+// dialProxyConn connects to the HTTP proxy u, with TLS for an https URL.
+func dialProxyConn(ctx context.Context, d *net.Dialer, u *url.URL, addrs []string) (c net.Conn, br *bufio.Reader, err error) {
+	// Only the proxy is dialed, use its resolved addresses.
+	for _, addr := range addrs {
+		if c, err = d.DialContext(ctx, "tcp", addr); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(deadline)
+	}
+	if u.Scheme == "https" {
+		tc := tls.Client(c, &tls.Config{ServerName: u.Hostname()})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+		c = tc
+	}
+	return c, bufio.NewReader(c), nil
+}
+
+// httpConnect sends a CONNECT request for addr on the proxy connection c,
+// with the Proxy-Authorization auth if not empty, and returns the response
+// read from br. The body of a failure response is consumed so the connection
+// can be used for the next step of an authentication.
+func httpConnect(c net.Conn, br *bufio.Reader, addr, auth string) (*http.Response, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+	if err := req.Write(c); err != nil {
+		return nil, err
+	}
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 1<<16))
+		res.Body.Close()
+	}
+	return res, nil
+}
+
+// proxyAuthScheme returns the authentication scheme to use among the ones
+// accepted by the proxy in the response res, in lower case, or an empty
+// string if none is supported.
+func proxyAuthScheme(res *http.Response) string {
+	scheme := ""
+	for _, v := range res.Header.Values("Proxy-Authenticate") {
+		switch s := strings.ToLower(strings.Fields(v + " ")[0]); s {
+		case "ntlm":
+			return s
+		case "basic":
+			scheme = s
+		}
+	}
+	return scheme
+}
+
+// ntlmConnect sends a CONNECT request for addr authenticated with NTLM on
+// the proxy connection c. The user name of user may be prefixed with its
+// domain, like DOMAIN\user.
+func ntlmConnect(c net.Conn, br *bufio.Reader, addr string, user *url.Userinfo) (*http.Response, error) {
+	res, err := httpConnect(c, br, addr, "NTLM "+base64.StdEncoding.EncodeToString(ntlmNegotiateMessage()))
+	if err != nil || res.StatusCode != http.StatusProxyAuthRequired {
+		return res, err
+	}
+	var challenge []byte
+	for _, v := range res.Header.Values("Proxy-Authenticate") {
+		if f := strings.Fields(v); len(f) == 2 && strings.EqualFold(f[0], "ntlm") {
+			challenge, _ = base64.StdEncoding.DecodeString(f[1])
+		}
+	}
+	if challenge == nil {
+		return res, nil
+	}
+	if res.Close {
+		return nil, errors.New("http proxy: connection closed during the NTLM authentication")
+	}
+	ch, err := parseNTLMChallenge(challenge)
+	if err != nil {
+		return nil, err
+	}
+	domain, name := "", user.Username()
+	if i := strings.IndexByte(name, '\\'); i >= 0 {
+		domain, name = name[:i], name[i+1:]
+	}
+	password, _ := user.Password()
+	msg, err := ntlmAuthenticateMessage(ch, domain, name, password)
+	if err != nil {
+		return nil, err
+	}
+	return httpConnect(c, br, addr, "NTLM "+base64.StdEncoding.EncodeToString(msg))
+}
+
+// bufferedConn is a connection whose first bytes were read in r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNTLMv2Response(t *testing.T) {
+	// Test vectors of MS-NLMP section 4.2.4.
+	key := ntowfv2("Domain", "User", "Password")
+	if got := hex.EncodeToString(key); got != "0c868a403bfd7a93a3001ef22ef02e3f" {
+		t.Errorf("ntowfv2() = %s", got)
+	}
+	targetInfo := append(append([]byte{2, 0, 12, 0}, utf16le("Domain")...), 1, 0, 12, 0)
+	targetInfo = append(append(targetInfo, utf16le("Server")...), 0, 0, 0, 0)
+	server := [8]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	client := [8]byte{0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa}
+	nt := ntlmv2Response(key, server, client, 0, targetInfo)
+	if got := hex.EncodeToString(nt[:16]); got != "68cd0ab851e51c96aabc927bebef6a1c" {
+		t.Errorf("NTProofStr = %s", got)
+	}
+	if !bytes.Equal(nt[16+16:16+24], client[:]) || !bytes.HasSuffix(nt, append(targetInfo, 0, 0, 0, 0)) {
+		t.Errorf("invalid client blob % x", nt[16:])
+	}
+}
+
+// ntlmTestChallenge is the challenge sent by startTestHTTPProxy.
+var ntlmTestChallenge = [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+// ntlmChallengeMessage returns a CHALLENGE_MESSAGE with ntlmTestChallenge.
+func ntlmChallengeMessage() []byte {
+	targetInfo := append(append([]byte{2, 0, 12, 0}, utf16le("DOMAIN")...), 0, 0, 0, 0)
+	b := make([]byte, 48)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 2)
+	binary.LittleEndian.PutUint32(b[20:], ntlmFlags)
+	copy(b[24:], ntlmTestChallenge[:])
+	binary.LittleEndian.PutUint16(b[40:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint16(b[42:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint32(b[44:], uint32(len(b)))
+	return append(b, targetInfo...)
+}
+
+// ntlmField returns the field of the AUTHENTICATE_MESSAGE msg described at
+// pos.
+func ntlmField(msg []byte, pos int) []byte {
+	l := int(binary.LittleEndian.Uint16(msg[pos:]))
+	off := int(binary.LittleEndian.Uint32(msg[pos+4:]))
+	if off+l > len(msg) {
+		return nil
+	}
+	return msg[off : off+l]
+}
+
+// checkNTLMAuth reports if the AUTHENTICATE_MESSAGE msg answers
+// ntlmTestChallenge for DOMAIN\user with password.
+func checkNTLMAuth(msg []byte) bool {
+	if len(msg) < 64 || !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 3 {
+		return false
+	}
+	nt := ntlmField(msg, 20)
+	if len(nt) < 16+28 ||
+		!bytes.Equal(ntlmField(msg, 28), utf16le("DOMAIN")) ||
+		!bytes.Equal(ntlmField(msg, 36), utf16le("user")) {
+		return false
+	}
+	mac := hmac.New(md5.New, ntowfv2("DOMAIN", "user", "password"))
+	mac.Write(ntlmTestChallenge[:])
+	mac.Write(nt[16:])
+	return hmac.Equal(mac.Sum(nil), nt[:16])
+}
+
+// startTestHTTPProxy starts an HTTP proxy on the loopback accepting the
+// CONNECT requests authenticated with the scheme, "NTLM", "Basic" or none,
+// for DOMAIN\user and password. The tunnels echo what they receive. It
+// returns the proxy address.
+func startTestHTTPProxy(t *testing.T, scheme string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	respond := func(c net.Conn, status int, hdr http.Header) {
+		res := &http.Response{StatusCode: status, ProtoMajor: 1, ProtoMinor: 1, Header: hdr}
+		if status != http.StatusOK {
+			res.ContentLength = 0
+		}
+		res.Write(c)
+	}
+	serve := func(c net.Conn) {
+		defer c.Close()
+		br := bufio.NewReader(c)
+		for {
+			req, err := http.ReadRequest(br)
+			if err != nil || req.Method != http.MethodConnect {
+				return
+			}
+			auth := strings.Fields(req.Header.Get("Proxy-Authorization") + " ")
+			ok := scheme == ""
+			switch {
+			case scheme == "Basic" && len(auth) == 2 && auth[0] == "Basic":
+				ok = auth[1] == base64.StdEncoding.EncodeToString([]byte(`DOMAIN\user:password`))
+			case scheme == "NTLM" && len(auth) == 2 && auth[0] == "NTLM":
+				msg, _ := base64.StdEncoding.DecodeString(auth[1])
+				if len(msg) >= 12 && binary.LittleEndian.Uint32(msg[8:]) == 1 {
+					respond(c, http.StatusProxyAuthRequired, http.Header{
+						"Proxy-Authenticate": {"NTLM " + base64.StdEncoding.EncodeToString(ntlmChallengeMessage())},
+					})
+					continue
+				}
+				ok = checkNTLMAuth(msg)
+			}
+			if !ok {
+				respond(c, http.StatusProxyAuthRequired, http.Header{
+					"Proxy-Authenticate": {scheme + ` realm="test"`, "Negotiate"},
+				})
+				continue
+			}
+			respond(c, http.StatusOK, http.Header{})
+			io.Copy(c, br)
+			return
+		}
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestDialHTTPProxy(t *testing.T) {
+	tests := []struct {
+		name   string
+		scheme string
+		user   *url.Userinfo
+		ok     bool
+	}{
+		{"no auth", "", nil, true},
+		{"basic", "Basic", url.UserPassword(`DOMAIN\user`, "password"), true},
+		{"basic wrong password", "Basic", url.UserPassword(`DOMAIN\user`, "wrong"), false},
+		{"ntlm", "NTLM", url.UserPassword(`DOMAIN\user`, "password"), true},
+		{"ntlm wrong password", "NTLM", url.UserPassword(`DOMAIN\user`, "wrong"), false},
+		{"ntlm no credentials", "NTLM", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startTestHTTPProxy(t, tt.scheme)
+			u := &url.URL{Scheme: "http", Host: addr, User: tt.user}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			c, err := dialHTTPProxy(ctx, &net.Dialer{}, u, []string{addr}, "dns.nextdns.io:443")
+			if !tt.ok {
+				if err == nil {
+					c.Close()
+					t.Fatal("dialHTTPProxy() succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := c.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			var b [4]byte
+			if _, err := io.ReadFull(c, b[:]); err != nil || string(b[:]) != "ping" {
+				t.Errorf("tunnel read %q, %v, want the echo", b, err)
+			}
+		})
+	}
+}
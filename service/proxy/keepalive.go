@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nextdns/windows/dnsmsg"
+)
+
+// keepAlive watches the upstream activity when KeepAliveInterval or
+// IdleConnTimeout is set. Idle connections are probed every
+// KeepAliveInterval and reset when the probe fails, or reset once idle for
+// IdleConnTimeout, so the first query after a long idle period, like after a
+// standby, does not hang on a connection silently dropped by the network. It
+// returns when ctx is done.
+func (p *Proxy) keepAlive(ctx context.Context) {
+	period := p.KeepAliveInterval
+	if period <= 0 || (p.IdleConnTimeout > 0 && p.IdleConnTimeout < period) {
+		period = p.IdleConnTimeout
+	}
+	t := time.NewTicker(period)
+	defer t.Stop()
+	var reset time.Time // last exchange when the connections were reset
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		last := p.stats.lastExchangeTime()
+		idle := time.Since(last)
+		switch {
+		case p.KeepAliveInterval > 0 && idle >= p.KeepAliveInterval:
+			if err := p.keepAliveProbe(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				p.logErr(fmt.Errorf("keepalive: %v, resetting upstream connections", err))
+				p.resetUpstreams()
+			}
+		case p.IdleConnTimeout > 0 && idle >= p.IdleConnTimeout && !last.Equal(reset):
+			p.logInfo("Upstream connections idle, resetting them")
+			p.resetUpstreams()
+			reset = last
+		}
+	}
+}
+
+// keepAliveProbe sends a query upstream on the current connections.
+func (p *Proxy) keepAliveProbe(ctx context.Context) error {
+	timeout := p.QueryTimeout
+	if timeout <= 0 {
+		timeout = DefaultQueryTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	_, err := p.exchangeOnce(ctx, newQuery(0, healthCheckName, dnsmsg.TypeA))
+	return err
+}
+
+// resetUpstreams replaces the upstreams, closing their connections, if the
+// proxy is started.
+func (p *Proxy) resetUpstreams() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stateLocked() != StateStarted {
+		return
+	}
+	p.setupUpstreams()
+}
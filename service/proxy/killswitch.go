@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/nextdns/windows/dnsmsg"
+)
+
+// KillSwitchMode defines how the queries are answered while no upstream is
+// reachable and the leak protection keeps them from going elsewhere.
+type KillSwitchMode int
+
+const (
+	// KillSwitchOff sends the queries upstream anyway, the clients waiting
+	// for them to time out.
+	KillSwitchOff KillSwitchMode = iota
+
+	// KillSwitchServFail answers SERVFAIL right away.
+	KillSwitchServFail
+
+	// KillSwitchRefused answers REFUSED right away.
+	KillSwitchRefused
+
+	// KillSwitchNullIP answers 0.0.0.0 to A queries, :: to AAAA queries and
+	// an empty answer to the others right away.
+	KillSwitchNullIP
+)
+
+// killSwitchTTL is the TTL of the addresses answered with KillSwitchNullIP,
+// zero so they are not cached past the outage.
+const killSwitchTTL = 0
+
+// killSwitch returns the response to q according to KillSwitch if the
+// upstreams are down while the leak protection is active.
+func (p *Proxy) killSwitch(q []byte) ([]byte, bool) {
+	if p.KillSwitch == KillSwitchOff || !p.LeakProtected() || !p.upstreamsDown() {
+		return nil, false
+	}
+	switch p.KillSwitch {
+	case KillSwitchRefused:
+		return reply(q, dnsmsg.RCodeRefused), true
+	case KillSwitchNullIP:
+		return nullIPReply(q, killSwitchTTL), true
+	}
+	return reply(q, dnsmsg.RCodeServFail), true
+}
+
+// upstreamsDown reports if no upstream is expected to answer: the
+// reconnection manager is reconnecting, or the circuit breakers of all the
+// upstreams are open and not due for a probe yet.
+func (p *Proxy) upstreamsDown() bool {
+	if atomic.LoadInt32(&p.stats.reconnecting) == 1 {
+		return true
+	}
+	_, ups := p.currentUpstreams()
+	if len(ups) == 0 {
+		return false
+	}
+	now := time.Now()
+	for _, u := range ups {
+		if u.breaker == nil || !u.breaker.cooling(now) {
+			return false
+		}
+	}
+	return true
+}
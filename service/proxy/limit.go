@@ -0,0 +1,49 @@
+package proxy
+
+import "time"
+
+const (
+	// DefaultMaxConcurrentQueries defines the default value for Proxy
+	// MaxConcurrentQueries. Browsing rarely has more than a few dozens of
+	// queries in flight.
+	DefaultMaxConcurrentQueries = 256
+
+	// queryQueueTimeout is the time a query waits for a slot when
+	// MaxConcurrentQueries are already in flight before being dropped.
+	queryQueueTimeout = 100 * time.Millisecond
+)
+
+// queryLimiter bounds the number of queries resolved concurrently.
+type queryLimiter chan struct{}
+
+func newQueryLimiter(max int) queryLimiter {
+	if max <= 0 {
+		max = DefaultMaxConcurrentQueries
+	}
+	return make(queryLimiter, max)
+}
+
+// acquire takes a slot, waiting up to queryQueueTimeout for one to be
+// released. It returns false if no slot got available in time or if stop is
+// closed.
+func (l queryLimiter) acquire(stop <-chan struct{}) bool {
+	select {
+	case l <- struct{}{}:
+		return true
+	default:
+	}
+	t := time.NewTimer(queryQueueTimeout)
+	defer t.Stop()
+	select {
+	case l <- struct{}{}:
+		return true
+	case <-t.C:
+	case <-stop:
+	}
+	return false
+}
+
+// release frees a slot taken with acquire.
+func (l queryLimiter) release() {
+	<-l
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel is the minimum severity of the messages sent to Logger.
+type LogLevel int32
+
+const (
+	// LogLevelDebug logs the verbose messages too, like each packet
+	// dropped with the reason. It slows the packet handling down and is
+	// meant for troubleshooting only.
+	LogLevelDebug LogLevel = iota - 1
+
+	// LogLevelInfo logs the informational messages, warnings and errors.
+	// It is the default.
+	LogLevelInfo
+
+	// LogLevelWarn logs the warnings and errors.
+	LogLevelWarn
+
+	// LogLevelError logs the errors only.
+	LogLevelError
+)
+
+var logLevelNames = [...]string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if i := int(l - LogLevelDebug); i >= 0 && i < len(logLevelNames) {
+		return logLevelNames[i]
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// ParseLogLevel returns the level named s, like "debug", as returned by
+// LogLevel.String.
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevelDebug + LogLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level %q", s)
+}
+
+// Logger receives the messages of the proxy at or above the level set with
+// SetLogLevel.
+type Logger interface {
+	Debug(msg string)
+	Info(msg string)
+	Warn(msg string)
+	Error(msg string)
+}
+
+// SetLogLevel sets the minimum level of the messages logged. It can be called
+// while the proxy runs, like to turn debug messages on while troubleshooting.
+func (p *Proxy) SetLogLevel(l LogLevel) {
+	atomic.StoreInt32(&p.logLevel, int32(l))
+}
+
+// LogLevel returns the level set with SetLogLevel.
+func (p *Proxy) LogLevel() LogLevel {
+	return LogLevel(atomic.LoadInt32(&p.logLevel))
+}
+
+// logEnabled reports if the messages of level l are logged.
+func (p *Proxy) logEnabled(l LogLevel) bool {
+	if l == LogLevelDebug && p.Logger == nil {
+		// DebugLog predates the levels and enables the debug messages when
+		// set.
+		return p.DebugLog != nil
+	}
+	return l >= p.LogLevel()
+}
+
+// logger returns Logger, or the adapter of ErrorLog, InfoLog and DebugLog if
+// not set.
+func (p *Proxy) logger() Logger {
+	if p.Logger != nil {
+		return p.Logger
+	}
+	return callbackLogger{p}
+}
+
+// callbackLogger sends the messages to the ErrorLog, InfoLog and DebugLog
+// callbacks of the proxy, warnings going to InfoLog.
+type callbackLogger struct {
+	p *Proxy
+}
+
+func (l callbackLogger) Debug(msg string) {
+	if l.p.DebugLog != nil {
+		l.p.DebugLog(msg)
+	}
+}
+
+func (l callbackLogger) Info(msg string) {
+	if l.p.InfoLog != nil {
+		l.p.InfoLog(msg)
+	}
+}
+
+func (l callbackLogger) Warn(msg string) {
+	l.Info(msg)
+}
+
+func (l callbackLogger) Error(msg string) {
+	if l.p.ErrorLog != nil {
+		l.p.ErrorLog(errors.New(msg))
+	}
+}
+
+func (p *Proxy) logDebug(msg string) {
+	if p.logEnabled(LogLevelDebug) {
+		p.logger().Debug(msg)
+	}
+}
+
+func (p *Proxy) logInfo(msg string) {
+	if p.logEnabled(LogLevelInfo) {
+		p.logger().Info(msg)
+	}
+}
+
+func (p *Proxy) logWarn(msg string) {
+	if p.logEnabled(LogLevelWarn) {
+		p.logger().Warn(msg)
+	}
+}
+
+// logErr logs err. ErrorLog gets err itself so it can be inspected, like a
+// QueryError.
+func (p *Proxy) logErr(err error) {
+	if err == nil || !p.logEnabled(LogLevelError) {
+		return
+	}
+	if p.Logger == nil {
+		if p.ErrorLog != nil {
+			p.ErrorLog(err)
+		}
+		return
+	}
+	p.Logger.Error(err.Error())
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// LogNameMode defines how the query names are written to the query logs.
+type LogNameMode int
+
+const (
+	// LogNameFull logs the full query names.
+	LogNameFull LogNameMode = iota
+
+	// LogNameDomain logs the registrable domain of the names only, like
+	// example.co.uk for www.example.co.uk, so the sites visited are known
+	// but not the hosts of each. The public suffixes, private ones like
+	// github.io included, are those of the Public Suffix List.
+	LogNameDomain
+
+	// LogNameHashed logs a salted hash of the names, keyed with
+	// QueryLogSalt, so identical names can be correlated without being
+	// readable.
+	LogNameHashed
+)
+
+// logName returns qname, in the ParseQuestion form, as written to the query
+// logs according to QueryLogNames. Each of the comma separated names of a
+// query with several questions is handled.
+func (p *Proxy) logName(qname string) string {
+	if p.QueryLogNames != LogNameFull && strings.Contains(qname, ",") {
+		names := strings.Split(qname, ",")
+		for i, n := range names {
+			names[i] = p.logName(n)
+		}
+		return strings.Join(names, ",")
+	}
+	switch p.QueryLogNames {
+	case LogNameDomain:
+		return registrableDomain(qname)
+	case LogNameHashed:
+		mac := hmac.New(sha256.New, []byte(p.QueryLogSalt))
+		mac.Write([]byte(qname))
+		return hex.EncodeToString(mac.Sum(nil)[:16])
+	}
+	return qname
+}
+
+// registrableDomain returns the public suffix of name plus one label, or name
+// if it is a public suffix itself.
+func registrableDomain(name string) string {
+	domain, err := publicsuffix.EffectiveTLDPlusOne(strings.TrimSuffix(name, "."))
+	if err != nil {
+		return name
+	}
+	return domain + "."
+}
@@ -0,0 +1,26 @@
+package proxy
+
+import "testing"
+
+func TestRegistrableDomain(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"www.example.com.", "example.com."},
+		{"example.com.", "example.com."},
+		{"www.example.co.uk.", "example.co.uk."},
+		{"user.github.io.", "user.github.io."},
+		{"a.user.github.io.", "user.github.io."},
+		{"a.b.kawasaki.jp.", "a.b.kawasaki.jp."},
+		{"a.city.kawasaki.jp.", "city.kawasaki.jp."},
+		{"com.", "com."},
+		{"co.uk.", "co.uk."},
+		{".", "."},
+	}
+	for _, tt := range tests {
+		if got := registrableDomain(tt.name); got != tt.want {
+			t.Errorf("registrableDomain(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
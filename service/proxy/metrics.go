@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// startMetrics starts the HTTP server exposing the proxy counters on
+// MetricsAddr.
+func (p *Proxy) startMetrics() error {
+	ln, err := net.Listen("tcp", p.MetricsAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", p.serveMetrics)
+	p.metrics = &http.Server{
+		Handler:     mux,
+		ReadTimeout: 10 * time.Second,
+	}
+	go func(srv *http.Server) {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			p.logErr(fmt.Errorf("metrics: %v", err))
+		}
+	}(p.metrics)
+	return nil
+}
+
+func (p *Proxy) stopMetrics() {
+	if p.metrics != nil {
+		p.metrics.Close()
+		p.metrics = nil
+	}
+}
+
+// serveMetrics writes the proxy counters in the Prometheus text format.
+func (p *Proxy) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	st := p.Stats()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	counter := func(name, help string, v uint64) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	gauge := func(name, help string, v float64) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, v)
+	}
+	counter("nextdns_queries_total", "Queries received from clients.", st.Queries)
+	counter("nextdns_cache_hits_total", "Queries answered from the cache.", st.CacheHits)
+	counter("nextdns_upstream_errors_total", "Queries that failed to get a response from the upstream.", st.UpstreamErrors)
+	counter("nextdns_timeouts_total", "Queries that timed out.", st.Timeouts)
+	counter("nextdns_dedup_drops_total", "Queries dropped as duplicates.", st.DedupDrops)
+	counter("nextdns_limit_drops_total", "Queries dropped because too many were in flight.", st.LimitDrops)
+	counter("nextdns_rate_limited_total", "Queries not sent upstream because their name was rate limited.", st.RateLimited)
+	counter("nextdns_blocklisted_total", "Queries answered locally because their name is in the blocklist.", st.Blocklisted)
+	counter("nextdns_tun_write_drops_total", "Packets dropped because the tun interface write was blocked.", st.TunWriteDrops)
+	counter("nextdns_received_bytes_total", "DNS bytes received from clients.", st.BytesIn)
+	counter("nextdns_sent_bytes_total", "DNS bytes sent to clients.", st.BytesOut)
+	var ratio float64
+	if st.Queries > 0 {
+		ratio = float64(st.CacheHits) / float64(st.Queries)
+	}
+	gauge("nextdns_cache_hit_ratio", "Ratio of the queries answered from the cache.", ratio)
+	gauge("nextdns_goroutines", "Number of goroutines.", float64(runtime.NumGoroutine()))
+	gauge("nextdns_packet_buffers", "Packet buffers in use.", float64(st.PacketBuffers))
+
+	const h = "nextdns_upstream_latency_seconds"
+	fmt.Fprintf(bw, "# HELP %s Upstream response time.\n# TYPE %s histogram\n", h, h)
+	for i, b := range latencyBounds {
+		fmt.Fprintf(bw, "%s_bucket{le=\"%g\"} %d\n", h, b.Seconds(), st.UpstreamLatencyBuckets[i])
+	}
+	fmt.Fprintf(bw, "%s_bucket{le=\"+Inf\"} %d\n", h, st.UpstreamLatencyCount)
+	fmt.Fprintf(bw, "%s_sum %g\n", h, st.UpstreamLatencySum.Seconds())
+	fmt.Fprintf(bw, "%s_count %d\n", h, st.UpstreamLatencyCount)
+
+	sizes := func(name, help string, sh SizeHistogram) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+		for i, b := range sizeBounds {
+			fmt.Fprintf(bw, "%s_bucket{le=\"%d\"} %d\n", name, b, sh.Buckets[i])
+		}
+		fmt.Fprintf(bw, "%s_bucket{le=\"+Inf\"} %d\n", name, sh.Count)
+		fmt.Fprintf(bw, "%s_sum %d\n", name, sh.Sum)
+		fmt.Fprintf(bw, "%s_count %d\n", name, sh.Count)
+	}
+	sizes("nextdns_query_size_bytes", "Size of the DNS queries received from clients.", st.QuerySizes)
+	sizes("nextdns_response_size_bytes", "Size of the DNS responses sent to clients.", st.ResponseSizes)
+}
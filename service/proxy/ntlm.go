@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// NTLM (MS-NLMP) messages of the client side of the authentication to HTTP
+// proxies. Only NTLMv2 responses are sent, without signing or sealing as the
+// connection is only authenticated.
+
+const (
+	ntlmNegotiateUnicode                 = 0x00000001
+	ntlmRequestTarget                    = 0x00000004
+	ntlmNegotiateNTLM                    = 0x00000200
+	ntlmNegotiateAlwaysSign              = 0x00008000
+	ntlmNegotiateExtendedSessionSecurity = 0x00080000
+	ntlmNegotiateTargetInfo              = 0x00800000
+	ntlmNegotiate128                     = 0x20000000
+	ntlmNegotiate56                      = 0x80000000
+
+	// ntlmFlags are the flags of the negotiate message.
+	ntlmFlags = ntlmNegotiateUnicode | ntlmRequestTarget | ntlmNegotiateNTLM |
+		ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSessionSecurity |
+		ntlmNegotiateTargetInfo | ntlmNegotiate128 | ntlmNegotiate56
+
+	// ntlmAvTimestamp is the ID of the AV pair of the target info holding
+	// the server time.
+	ntlmAvTimestamp = 7
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// ntlmNegotiateMessage returns the NEGOTIATE_MESSAGE starting the
+// authentication, without domain nor workstation.
+func ntlmNegotiateMessage() []byte {
+	b := make([]byte, 32)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 1)
+	binary.LittleEndian.PutUint32(b[12:], ntlmFlags)
+	return b
+}
+
+// ntlmChallenge is the content of a CHALLENGE_MESSAGE used to answer it.
+type ntlmChallenge struct {
+	flags           uint32
+	serverChallenge [8]byte
+	targetInfo      []byte
+}
+
+// parseNTLMChallenge parses the CHALLENGE_MESSAGE b.
+func parseNTLMChallenge(b []byte) (c ntlmChallenge, err error) {
+	if len(b) < 48 || !bytes.Equal(b[:8], ntlmSignature) || binary.LittleEndian.Uint32(b[8:]) != 2 {
+		return c, errors.New("invalid NTLM challenge")
+	}
+	c.flags = binary.LittleEndian.Uint32(b[20:])
+	copy(c.serverChallenge[:], b[24:32])
+	l := int(binary.LittleEndian.Uint16(b[40:]))
+	off := int(binary.LittleEndian.Uint32(b[44:]))
+	if off > len(b) || l > len(b)-off {
+		return c, errors.New("invalid NTLM challenge target info")
+	}
+	c.targetInfo = b[off : off+l]
+	return c, nil
+}
+
+// timestamp returns the server time of the target info of c, if any, in
+// FILETIME units.
+func (c ntlmChallenge) timestamp() (uint64, bool) {
+	for b := c.targetInfo; len(b) >= 4; {
+		id := binary.LittleEndian.Uint16(b)
+		l := int(binary.LittleEndian.Uint16(b[2:]))
+		if len(b) < 4+l {
+			break
+		}
+		if id == ntlmAvTimestamp && l == 8 {
+			return binary.LittleEndian.Uint64(b[4:]), true
+		}
+		b = b[4+l:]
+	}
+	return 0, false
+}
+
+// ntlmAuthenticateMessage returns the AUTHENTICATE_MESSAGE answering the
+// challenge c for the user of domain.
+func ntlmAuthenticateMessage(c ntlmChallenge, domain, user, password string) ([]byte, error) {
+	if c.flags&ntlmNegotiateUnicode == 0 {
+		return nil, errors.New("NTLM without Unicode support")
+	}
+	var clientChallenge [8]byte
+	if _, err := rand.Read(clientChallenge[:]); err != nil {
+		return nil, err
+	}
+	key := ntowfv2(domain, user, password)
+	// Without the server time, a LMv2 response is sent with the NTLMv2 one,
+	// otherwise the LM response must be empty (MS-NLMP 3.1.5.12).
+	lm := make([]byte, 24)
+	ts, ok := c.timestamp()
+	if !ok {
+		ts = ntlmFiletime(time.Now())
+		mac := hmac.New(md5.New, key)
+		mac.Write(c.serverChallenge[:])
+		mac.Write(clientChallenge[:])
+		lm = append(mac.Sum(nil), clientChallenge[:]...)
+	}
+	nt := ntlmv2Response(key, c.serverChallenge, clientChallenge, ts, c.targetInfo)
+
+	const headerLen = 64
+	b := make([]byte, headerLen)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 3)
+	// Each field is described by its length, twice, and its offset.
+	fields := [][]byte{
+		lm,
+		nt,
+		utf16le(domain),
+		utf16le(user),
+		nil, // workstation
+		nil, // encrypted random session key
+	}
+	for i, data := range fields {
+		pos := 12 + 8*i
+		binary.LittleEndian.PutUint16(b[pos:], uint16(len(data)))
+		binary.LittleEndian.PutUint16(b[pos+2:], uint16(len(data)))
+		binary.LittleEndian.PutUint32(b[pos+4:], uint32(len(b)))
+		b = append(b, data...)
+	}
+	binary.LittleEndian.PutUint32(b[60:], c.flags&ntlmFlags)
+	return b, nil
+}
+
+// ntowfv2 returns the NTLMv2 key of the user of domain.
+func ntowfv2(domain, user, password string) []byte {
+	h := md4.New()
+	h.Write(utf16le(password))
+	mac := hmac.New(md5.New, h.Sum(nil))
+	mac.Write(utf16le(strings.ToUpper(user) + domain))
+	return mac.Sum(nil)
+}
+
+// ntlmv2Response returns the NTLMv2 response, NTProofStr followed by the
+// client blob, to serverChallenge for key.
+func ntlmv2Response(key []byte, serverChallenge, clientChallenge [8]byte, timestamp uint64, targetInfo []byte) []byte {
+	blob := make([]byte, 28, 28+len(targetInfo)+4)
+	blob[0], blob[1] = 1, 1 // versions
+	binary.LittleEndian.PutUint64(blob[8:], timestamp)
+	copy(blob[16:], clientChallenge[:])
+	blob = append(blob, targetInfo...)
+	blob = append(blob, 0, 0, 0, 0)
+	mac := hmac.New(md5.New, key)
+	mac.Write(serverChallenge[:])
+	mac.Write(blob)
+	return append(mac.Sum(nil), blob...)
+}
+
+// ntlmFiletime returns t as a Windows FILETIME, in 100ns since 1601.
+func ntlmFiletime(t time.Time) uint64 {
+	return uint64(t.UnixNano()/100) + 116444736000000000
+}
+
+func utf16le(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
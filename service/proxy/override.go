@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/nextdns/windows/dnsmsg"
+)
+
+// DefaultOverrideTTL defines the default value for Proxy OverrideTTL.
+const DefaultOverrideTTL = time.Minute
+
+// normalizeOverrides returns overrides with names lower-cased and fully
+// qualified, as returned by parseQuestion.
+func normalizeOverrides(overrides map[string][]net.IP) map[string][]net.IP {
+	if len(overrides) == 0 {
+		return nil
+	}
+	m := make(map[string][]net.IP, len(overrides))
+	for name, ips := range overrides {
+		name = strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+		m[name] = append(m[name], ips...)
+	}
+	return m
+}
+
+// override returns the locally synthesized response to q if it is an A or
+// AAAA query for a name found in Overrides. Names overridden without an
+// address of the queried type get an empty answer.
+func (p *Proxy) override(q []byte) ([]byte, bool) {
+	overrides := p.overrides
+	if len(overrides) == 0 {
+		return nil, false
+	}
+	name, qtype, qclass, _, ok := dnsmsg.ParseQuestion(q)
+	if !ok || qclass != dnsmsg.ClassIN || (qtype != dnsmsg.TypeA && qtype != dnsmsg.TypeAAAA) {
+		return nil, false
+	}
+	ips, found := overrides[name]
+	if !found {
+		return nil, false
+	}
+	ttl := p.OverrideTTL
+	if ttl <= 0 {
+		ttl = DefaultOverrideTTL
+	}
+	msg := reply(q, dnsmsg.RCodeNoError)
+	dnsmsg.SetAuthoritative(msg)
+	var count uint16
+	for _, ip := range ips {
+		rdata := ip.To4()
+		if qtype == dnsmsg.TypeAAAA {
+			if rdata != nil {
+				continue
+			}
+			rdata = ip.To16()
+		}
+		if rdata == nil {
+			continue
+		}
+		msg = appendRR(msg, dnsmsg.HeaderLen, qtype, uint32(ttl/time.Second), rdata)
+		count++
+	}
+	binary.BigEndian.PutUint16(msg[6:], count)
+	return msg, true
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	udpHeaderLen  = 8
+
+	protoTCP = 6
+	protoUDP = 17
+
+	// dnsOffset is the offset of the DNS message in a UDP packet received on
+	// the tun interface.
+	dnsOffset = ipv4HeaderLen + udpHeaderLen
+
+	// dnsOffset6 is the offset of the DNS message in a UDP packet received
+	// over IPv6 without extension headers.
+	dnsOffset6 = ipv6HeaderLen + udpHeaderLen
+
+	// packetPreviewLen is the number of bytes of the dropped packets logged
+	// as debug messages, enough for the IP and UDP headers and the DNS header.
+	packetPreviewLen = 60
+)
+
+// writeIPv4Header writes an IPv4 header without options at the beginning of b
+// for a packet of totalLen bytes.
+func writeIPv4Header(b []byte, src, dst []byte, proto uint8, totalLen int) {
+	ip := b[:ipv4HeaderLen]
+	ip[0] = 0x45 // version 4, no options
+	ip[1] = 0
+	binary.BigEndian.PutUint16(ip[2:], uint16(totalLen))
+	binary.BigEndian.PutUint16(ip[4:], 0) // id
+	binary.BigEndian.PutUint16(ip[6:], 0) // no fragmentation
+	ip[8] = 64                            // TTL
+	ip[9] = proto
+	binary.BigEndian.PutUint16(ip[10:], 0) // checksum
+	copy(ip[12:16], src)
+	copy(ip[16:20], dst)
+	binary.BigEndian.PutUint16(ip[10:], checksum(0, ip))
+}
+
+// writeIPv6Header writes an IPv6 header at the beginning of b for a packet
+// carrying payloadLen bytes.
+func writeIPv6Header(b []byte, src, dst []byte, proto uint8, payloadLen int) {
+	ip := b[:ipv6HeaderLen]
+	ip[0] = 0x60 // version 6
+	ip[1], ip[2], ip[3] = 0, 0, 0
+	binary.BigEndian.PutUint16(ip[4:], uint16(payloadLen))
+	ip[6] = proto
+	ip[7] = 64 // hop limit
+	copy(ip[8:24], src)
+	copy(ip[24:40], dst)
+}
+
+// udpPacketLen returns the length of the IPv4 or IPv6 UDP packet in buf whose
+// payload starts at buf[off:] according to its IP and UDP length fields,
+// trailing bytes like padding excluded. It returns false if the fields claim
+// more bytes than buf holds, like after a partial read, or no payload.
+func udpPacketLen(buf []byte, off int) (int, bool) {
+	var ipLen int
+	if buf[0]>>4 == 4 {
+		ipLen = int(binary.BigEndian.Uint16(buf[2:4]))
+	} else {
+		ipLen = ipv6HeaderLen + int(binary.BigEndian.Uint16(buf[4:6]))
+	}
+	udpLen := int(binary.BigEndian.Uint16(buf[off-udpHeaderLen+4:]))
+	n := off - udpHeaderLen + udpLen
+	if ipLen > len(buf) || n > ipLen || n <= off {
+		return 0, false
+	}
+	return n, true
+}
+
+// udpSource returns the source address and port of the IPv4 or IPv6 UDP
+// packet in buf whose payload starts at buf[off:].
+func udpSource(buf []byte, off int) (net.IP, uint16) {
+	src := net.IP(buf[12:16])
+	if buf[0]>>4 == 6 {
+		src = net.IP(buf[8:24])
+	}
+	return src, binary.BigEndian.Uint16(buf[off-udpHeaderLen:])
+}
+
+// udpResponse turns the IPv4 or IPv6 UDP query packet in buf into its response
+// by swapping addresses and ports and updating lengths and checksums. The n
+// bytes of DNS response must already be written at buf[off:], right after the
+// UDP header. IPv4 options are not copied to the response.
+func udpResponse(buf []byte, off, n int) []byte {
+	var pkt, src, dst []byte
+	if buf[0]>>4 == 6 {
+		pkt = buf[:dnsOffset6+n]
+		var s, d [16]byte
+		copy(s[:], pkt[24:40])
+		copy(d[:], pkt[8:24])
+		src, dst = s[:], d[:]
+		writeIPv6Header(pkt, src, dst, protoUDP, udpHeaderLen+n)
+	} else {
+		if off != dnsOffset {
+			// Drop IP options, moving the UDP header and payload.
+			copy(buf[ipv4HeaderLen:], buf[off-udpHeaderLen:off+n])
+		}
+		pkt = buf[:dnsOffset+n]
+		var s, d [4]byte
+		copy(s[:], pkt[16:20])
+		copy(d[:], pkt[12:16])
+		src, dst = s[:], d[:]
+		writeIPv4Header(pkt, src, dst, protoUDP, len(pkt))
+	}
+
+	udp := pkt[len(pkt)-n-udpHeaderLen:]
+	sport := binary.BigEndian.Uint16(udp[0:])
+	copy(udp[0:2], udp[2:4])
+	binary.BigEndian.PutUint16(udp[2:], sport)
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	binary.BigEndian.PutUint16(udp[6:], 0)
+	sum := pseudoHeaderSum(src, dst, protoUDP, len(udp))
+	if cs := checksum(sum, udp); cs != 0 {
+		binary.BigEndian.PutUint16(udp[6:], cs)
+	} else {
+		binary.BigEndian.PutUint16(udp[6:], 0xffff)
+	}
+	return pkt
+}
+
+func pseudoHeaderSum(src, dst []byte, proto uint8, length int) uint32 {
+	var sum uint32
+	for i := 0; i < len(src); i += 2 {
+		sum += uint32(src[i])<<8 | uint32(src[i+1])
+		sum += uint32(dst[i])<<8 | uint32(dst[i+1])
+	}
+	sum += uint32(proto)
+	sum += uint32(length)
+	return sum
+}
+
+// checksum computes the internet checksum of b, starting with sum.
+func checksum(sum uint32, b []byte) uint16 {
+	for len(b) >= 2 {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nextdns/windows/dnsmsg"
+)
+
+// passthrough sends the queries to the system DNS servers when Passthrough is
+// set, logging the upstream the query q would have been sent to otherwise.
+func (p *Proxy) passthrough(q []byte) (upstream, error) {
+	u, ok := p.systemUpstream()
+	if !ok {
+		return upstream{}, errors.New("passthrough: no system DNS server")
+	}
+	name, qtype, _, _, _ := dnsmsg.ParseQuestion(q)
+	routes, ups := p.currentUpstreams()
+	would := "none"
+	if r, ok := route(routes, q); ok {
+		would = r.name
+	} else if len(ups) > 0 {
+		would = ups[p.selector.get()%len(ups)].name
+	}
+	p.logInfo(fmt.Sprintf("Passthrough query %x %s %s: forwarded to the system DNS instead of %s",
+		dnsmsg.ID(q), name, typeString(qtype), would))
+	return u, nil
+}
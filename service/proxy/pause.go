@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// Pause stops the protection without stopping the proxy: the tun interface
+// and the driver are left untouched, queries being forwarded to the system DNS
+// servers, without caching, and dnsunleak stopped until Resume is called.
+// Toggling the protection this way avoids the driver stop path. If the proxy
+// is not started, it starts paused.
+func (p *Proxy) Pause() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Paused() {
+		return nil
+	}
+	if p.stateLocked() == StateStarted {
+		if _, ok := p.systemUpstream(); !ok {
+			p.captureSystemDNS()
+			p.setupUpstreams()
+			if _, ok := p.systemUpstream(); !ok {
+				return errors.New("pause: no system DNS server")
+			}
+		}
+	}
+	if changed, _ := p.setPaused(true); changed {
+		p.logInfo("Paused, forwarding queries to the system DNS servers")
+	}
+	return nil
+}
+
+// Resume resumes the protection stopped by Pause.
+func (p *Proxy) Resume() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	changed, err := p.setPaused(false)
+	if changed {
+		p.logInfo("Resumed, forwarding queries to NextDNS")
+	}
+	return err
+}
+
+// Paused reports if the proxy is paused.
+func (p *Proxy) Paused() bool {
+	return atomic.LoadInt32(&p.paused) == 1
+}
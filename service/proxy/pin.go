@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+)
+
+// ErrPinMismatch is returned when no certificate of the upstream matches
+// PinnedSPKI.
+var ErrPinMismatch = errors.New("certificate pinning: no certificate matches the pinned public keys")
+
+// verifyPins checks that one of the certificates of the chain presented in cs
+// has the SHA-256 hash of its public key in PinnedSPKI.
+func (p *Proxy) verifyPins(cs tls.ConnectionState) error {
+	for _, cert := range cs.PeerCertificates {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range p.PinnedSPKI {
+			if bytes.Equal(sum[:], pin) {
+				return nil
+			}
+		}
+	}
+	if len(cs.PeerCertificates) > 0 {
+		return fmt.Errorf("%w (%s)", ErrPinMismatch, cs.PeerCertificates[0].Subject)
+	}
+	return ErrPinMismatch
+}
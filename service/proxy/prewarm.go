@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nextdns/windows/dnsmsg"
+)
+
+// prewarm sends a query to the upstreams so the connection is established
+// before the first client query.
+func (p *Proxy) prewarm(ctx context.Context) {
+	timeout := p.QueryTimeout
+	if timeout <= 0 {
+		timeout = DefaultQueryTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	if _, err := p.exchange(ctx, newQuery(0, healthCheckName, dnsmsg.TypeA)); err != nil {
+		if ctx.Err() != context.Canceled {
+			p.logErr(fmt.Errorf("prewarm: %v", err))
+		}
+		return
+	}
+	p.logInfo(fmt.Sprintf("Upstream connection prewarmed in %dms", time.Since(start)/time.Millisecond))
+}
@@ -0,0 +1,22 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/nextdns/windows/procinfo"
+)
+
+// processName returns the name of the process owning the socket the query was
+// sent from, ip:port over TCP or UDP, or an empty string if it cannot be found,
+// like when the socket was already closed.
+func processName(tcp bool, ip net.IP, port uint16) string {
+	owner := procinfo.UDPOwner
+	if tcp {
+		owner = procinfo.TCPOwner
+	}
+	name, err := owner(ip, port)
+	if err != nil {
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,476 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nextdns/windows/dnsmsg"
+)
+
+// testTun is an in-memory tun device: the packets sent to in are read by the
+// proxy, and the ones it writes are sent to out.
+type testTun struct {
+	in     chan []byte
+	out    chan []byte
+	closed chan struct{}
+	once   sync.Once
+}
+
+// testTunQueueLen is the number of packets buffered by testTun in each
+// direction, like the queue of a tun device.
+const testTunQueueLen = 64
+
+func newTestTun() *testTun {
+	return &testTun{
+		in:     make(chan []byte, testTunQueueLen),
+		out:    make(chan []byte, testTunQueueLen),
+		closed: make(chan struct{}),
+	}
+}
+
+func (t *testTun) Read(b []byte) (int, error) {
+	select {
+	case pkt := <-t.in:
+		return copy(b, pkt), nil
+	case <-t.closed:
+		return 0, io.EOF
+	}
+}
+
+func (t *testTun) Write(b []byte) (int, error) {
+	pkt := append([]byte(nil), b...)
+	select {
+	case t.out <- pkt:
+		return len(b), nil
+	case <-t.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (t *testTun) Close() error {
+	t.once.Do(func() { close(t.closed) })
+	return nil
+}
+
+// startTestUpstream starts a plain DNS server on the loopback answering the
+// queries with handler, called concurrently, and returns its address.
+func startTestUpstream(tb testing.TB, handler func(q []byte) []byte) string {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { c.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q := append([]byte(nil), buf[:n]...)
+			go func() {
+				if msg := handler(q); msg != nil {
+					_, _ = c.WriteTo(msg, addr)
+				}
+			}()
+		}
+	}()
+	return c.LocalAddr().String()
+}
+
+// startTestProxy starts p on an in-memory tun, using a plain DNS upstream
+// answering with handler, and returns the tun. p is stopped at the end of the
+// test.
+func startTestProxy(tb testing.TB, p *Proxy, handler func(q []byte) []byte) *testTun {
+	tun := newTestTun()
+	p.PlainUpstream = startTestUpstream(tb, handler)
+	p.OpenTun = func() (io.ReadWriteCloser, error) {
+		return tun, nil
+	}
+	if err := p.Start(); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { p.Stop() })
+	return tun
+}
+
+var (
+	testClientIP = net.ParseIP(DefaultTunAddr).To4()
+	testDNSIP    = net.ParseIP(DefaultTunPeer).To4()
+)
+
+// udpQuery returns an IPv4 UDP packet carrying the DNS query q from sport to
+// the DNS address of the proxy.
+func udpQuery(q []byte, sport uint16) []byte {
+	pkt := make([]byte, dnsOffset+len(q))
+	writeIPv4Header(pkt, testClientIP, testDNSIP, protoUDP, len(pkt))
+	udp := pkt[ipv4HeaderLen:]
+	binary.BigEndian.PutUint16(udp[0:], sport)
+	binary.BigEndian.PutUint16(udp[2:], 53)
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[udpHeaderLen:], q)
+	sum := pseudoHeaderSum(testClientIP, testDNSIP, protoUDP, len(udp))
+	binary.BigEndian.PutUint16(udp[6:], checksum(sum, udp))
+	return pkt
+}
+
+// readResponse returns the next packet written by the proxy to tun.
+func readResponse(tb testing.TB, tun *testTun) []byte {
+	tb.Helper()
+	select {
+	case pkt := <-tun.out:
+		return pkt
+	case <-time.After(5 * time.Second):
+		tb.Fatal("no response")
+		return nil
+	}
+}
+
+// checkUDPResponse checks pkt is a valid IPv4 UDP packet from the DNS
+// address of the proxy to sport, and returns its DNS message.
+func checkUDPResponse(tb testing.TB, pkt []byte, sport uint16) []byte {
+	tb.Helper()
+	if len(pkt) < dnsOffset+dnsmsg.HeaderLen || pkt[0] != 0x45 || pkt[9] != protoUDP {
+		tb.Fatalf("invalid response packet % x", pkt)
+	}
+	if n := int(binary.BigEndian.Uint16(pkt[2:])); n != len(pkt) {
+		tb.Errorf("IP length %d, packet of %d bytes", n, len(pkt))
+	}
+	if checksum(0, pkt[:ipv4HeaderLen]) != 0 {
+		tb.Error("invalid IP checksum")
+	}
+	if src, dst := net.IP(pkt[12:16]), net.IP(pkt[16:20]); !src.Equal(testDNSIP) || !dst.Equal(testClientIP) {
+		tb.Errorf("response from %v to %v", src, dst)
+	}
+	udp := pkt[ipv4HeaderLen:]
+	if sp, dp := binary.BigEndian.Uint16(udp), binary.BigEndian.Uint16(udp[2:]); sp != 53 || dp != sport {
+		tb.Errorf("response from port %d to %d", sp, dp)
+	}
+	if n := int(binary.BigEndian.Uint16(udp[4:])); n != len(udp) {
+		tb.Errorf("UDP length %d, payload of %d bytes", n, len(udp))
+	}
+	if checksum(pseudoHeaderSum(testDNSIP, testClientIP, protoUDP, len(udp)), udp) != 0 {
+		tb.Error("invalid UDP checksum")
+	}
+	return udp[udpHeaderLen:]
+}
+
+func TestProxyUDP(t *testing.T) {
+	answer := net.IPv4(192, 0, 2, 1)
+	tun := startTestProxy(t, &Proxy{}, func(q []byte) []byte {
+		return answerA(q, answer, false)
+	})
+	for i := 0; i < 3; i++ {
+		sport := uint16(40000 + i)
+		id := uint16(0x1000 + i)
+		tun.in <- udpQuery(newQuery(id, "example.com.", dnsmsg.TypeA), sport)
+		msg := checkUDPResponse(t, readResponse(t, tun), sport)
+		if dnsmsg.ID(msg) != id {
+			t.Errorf("response ID %#x, want %#x", dnsmsg.ID(msg), id)
+		}
+		if dnsmsg.RCode(msg) != dnsmsg.RCodeNoError || dnsmsg.Count(msg, dnsmsg.SectionAnswer) != 1 {
+			t.Fatalf("unexpected response % x", msg)
+		}
+		if !bytes.HasSuffix(msg, answer.To4()) {
+			t.Errorf("response % x does not hold %v", msg, answer)
+		}
+	}
+}
+
+func TestProxyUDPServFail(t *testing.T) {
+	tun := startTestProxy(t, &Proxy{}, func(q []byte) []byte {
+		return reply(q, dnsmsg.RCodeServFail)
+	})
+	tun.in <- udpQuery(newQuery(1, "example.com.", dnsmsg.TypeA), 40000)
+	msg := checkUDPResponse(t, readResponse(t, tun), 40000)
+	if dnsmsg.ID(msg) != 1 || dnsmsg.RCode(msg) != dnsmsg.RCodeServFail {
+		t.Errorf("unexpected response % x", msg)
+	}
+}
+
+// answerManyA returns a response to q with n A records.
+func answerManyA(q []byte, n int) []byte {
+	_, _, _, off, ok := dnsmsg.ParseQuestion(q)
+	if !ok {
+		panic("invalid query")
+	}
+	msg := append([]byte(nil), q[:off]...)
+	msg[2] |= 0x80 // QR
+	msg[3] |= 0x80 // RA
+	binary.BigEndian.PutUint16(msg[6:], uint16(n))
+	binary.BigEndian.PutUint16(msg[10:], 0)
+	for i := 0; i < n; i++ {
+		msg = append(msg, 0xc0, dnsmsg.HeaderLen, 0, dnsmsg.TypeA, 0, dnsmsg.ClassIN, 0, 0, 1, 0x2c, 0, 4)
+		msg = append(msg, 192, 0, 2, byte(i))
+	}
+	return msg
+}
+
+func TestProxyUDPTruncate(t *testing.T) {
+	tun := startTestProxy(t, &Proxy{}, func(q []byte) []byte {
+		return answerManyA(q, 50)
+	})
+	q := newQuery(1, "example.com.", dnsmsg.TypeA)
+
+	// Without EDNS, the response is truncated to 512 bytes over IPv4 so the
+	// client retries over TCP.
+	tun.in <- udpQuery(q, 40000)
+	msg := checkUDPResponse(t, readResponse(t, tun), 40000)
+	if !dnsmsg.Truncated(msg) || len(msg) > 512 {
+		t.Errorf("IPv4 response of %d bytes, truncated %v, want truncated", len(msg), dnsmsg.Truncated(msg))
+	}
+
+	// DNS over TCP is not supported over IPv6, the response is sent whole.
+	src := net.ParseIP("fd42:dead:beef::43")
+	dst := net.ParseIP("fd42:dead:beef::42")
+	pkt := make([]byte, dnsOffset6+len(q))
+	writeIPv6Header(pkt, src, dst, protoUDP, udpHeaderLen+len(q))
+	udp := pkt[ipv6HeaderLen:]
+	binary.BigEndian.PutUint16(udp[0:], 40001)
+	binary.BigEndian.PutUint16(udp[2:], 53)
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[udpHeaderLen:], q)
+	binary.BigEndian.PutUint16(udp[6:], checksum(pseudoHeaderSum(src, dst, protoUDP, len(udp)), udp))
+	tun.in <- pkt
+	res := readResponse(t, tun)
+	if len(res) < dnsOffset6 || res[0]>>4 != 6 {
+		t.Fatalf("invalid response packet % x", res)
+	}
+	msg = res[dnsOffset6:]
+	if dnsmsg.Truncated(msg) || dnsmsg.Count(msg, dnsmsg.SectionAnswer) != 50 {
+		t.Errorf("IPv6 response of %d bytes with %d answers, truncated %v, want all 50",
+			len(msg), dnsmsg.Count(msg, dnsmsg.SectionAnswer), dnsmsg.Truncated(msg))
+	}
+}
+
+func TestProxyNotForUs(t *testing.T) {
+	tun := startTestProxy(t, &Proxy{}, func(q []byte) []byte {
+		return answerA(q, net.IPv4(192, 0, 2, 1), false)
+	})
+	pkt := udpQuery(newQuery(1, "example.com.", dnsmsg.TypeA), 40000)
+	writeIPv4Header(pkt, testClientIP, net.IPv4(192, 0, 2, 99).To4(), protoUDP, len(pkt))
+	tun.in <- pkt
+	// Only the query sent to the proxy is answered.
+	tun.in <- udpQuery(newQuery(2, "example.com.", dnsmsg.TypeA), 40001)
+	msg := checkUDPResponse(t, readResponse(t, tun), 40001)
+	if dnsmsg.ID(msg) != 2 {
+		t.Errorf("response to %#x, want 0x2", dnsmsg.ID(msg))
+	}
+	select {
+	case pkt := <-tun.out:
+		t.Errorf("unexpected packet % x", pkt)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestProxyBuffersReturned(t *testing.T) {
+	// The upstream never answers and a single query is resolved at a time so
+	// the queries pile up in the queues when the proxy stops. The responses
+	// are not read from the tun for one round out of two so the writer
+	// stalls too.
+	p := &Proxy{
+		MaxConcurrentQueries: 1,
+		QueryTimeout:         20 * time.Millisecond,
+		DrainTimeout:         50 * time.Millisecond,
+		TunWriteTimeout:      10 * time.Millisecond,
+		PlainUpstream: startTestUpstream(t, func(q []byte) []byte {
+			return nil
+		}),
+	}
+	for round := 0; round < 10; round++ {
+		tun := newTestTun()
+		p.OpenTun = func() (io.ReadWriteCloser, error) {
+			return tun, nil
+		}
+		if err := p.Start(); err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan struct{})
+		if round%2 == 1 {
+			go func() {
+				for {
+					select {
+					case <-tun.out:
+					case <-done:
+						return
+					}
+				}
+			}()
+		}
+		for i := 0; i < 2*packetQueueLen; i++ {
+			tun.in <- udpQuery(newQuery(uint16(i), "example.com.", dnsmsg.TypeA), uint16(40000+i))
+		}
+		time.Sleep(30 * time.Millisecond)
+		p.Stop()
+		close(done)
+		waitFor(t, "proxy stopped", func() bool {
+			return p.State() == StateStopped
+		})
+	}
+	waitFor(t, "packet buffers returned", func() bool {
+		return p.Stats().PacketBuffers == 0
+	})
+}
+
+// tcpPacket returns an IPv4 TCP segment from sport to the DNS port of the
+// proxy.
+func tcpPacket(sport uint16, seq, ack uint32, flags uint8, payload []byte) []byte {
+	pkt := make([]byte, ipv4HeaderLen+tcpHeaderLen+len(payload))
+	writeIPv4Header(pkt, testClientIP, testDNSIP, protoTCP, len(pkt))
+	tcp := pkt[ipv4HeaderLen:]
+	binary.BigEndian.PutUint16(tcp[0:], sport)
+	binary.BigEndian.PutUint16(tcp[2:], 53)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = tcpHeaderLen / 4 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[tcpHeaderLen:], payload)
+	sum := pseudoHeaderSum(testClientIP, testDNSIP, protoTCP, len(tcp))
+	binary.BigEndian.PutUint16(tcp[16:], checksum(sum, tcp))
+	return pkt
+}
+
+// readSegment returns the next TCP segment written by the proxy to tun.
+func readSegment(tb testing.TB, tun *testTun) tcpSegment {
+	tb.Helper()
+	seg, ok := parseTCPSegment(readResponse(tb, tun))
+	if !ok {
+		tb.Fatal("invalid TCP segment")
+	}
+	return seg
+}
+
+func TestProxyTCP(t *testing.T) {
+	answer := net.IPv4(192, 0, 2, 1)
+	p := &Proxy{}
+	tun := startTestProxy(t, p, func(q []byte) []byte {
+		return answerA(q, answer, false)
+	})
+	tun.in <- tcpPacket(40000, 1000, 0, tcpFlagSYN, nil)
+	synAck := readSegment(t, tun)
+	if synAck.flags != tcpFlagSYN|tcpFlagACK || synAck.ack != 1001 {
+		t.Fatalf("unexpected SYN-ACK %+v", synAck)
+	}
+	seq, ack := uint32(1001), synAck.seq+1
+	q := newQuery(0x1234, "example.com.", dnsmsg.TypeA)
+	data := append([]byte{0, byte(len(q))}, q...)
+	tun.in <- tcpPacket(40000, seq, ack, tcpFlagPSH|tcpFlagACK, data)
+	seq += uint32(len(data))
+	var msg []byte
+	for msg == nil {
+		seg := readSegment(t, tun)
+		if seg.ack != seq {
+			t.Fatalf("segment %+v does not acknowledge %d", seg, seq)
+		}
+		if len(seg.payload) > 0 {
+			msg = seg.payload[2:]
+			ack += uint32(len(seg.payload))
+		}
+	}
+	if dnsmsg.ID(msg) != 0x1234 || !bytes.HasSuffix(msg, answer.To4()) {
+		t.Errorf("unexpected response % x", msg)
+	}
+
+	// The connection left open is reset when the proxy stops.
+	p.Stop()
+	rst := readSegment(t, tun)
+	if rst.flags&tcpFlagRST == 0 || rst.seq != ack || rst.dport != 40000 {
+		t.Errorf("unexpected segment %+v, want a RST", rst)
+	}
+}
+
+func TestProxyTCPZeroMSS(t *testing.T) {
+	tun := startTestProxy(t, &Proxy{}, func(q []byte) []byte {
+		return answerA(q, net.IPv4(192, 0, 2, 1), false)
+	})
+	syn := tcpPacket(40000, 1000, 0, tcpFlagSYN, nil)
+	// Advertise a zero MSS in the options.
+	syn = append(syn, 2, 4, 0, 0)
+	writeIPv4Header(syn, testClientIP, testDNSIP, protoTCP, len(syn))
+	tcp := syn[ipv4HeaderLen:]
+	tcp[12] = (tcpHeaderLen + 4) / 4 << 4
+	binary.BigEndian.PutUint16(tcp[16:], 0)
+	binary.BigEndian.PutUint16(tcp[16:], checksum(pseudoHeaderSum(testClientIP, testDNSIP, protoTCP, len(tcp)), tcp))
+	if seg, ok := parseTCPSegment(syn); !ok || seg.mss != tcpDefaultMSS {
+		t.Fatalf("parseTCPSegment() MSS = %d, %v, want %d", seg.mss, ok, tcpDefaultMSS)
+	}
+	tun.in <- syn
+	synAck := readSegment(t, tun)
+	seq, ack := uint32(1001), synAck.seq+1
+	q := newQuery(0x1234, "example.com.", dnsmsg.TypeA)
+	data := append([]byte{0, byte(len(q))}, q...)
+	tun.in <- tcpPacket(40000, seq, ack, tcpFlagPSH|tcpFlagACK, data)
+	var payload []byte
+	for i := 0; len(payload) < 2 || len(payload) < 2+int(binary.BigEndian.Uint16(payload)); i++ {
+		if i > 10 {
+			t.Fatalf("no complete response after %d segments, got % x", i, payload)
+		}
+		payload = append(payload, readSegment(t, tun).payload...)
+	}
+	if dnsmsg.ID(payload[2:]) != 0x1234 {
+		t.Errorf("unexpected response % x", payload[2:])
+	}
+}
+
+func TestWatchdogUpstreamsDown(t *testing.T) {
+	// The health checks sent to the tun address never come back on the test
+	// tun, the proxy would close it to restart after the first one if they
+	// were counted while the upstreams are down.
+	p := &Proxy{
+		HealthCheckInterval: 10 * time.Millisecond,
+		HealthCheckFailures: 1,
+		QueryTimeout:        20 * time.Millisecond,
+	}
+	atomic.StoreInt32(&p.stats.reconnecting, 1)
+	tun := startTestProxy(t, p, func(q []byte) []byte {
+		return answerA(q, net.IPv4(192, 0, 2, 1), false)
+	})
+	select {
+	case <-tun.closed:
+		t.Fatal("proxy restarted while reconnecting")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// waitFor waits up to 5 seconds for cond to be true.
+func waitFor(tb testing.TB, what string, cond func() bool) {
+	tb.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			tb.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// BenchmarkProxyUDP measures the queries answered per second for bursts of
+// up to 100 queries in flight, like when loading a page with many
+// subresources, with an upstream answering in 5ms.
+func BenchmarkProxyUDP(b *testing.B) {
+	tun := startTestProxy(b, &Proxy{}, func(q []byte) []byte {
+		time.Sleep(5 * time.Millisecond)
+		return answerA(q, net.IPv4(192, 0, 2, 1), false)
+	})
+	const burst = 100
+	slots := make(chan struct{}, burst)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			slots <- struct{}{}
+			tun.in <- udpQuery(newQuery(uint16(i), "example.com.", dnsmsg.TypeA), uint16(1024+i%burst))
+		}
+	}()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		readResponse(b, tun)
+		<-slots
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "queries/s")
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nextdns/windows/dnsmsg"
+)
+
+// parseReverseName returns the address of the in-addr.arpa or ip6.arpa name.
+func parseReverseName(name string) net.IP {
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv4len)
+		for i, l := range labels {
+			n, err := strconv.ParseUint(l, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[net.IPv4len-1-i] = byte(n)
+		}
+		return ip
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(labels) != 2*net.IPv6len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, l := range labels {
+			n, err := strconv.ParseUint(l, 16, 4)
+			if err != nil || len(l) != 1 {
+				return nil
+			}
+			nibble := 2*net.IPv6len - 1 - i
+			ip[nibble/2] |= byte(n) << (4 * uint(1-nibble%2))
+		}
+		return ip
+	}
+	return nil
+}
+
+// localPTR returns the locally synthesized response to q if it is a PTR query
+// for one of the proxy addresses or for an address in LocalPTRNetworks. The
+// proxy addresses resolve to LocalPTRName when set, other names get an
+// NXDOMAIN.
+func (p *Proxy) localPTR(q []byte) ([]byte, bool) {
+	name, qtype, qclass, _, ok := dnsmsg.ParseQuestion(q)
+	if !ok || qclass != dnsmsg.ClassIN || qtype != dnsmsg.TypePTR {
+		return nil, false
+	}
+	ip := parseReverseName(name)
+	if ip == nil {
+		return nil, false
+	}
+	local := false
+	for _, addr := range p.localAddrs {
+		if addr.Equal(ip) {
+			local = true
+			break
+		}
+	}
+	if !local || p.LocalPTRName == "" {
+		if !local && !p.inLocalPTRNetworks(ip) {
+			return nil, false
+		}
+		msg := reply(q, dnsmsg.RCodeNXDomain)
+		dnsmsg.SetAuthoritative(msg)
+		return msg, true
+	}
+	ttl := p.OverrideTTL
+	if ttl <= 0 {
+		ttl = DefaultOverrideTTL
+	}
+	msg := reply(q, dnsmsg.RCodeNoError)
+	dnsmsg.SetAuthoritative(msg)
+	rdata := appendName(nil, strings.ToLower(p.LocalPTRName))
+	msg = appendRR(msg, dnsmsg.HeaderLen, dnsmsg.TypePTR, uint32(ttl/time.Second), rdata)
+	binary.BigEndian.PutUint16(msg[6:], 1)
+	return msg, true
+}
+
+func (p *Proxy) inLocalPTRNetworks(ip net.IP) bool {
+	for _, n := range p.LocalPTRNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,392 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nextdns/windows/dnsmsg"
+	"github.com/nextdns/windows/resolver"
+)
+
+// DefaultQueryLogMaxSize defines the default value for QueryLogFile MaxSize.
+const DefaultQueryLogMaxSize = 10 << 20
+
+// QueryLogFile writes one JSON line per answered query to a file. When the
+// file grows over MaxSize, it is renamed with a .1 suffix, the previous
+// segments being shifted to .2 and so on up to MaxBackups, and a new file is
+// started.
+type QueryLogFile struct {
+	// Path is the file the queries are logged to.
+	Path string
+
+	// MaxSize is the size in bytes after which the file is rotated. If zero,
+	// DefaultQueryLogMaxSize is used.
+	MaxSize int64
+
+	// MaxBackups is the number of rotated segments kept. If zero, one is
+	// kept.
+	MaxBackups int
+
+	// Compress gzips the rotated segments, named with an additional .gz
+	// suffix, the current one staying in plain text. They are compressed in
+	// the background, as they are rotated.
+	Compress bool
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+
+	compressing chan struct{} // closed once the last rotated segment is compressed
+	compressErr error         // set before compressing is closed
+}
+
+type queryLogEntry struct {
+	Time        time.Time `json:"time"`
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	RCode       string    `json:"rcode"`
+	Answers     int       `json:"answers"`
+	Cached      bool      `json:"cached"`
+	Upstream    string    `json:"upstream,omitempty"`
+	Process     string    `json:"process,omitempty"`
+	EDE         string    `json:"ede,omitempty"`
+	LatencyMs   float64   `json:"latencyMs"`
+	RoundTripMs float64   `json:"roundTripMs,omitempty"`
+	ReadMs      float64   `json:"readMs,omitempty"`
+	BytesIn     int       `json:"bytesIn"`
+	BytesOut    int       `json:"bytesOut"`
+}
+
+// QueryResult describes how an answered query got resolved.
+type QueryResult struct {
+	// MsgID, Name and Type identify the query. RCode is the response code,
+	// or -1 if the response is malformed.
+	MsgID uint16
+	Name  string
+	Type  uint16
+	RCode int
+
+	// Cached reports if the response was served from the cache.
+	Cached bool
+
+	// Upstream is the name of the upstream the query was sent to, if any,
+	// and Latency the time it took to answer.
+	Upstream string
+	Latency  time.Duration
+
+	// RoundTrip is the time spent waiting for the DoH response headers and
+	// Read the time spent reading its body. They are zero for the other
+	// protocols.
+	RoundTrip time.Duration
+	Read      time.Duration
+
+	// Process is the executable name of the process that sent the query
+	// when LogProcessNames is set and it could be found.
+	Process string
+
+	// ExtendedError is the Extended DNS Error of the upstream response, if
+	// any, like the reason a name was blocked.
+	ExtendedError *ExtendedError
+}
+
+func (l *QueryLogFile) write(e queryLogEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.compressResultLocked(false); err != nil {
+		return err
+	}
+	if l.f != nil && l.size+int64(len(b)) > l.maxSize() {
+		l.f.Close()
+		l.f = nil
+		if err := l.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	if l.f == nil {
+		if l.f, err = os.OpenFile(l.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+			return err
+		}
+		fi, err := l.f.Stat()
+		if err != nil {
+			l.f.Close()
+			l.f = nil
+			return err
+		}
+		l.size = fi.Size()
+	}
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	return err
+}
+
+// rotateLocked renames the closed current file to the first segment, shifting
+// the previous ones and dropping the oldest.
+func (l *QueryLogFile) rotateLocked() error {
+	// The first segment is renamed below, its compression must be done.
+	if err := l.compressResultLocked(true); err != nil {
+		return err
+	}
+	suffix := ""
+	if l.Compress {
+		suffix = ".gz"
+	}
+	segment := func(i int) string {
+		return fmt.Sprintf("%s.%d%s", l.Path, i, suffix)
+	}
+	for i := l.maxBackups() - 1; i >= 1; i-- {
+		if err := os.Rename(segment(i), segment(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(l.Path, l.Path+".1"); err != nil {
+		return err
+	}
+	if !l.Compress {
+		return nil
+	}
+	done := make(chan struct{})
+	l.compressing = done
+	go func() {
+		defer close(done)
+		l.compressErr = compressFile(l.Path+".1", segment(1))
+	}()
+	return nil
+}
+
+// compressResultLocked returns the error of the compression of the last
+// rotated segment once done, waiting for it if wait is set.
+func (l *QueryLogFile) compressResultLocked(wait bool) error {
+	if l.compressing == nil {
+		return nil
+	}
+	if wait {
+		<-l.compressing
+	} else {
+		select {
+		case <-l.compressing:
+		default:
+			return nil
+		}
+	}
+	l.compressing = nil
+	if err := l.compressErr; err != nil {
+		l.compressErr = nil
+		return fmt.Errorf("compress: %v", err)
+	}
+	return nil
+}
+
+// compressFile gzips the file src to dst and removes src.
+func compressFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(dst)
+		}
+	}()
+	zw := gzip.NewWriter(out)
+	if _, err = io.Copy(zw, in); err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
+
+func (l *QueryLogFile) maxBackups() int {
+	if l.MaxBackups <= 0 {
+		return 1
+	}
+	return l.MaxBackups
+}
+
+func (l *QueryLogFile) maxSize() int64 {
+	if l.MaxSize <= 0 {
+		return DefaultQueryLogMaxSize
+	}
+	return l.MaxSize
+}
+
+// close closes the current file, once the last rotated segment is
+// compressed. It is reopened on the next write.
+func (l *QueryLogFile) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cerr := l.compressResultLocked(true)
+	if l.f == nil {
+		return cerr
+	}
+	err := l.f.Close()
+	l.f = nil
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// queryInfo collects how a query got resolved for the query log.
+type queryInfo struct {
+	cached   bool
+	upstream string
+	latency  time.Duration
+	timing   resolver.Timing
+	process  string
+	ede      *ExtendedError
+}
+
+type queryInfoKey struct{}
+
+// withQueryInfo returns a context collecting the resolution details of the
+// query in qi.
+func withQueryInfo(ctx context.Context, qi *queryInfo) context.Context {
+	return context.WithValue(ctx, queryInfoKey{}, qi)
+}
+
+// queryInfoFrom returns the queryInfo attached to ctx, or nil.
+func queryInfoFrom(ctx context.Context) *queryInfo {
+	qi, _ := ctx.Value(queryInfoKey{}).(*queryInfo)
+	return qi
+}
+
+// logResponse reports the response msg answering q to QueryLogResult, writes
+// it to the QueryLogFile and keeps it for RecentQueries. bytesOut is the size
+// of the response sent to the client.
+func (p *Proxy) logResponse(ctx context.Context, q, msg []byte, bytesOut int) {
+	if p.QueryLogFile == nil && p.QueryLogResult == nil && p.RecentQueriesSize <= 0 {
+		return
+	}
+	name, qtype, _, _, _ := dnsmsg.ParseQuestion(q)
+	if dnsmsg.QuestionCount(q) > 1 {
+		name = queryName(q)
+	}
+	name = p.logName(name)
+	r := QueryResult{
+		MsgID: dnsmsg.ID(q),
+		Name:  name,
+		Type:  qtype,
+		RCode: dnsmsg.RCode(msg),
+	}
+	if qi := queryInfoFrom(ctx); qi != nil {
+		r.Cached = qi.cached
+		r.Upstream = qi.upstream
+		r.Latency = qi.latency
+		r.RoundTrip = qi.timing.RoundTrip
+		r.Read = qi.timing.Read
+		r.Process = qi.process
+		r.ExtendedError = qi.ede
+	}
+	if r.ExtendedError == nil {
+		// Cached responses may still have their OPT record.
+		r.ExtendedError, _ = extendedError(msg)
+	}
+	if p.QueryLogResult != nil {
+		p.QueryLogResult(r)
+	}
+	now := time.Now()
+	if p.RecentQueriesSize > 0 {
+		rq := RecentQuery{
+			Time:     now,
+			Name:     name,
+			Type:     typeString(qtype),
+			Cached:   r.Cached,
+			Upstream: r.Upstream,
+		}
+		if r.RCode >= 0 {
+			rq.RCode = rcodeString(r.RCode)
+		}
+		p.recent.add(p.RecentQueriesSize, rq)
+	}
+	if p.QueryLogFile == nil {
+		return
+	}
+	e := queryLogEntry{
+		Time:        now,
+		Name:        name,
+		Type:        typeString(qtype),
+		Cached:      r.Cached,
+		Upstream:    r.Upstream,
+		Process:     r.Process,
+		LatencyMs:   float64(r.Latency) / float64(time.Millisecond),
+		RoundTripMs: float64(r.RoundTrip) / float64(time.Millisecond),
+		ReadMs:      float64(r.Read) / float64(time.Millisecond),
+		BytesIn:     len(q),
+		BytesOut:    bytesOut,
+	}
+	if r.ExtendedError != nil {
+		e.EDE = r.ExtendedError.String()
+	}
+	if r.RCode >= 0 {
+		e.RCode = rcodeString(r.RCode)
+		e.Answers = dnsmsg.Count(msg, dnsmsg.SectionAnswer)
+	}
+	if err := p.QueryLogFile.write(e); err != nil {
+		p.logErr(fmt.Errorf("query log: %v", err))
+	}
+}
+
+var typeNames = map[uint16]string{
+	1:   "A",
+	2:   "NS",
+	5:   "CNAME",
+	6:   "SOA",
+	12:  "PTR",
+	15:  "MX",
+	16:  "TXT",
+	28:  "AAAA",
+	33:  "SRV",
+	35:  "NAPTR",
+	43:  "DS",
+	46:  "RRSIG",
+	48:  "DNSKEY",
+	64:  "SVCB",
+	65:  "HTTPS",
+	255: "ANY",
+}
+
+func typeString(t uint16) string {
+	if s, ok := typeNames[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+var rcodeNames = map[int]string{
+	0: "NOERROR",
+	1: "FORMERR",
+	2: "SERVFAIL",
+	3: "NXDOMAIN",
+	4: "NOTIMP",
+	5: "REFUSED",
+}
+
+func rcodeString(rc int) string {
+	if s, ok := rcodeNames[rc]; ok {
+		return s
+	}
+	return fmt.Sprintf("RCODE%d", rc)
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nextdns/windows/dnsmsg"
+)
+
+// DefaultNameRateLimitDuration defines the default value for Proxy
+// NameRateLimitDuration.
+const DefaultNameRateLimitDuration = 30 * time.Second
+
+// nameLimiter counts the queries received per name to limit the names queried
+// more than a given number of times per second.
+type nameLimiter struct {
+	mu    sync.Mutex
+	names map[string]*nameRate
+}
+
+type nameRate struct {
+	window time.Time // start of the current one second window
+	count  int       // queries received in the current window
+	until  time.Time // end of the limitation, if limited
+}
+
+// allow records a query for name and returns false if name is limited
+// because it got more than qps queries in the last second. Once limited, the
+// name stays so for d. started reports if the limitation just started.
+func (l *nameLimiter) allow(name string, qps int, d time.Duration) (ok, started bool) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r := l.names[name]
+	if r == nil {
+		if l.names == nil {
+			l.names = map[string]*nameRate{}
+		}
+		if len(l.names) >= 1024 {
+			for n, r := range l.names {
+				if now.Sub(r.window) >= time.Second && !now.Before(r.until) {
+					delete(l.names, n)
+				}
+			}
+		}
+		r = &nameRate{}
+		l.names[name] = r
+	}
+	if now.Before(r.until) {
+		return false, false
+	}
+	if now.Sub(r.window) >= time.Second {
+		r.window = now
+		r.count = 0
+	}
+	r.count++
+	if r.count <= qps {
+		return true, false
+	}
+	r.until = now.Add(d)
+	return false, true
+}
+
+// rateLimit returns the response to q if its name is over NameRateLimit: the
+// cached response if any, or a REFUSED.
+func (p *Proxy) rateLimit(q []byte) ([]byte, bool) {
+	if p.NameRateLimit <= 0 {
+		return nil, false
+	}
+	k, ok := queryCacheKey(q)
+	if !ok {
+		return nil, false
+	}
+	d := p.NameRateLimitDuration
+	if d <= 0 {
+		d = DefaultNameRateLimitDuration
+	}
+	allowed, started := p.names.allow(k.name, p.NameRateLimit, d)
+	if allowed {
+		return nil, false
+	}
+	if started {
+		p.logWarn(fmt.Sprintf("Rate limiting %s for %v: over %d queries/s", k.name, d, p.NameRateLimit))
+	}
+	p.stats.incr(&p.stats.rateLimited)
+	if p.Cache != nil {
+		if msg := p.Cache.stale(k, dnsmsg.ID(q)); msg != nil {
+			return msg, true
+		}
+	}
+	return reply(q, dnsmsg.RCodeRefused), true
+}
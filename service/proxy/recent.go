@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// RecentQuery is an answered query kept for RecentQueries.
+type RecentQuery struct {
+	Time time.Time `json:"time"`
+	Name string    `json:"name"`
+
+	// Type and RCode are the names of the query type and of the response
+	// code, like AAAA and NXDOMAIN. RCode is empty if the response is
+	// malformed.
+	Type  string `json:"type"`
+	RCode string `json:"rcode"`
+
+	// Cached reports if the response was served from the cache.
+	Cached bool `json:"cached"`
+
+	// Upstream is the name of the upstream the query was sent to, if any.
+	Upstream string `json:"upstream,omitempty"`
+}
+
+// recentQueries is a ring buffer of the last answered queries.
+type recentQueries struct {
+	mu   sync.Mutex
+	buf  []RecentQuery
+	next int // index of the next query to add
+	full bool
+}
+
+func (r *recentQueries) add(size int, q RecentQuery) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.buf) != size {
+		// Allocated on the first query.
+		r.buf, r.next, r.full = make([]RecentQuery, size), 0, false
+	}
+	r.buf[r.next] = q
+	r.next++
+	if r.next == len(r.buf) {
+		r.next, r.full = 0, true
+	}
+}
+
+// list returns the queries, most recent first.
+func (r *recentQueries) list() []RecentQuery {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := r.next
+	if r.full {
+		n = len(r.buf)
+	}
+	res := make([]RecentQuery, 0, n)
+	for i := 1; i <= n; i++ {
+		res = append(res, r.buf[(r.next-i+len(r.buf))%len(r.buf)])
+	}
+	return res
+}
+
+// RecentQueries returns the last RecentQueriesSize answered queries, most
+// recent first, for a view of the recent activity without a query log.
+func (p *Proxy) RecentQueries() []RecentQuery {
+	return p.recent.list()
+}
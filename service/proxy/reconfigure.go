@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// Options are the settings Reconfigure changes on a running proxy. They have
+// the meaning of the Proxy and Cache fields of the same name.
+type Options struct {
+	UpstreamHostName  string
+	ConfigID          string
+	ExtraHeaders      http.Header
+	Protocol          string
+	Routes            map[string]string
+	FallbackUpstreams []string
+
+	CacheMaxEntries     int
+	CacheMaxNegativeTTL time.Duration
+	CachePrefetchRatio  float64
+	CacheMaxStale       time.Duration
+}
+
+// Reconfigure applies opts in place. Unlike a Stop and Start, the tun
+// interface and the driver are left untouched and queries keep being
+// answered: only the upstreams are replaced, if their settings changed. The
+// cache settings are ignored if Cache is nil. opts must not be modified
+// afterwards.
+func (p *Proxy) Reconfigure(opts Options) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cfgMu.Lock()
+	reset := p.hostname != opts.UpstreamHostName ||
+		p.Protocol != opts.Protocol ||
+		!reflect.DeepEqual(p.Routes, opts.Routes) ||
+		!reflect.DeepEqual(p.FallbackUpstreams, opts.FallbackUpstreams)
+	if p.id != opts.ConfigID && (opts.Protocol == ProtocolDOT || opts.Protocol == ProtocolDOQ) {
+		// Conveyed in the server name.
+		reset = true
+	}
+	p.hostname = opts.UpstreamHostName
+	p.id = opts.ConfigID
+	p.ExtraHeaders = opts.ExtraHeaders
+	p.cfgMu.Unlock()
+	p.Protocol = opts.Protocol
+	p.Routes = opts.Routes
+	p.FallbackUpstreams = opts.FallbackUpstreams
+	if p.Cache != nil {
+		p.Cache.configure(opts.CacheMaxEntries, opts.CacheMaxNegativeTTL, opts.CachePrefetchRatio, opts.CacheMaxStale)
+	}
+	if reset && p.stateLocked() == StateStarted {
+		p.logInfo("Configuration changed, replacing upstreams")
+		p.setupUpstreams()
+	}
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/nextdns/windows/resolver"
+)
+
+// Upstream connection states reported in Stats when Reconnect is set.
+const (
+	ConnectionConnected    = "connected"
+	ConnectionReconnecting = "reconnecting"
+)
+
+const (
+	// reconnectMinBackoff and reconnectMaxBackoff bound the time between two
+	// reconnection attempts, doubled after each failure.
+	reconnectMinBackoff = time.Second
+	reconnectMaxBackoff = time.Minute
+)
+
+// connectionFailed asks the reconnection manager to reconnect to the upstream
+// if err is a transport error. It does not block.
+func (p *Proxy) connectionFailed(ctx context.Context, err error) {
+	if !p.Reconnect || ctx.Err() == context.Canceled {
+		return
+	}
+	var te *resolver.TransportError
+	if !errors.As(err, &te) {
+		return
+	}
+	select {
+	case p.reconnectCheck <- struct{}{}:
+	default:
+	}
+}
+
+// reconnectMonitor replaces the upstream connections after a transport error
+// and probes them, with an exponential backoff between attempts, until a
+// probe succeeds. Client queries thus do not each trigger a reconnection
+// after a network blip. It returns when ctx is done.
+func (p *Proxy) reconnectMonitor(ctx context.Context) {
+	defer atomic.StoreInt32(&p.stats.reconnecting, 0)
+	for {
+		select {
+		case <-p.reconnectCheck:
+		case <-ctx.Done():
+			return
+		}
+		atomic.StoreInt32(&p.stats.reconnecting, 1)
+		p.logWarn("Upstream connection failed, reconnecting")
+		backoff := reconnectMinBackoff
+		for {
+			p.resetUpstreams()
+			err := p.keepAliveProbe(ctx)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			p.logErr(fmt.Errorf("reconnect: %v, retrying in %v", err, backoff))
+			t := time.NewTimer(backoff)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return
+			}
+			if backoff *= 2; backoff > reconnectMaxBackoff {
+				backoff = reconnectMaxBackoff
+			}
+		}
+		// Ignore the failures of the queries sent on the old connections
+		// while reconnecting.
+		select {
+		case <-p.reconnectCheck:
+		default:
+		}
+		atomic.StoreInt32(&p.stats.reconnecting, 0)
+		p.logInfo("Upstream reconnected")
+	}
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nextdns/windows/dnsmsg"
+	"github.com/nextdns/windows/resolver"
+)
+
+// newRoutes returns the upstreams of routes indexed by normalized domain
+// suffix.
+func (p *Proxy) newRoutes(routes map[string]string) map[string]upstream {
+	if len(routes) == 0 {
+		return nil
+	}
+	m := make(map[string]upstream, len(routes))
+	for suffix, u := range routes {
+		r, err := resolver.New(u)
+		if err != nil {
+			p.logErr(fmt.Errorf("invalid route %s: %v", suffix, err))
+			continue
+		}
+		p.setupResolver(u, r)
+		suffix = strings.ToLower(strings.Trim(suffix, ".")) + "."
+		m[suffix] = upstream{name: u, resolver: r}
+	}
+	return m
+}
+
+// route returns the upstream of routes for the query q, if any. The longest
+// suffix of the query name found in routes wins.
+func route(routes map[string]upstream, q []byte) (upstream, bool) {
+	if len(routes) == 0 {
+		return upstream{}, false
+	}
+	name, _, _, _, ok := dnsmsg.ParseQuestion(q)
+	if !ok {
+		return upstream{}, false
+	}
+	for {
+		if u, found := routes[name]; found {
+			return u, true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			return upstream{}, false
+		}
+		name = name[i+1:]
+	}
+}
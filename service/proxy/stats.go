@@ -0,0 +1,325 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats holds the proxy counters since it was created or since the last call
+// to ResetStats.
+type Stats struct {
+	// Queries is the number of queries received from clients.
+	Queries uint64
+
+	// CacheHits is the number of queries answered from the cache.
+	CacheHits uint64
+
+	// UpstreamErrors is the number of queries that failed to get a response
+	// from the upstream, timeouts excluded.
+	UpstreamErrors uint64
+
+	// Timeouts is the number of queries that did not get a response within
+	// QueryTimeout.
+	Timeouts uint64
+
+	// DedupDrops is the number of queries dropped as duplicates.
+	DedupDrops uint64
+
+	// LimitDrops is the number of queries dropped because
+	// MaxConcurrentQueries were already in flight.
+	LimitDrops uint64
+
+	// RateLimited is the number of queries not sent upstream because their
+	// name was over NameRateLimit.
+	RateLimited uint64
+
+	// Blocklisted is the number of queries answered locally because their
+	// name is in Blocklist.
+	Blocklisted uint64
+
+	// TunWriteDrops is the number of packets dropped because a write to the
+	// tun interface was blocked for more than TunWriteTimeout.
+	TunWriteDrops uint64
+
+	// BytesIn and BytesOut are the number of DNS bytes received from and sent
+	// to clients.
+	BytesIn  uint64
+	BytesOut uint64
+
+	// UpstreamLatency is a moving average of the upstream response time.
+	UpstreamLatency time.Duration
+
+	// UpstreamLatencyBuckets holds, for each bound of the latency histogram
+	// (5ms, 10ms, 25ms, 50ms, 100ms, 250ms, 500ms, 1s and 2.5s), the number of
+	// upstream responses received within that bound.
+	// UpstreamLatencyCount and UpstreamLatencySum are the total number of
+	// upstream responses and the sum of their response times.
+	UpstreamLatencyBuckets []uint64
+	UpstreamLatencyCount   uint64
+	UpstreamLatencySum     time.Duration
+
+	// QuerySizes and ResponseSizes are the histograms of the sizes of the
+	// DNS queries received from and responses sent to clients.
+	QuerySizes    SizeHistogram
+	ResponseSizes SizeHistogram
+
+	// LastHealthCheck is the time of the last successful health check, zero if
+	// none succeeded yet. It is not affected by ResetStats.
+	LastHealthCheck time.Time
+
+	// Connection is the state of the upstream connection,
+	// ConnectionConnected or ConnectionReconnecting, when Reconnect is set.
+	// It is not affected by ResetStats.
+	Connection string
+
+	// PacketBuffers is the number of packet buffers in use, held by the
+	// queued packets and the queries in flight. It is not affected by
+	// ResetStats.
+	PacketBuffers int64
+
+	// TrippedUpstreams lists the upstreams skipped because their circuit
+	// breaker is open, see BreakerThreshold. When not empty, queries are
+	// answered by the fallbacks. It is not affected by ResetStats.
+	TrippedUpstreams []string
+}
+
+// SizeHistogram is a histogram of DNS message sizes.
+type SizeHistogram struct {
+	// Buckets holds, for each bound of the histogram (64, 128, 256, 512,
+	// 1232, 1472 and 4096 bytes), the number of messages of at most that
+	// size. 1232 is the safe EDNS buffer size and 1472 the largest payload
+	// of a UDP datagram fitting in a 1500 bytes MTU.
+	Buckets []uint64
+
+	// Count, Sum and Max are the number of messages, the sum of their sizes
+	// and the size of the largest one.
+	Count uint64
+	Sum   uint64
+	Max   uint64
+}
+
+// sizeBounds are the upper bounds of the message size histograms.
+var sizeBounds = [...]int{64, 128, 256, 512, 1232, 1472, 4096}
+
+// sizeHistogram is the live SizeHistogram. All fields are accessed
+// atomically.
+type sizeHistogram struct {
+	// buckets counts the messages per sizeBounds bound, the last one
+	// counting the messages above all the bounds.
+	buckets [len(sizeBounds) + 1]uint64
+	sum     uint64
+	max     uint64
+}
+
+// observe counts a message of n bytes.
+func (h *sizeHistogram) observe(n int) {
+	i := 0
+	for i < len(sizeBounds) && n > sizeBounds[i] {
+		i++
+	}
+	atomic.AddUint64(&h.buckets[i], 1)
+	atomic.AddUint64(&h.sum, uint64(n))
+	for {
+		old := atomic.LoadUint64(&h.max)
+		if uint64(n) <= old || atomic.CompareAndSwapUint64(&h.max, old, uint64(n)) {
+			return
+		}
+	}
+}
+
+// snapshot returns h with cumulative buckets.
+func (h *sizeHistogram) snapshot() SizeHistogram {
+	st := SizeHistogram{
+		Buckets: make([]uint64, len(sizeBounds)),
+		Sum:     atomic.LoadUint64(&h.sum),
+		Max:     atomic.LoadUint64(&h.max),
+	}
+	for i := range h.buckets {
+		st.Count += atomic.LoadUint64(&h.buckets[i])
+		if i < len(st.Buckets) {
+			st.Buckets[i] = st.Count
+		}
+	}
+	return st
+}
+
+func (h *sizeHistogram) reset() {
+	for i := range h.buckets {
+		atomic.StoreUint64(&h.buckets[i], 0)
+	}
+	atomic.StoreUint64(&h.sum, 0)
+	atomic.StoreUint64(&h.max, 0)
+}
+
+// latencyBounds are the upper bounds of the upstream latency histogram.
+var latencyBounds = [...]time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+}
+
+// stats are the live counters behind Stats. All fields are accessed
+// atomically.
+type stats struct {
+	queries        uint64
+	cacheHits      uint64
+	upstreamErrors uint64
+	timeouts       uint64
+	dedupDrops     uint64
+	limitDrops     uint64
+	rateLimited    uint64
+	blocklisted    uint64
+	writeDrops     uint64
+	bytesIn        uint64
+	bytesOut       uint64
+	latency        int64 // moving average in ns
+
+	// latencyBuckets counts the samples per latencyBounds bound, the last
+	// one counting the samples above all the bounds.
+	latencyBuckets [len(latencyBounds) + 1]uint64
+	latencySum     int64 // in ns
+
+	querySizes    sizeHistogram
+	responseSizes sizeHistogram
+
+	lastHealthCheck int64  // unix time in ns
+	lastExchange    int64  // unix time in ns of the last upstream response
+	packetBuffers   int64  // packet buffers in use
+	tunWrites       uint64 // packets written to the tun
+	reconnecting    int32  // 1 while the reconnection manager reconnects
+}
+
+// Stats returns a snapshot of the proxy counters.
+func (p *Proxy) Stats() Stats {
+	s := &p.stats
+	buckets := make([]uint64, len(latencyBounds))
+	var count uint64
+	for i := range s.latencyBuckets {
+		count += atomic.LoadUint64(&s.latencyBuckets[i])
+		if i < len(buckets) {
+			buckets[i] = count
+		}
+	}
+	st := Stats{
+		Queries:         atomic.LoadUint64(&s.queries),
+		CacheHits:       atomic.LoadUint64(&s.cacheHits),
+		UpstreamErrors:  atomic.LoadUint64(&s.upstreamErrors),
+		Timeouts:        atomic.LoadUint64(&s.timeouts),
+		DedupDrops:      atomic.LoadUint64(&s.dedupDrops),
+		LimitDrops:      atomic.LoadUint64(&s.limitDrops),
+		RateLimited:     atomic.LoadUint64(&s.rateLimited),
+		Blocklisted:     atomic.LoadUint64(&s.blocklisted),
+		TunWriteDrops:   atomic.LoadUint64(&s.writeDrops),
+		BytesIn:         atomic.LoadUint64(&s.bytesIn),
+		BytesOut:        atomic.LoadUint64(&s.bytesOut),
+		UpstreamLatency: time.Duration(atomic.LoadInt64(&s.latency)),
+
+		UpstreamLatencyBuckets: buckets,
+		UpstreamLatencyCount:   count,
+		UpstreamLatencySum:     time.Duration(atomic.LoadInt64(&s.latencySum)),
+
+		QuerySizes:    s.querySizes.snapshot(),
+		ResponseSizes: s.responseSizes.snapshot(),
+	}
+	if t := atomic.LoadInt64(&s.lastHealthCheck); t != 0 {
+		st.LastHealthCheck = time.Unix(0, t)
+	}
+	if p.Reconnect {
+		st.Connection = ConnectionConnected
+		if atomic.LoadInt32(&s.reconnecting) == 1 {
+			st.Connection = ConnectionReconnecting
+		}
+	}
+	st.PacketBuffers = atomic.LoadInt64(&s.packetBuffers)
+	st.TrippedUpstreams = p.trippedUpstreams()
+	return st
+}
+
+// ResetStats resets all the proxy counters to zero.
+func (p *Proxy) ResetStats() {
+	s := &p.stats
+	atomic.StoreUint64(&s.queries, 0)
+	atomic.StoreUint64(&s.cacheHits, 0)
+	atomic.StoreUint64(&s.upstreamErrors, 0)
+	atomic.StoreUint64(&s.timeouts, 0)
+	atomic.StoreUint64(&s.dedupDrops, 0)
+	atomic.StoreUint64(&s.limitDrops, 0)
+	atomic.StoreUint64(&s.rateLimited, 0)
+	atomic.StoreUint64(&s.blocklisted, 0)
+	atomic.StoreUint64(&s.writeDrops, 0)
+	atomic.StoreUint64(&s.bytesIn, 0)
+	atomic.StoreUint64(&s.bytesOut, 0)
+	atomic.StoreInt64(&s.latency, 0)
+	for i := range s.latencyBuckets {
+		atomic.StoreUint64(&s.latencyBuckets[i], 0)
+	}
+	atomic.StoreInt64(&s.latencySum, 0)
+	s.querySizes.reset()
+	s.responseSizes.reset()
+}
+
+func (s *stats) setLastHealthCheck(t time.Time) {
+	atomic.StoreInt64(&s.lastHealthCheck, t.UnixNano())
+}
+
+func (s *stats) setLastExchange(t time.Time) {
+	atomic.StoreInt64(&s.lastExchange, t.UnixNano())
+}
+
+// lastExchangeTime returns the time of the last upstream response, or the
+// zero time if none was received.
+func (s *stats) lastExchangeTime() time.Time {
+	ns := atomic.LoadInt64(&s.lastExchange)
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+func (s *stats) incr(counter *uint64) {
+	atomic.AddUint64(counter, 1)
+}
+
+func (s *stats) add(counter *uint64, n int) {
+	atomic.AddUint64(counter, uint64(n))
+}
+
+// observeQuery counts a query of n bytes received from a client.
+func (s *stats) observeQuery(n int) {
+	s.add(&s.bytesIn, n)
+	s.querySizes.observe(n)
+}
+
+// observeResponse counts a response of n bytes sent to a client.
+func (s *stats) observeResponse(n int) {
+	s.add(&s.bytesOut, n)
+	s.responseSizes.observe(n)
+}
+
+// observeLatency adds d to the upstream latency moving average. Like the TCP
+// smoothed RTT, each new sample weights for 1/8th of the average. The sample
+// is also counted in the latency histogram.
+func (s *stats) observeLatency(d time.Duration) {
+	i := 0
+	for i < len(latencyBounds) && d > latencyBounds[i] {
+		i++
+	}
+	atomic.AddUint64(&s.latencyBuckets[i], 1)
+	atomic.AddInt64(&s.latencySum, int64(d))
+	for {
+		old := atomic.LoadInt64(&s.latency)
+		avg := int64(d)
+		if old != 0 {
+			avg = old + (int64(d)-old)/8
+		}
+		if atomic.CompareAndSwapInt64(&s.latency, old, avg) {
+			return
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/nextdns/windows/resolver"
+	"github.com/nextdns/windows/sysdns"
+)
+
+const (
+	// systemDNSName is the name of the upstream forwarding to the system DNS
+	// servers.
+	systemDNSName = "system"
+
+	// tunDeviceName is the name of the tun interface, whose DNS servers are
+	// the proxy.
+	tunDeviceName = "NextDNS"
+)
+
+// usesSystemDNS reports if the configuration needs the system DNS servers.
+func (p *Proxy) usesSystemDNS() bool {
+	return len(p.SystemDNSDomains) > 0 || p.CaptivePortalDetection || p.Passthrough || p.Paused()
+}
+
+// captureSystemDNS records the DNS servers of the other interfaces, like the
+// ones given by DHCP. As the tun interface is ignored, it can be called again
+// after the proxy took over the system DNS, like after a network change.
+func (p *Proxy) captureSystemDNS() {
+	ips, err := sysdns.Servers(tunDeviceName)
+	if err != nil {
+		p.logErr(fmt.Errorf("system DNS: %v", err))
+		return
+	}
+	var servers []net.IP
+ips:
+	for _, ip := range ips {
+		if ip.IsLinkLocalUnicast() || ip.IsLoopback() {
+			// Link-local servers cannot be reached without their zone.
+			continue
+		}
+		for _, addr := range p.localAddrs {
+			if addr.Equal(ip) {
+				continue ips
+			}
+		}
+		servers = append(servers, ip)
+	}
+	p.logInfo(fmt.Sprintf("System DNS servers: %v", servers))
+	p.upMu.Lock()
+	p.systemDNS = servers
+	p.upMu.Unlock()
+}
+
+// systemUpstream returns the upstream forwarding to the system DNS servers,
+// or false if none was found.
+func (p *Proxy) systemUpstream() (upstream, bool) {
+	p.upMu.RLock()
+	defer p.upMu.RUnlock()
+	return p.sysUpstream, p.sysUpstream.resolver != nil
+}
+
+// newSystemUpstream returns an upstream sending queries to the DNS servers
+// ips, or a zero upstream if there is none.
+func newSystemUpstream(ips []net.IP) upstream {
+	var rs []resolver.Resolver
+	for _, ip := range ips {
+		rs = append(rs, &resolver.DNS53{Addr: net.JoinHostPort(ip.String(), "53")})
+	}
+	switch len(rs) {
+	case 0:
+		return upstream{}
+	case 1:
+		return upstream{name: systemDNSName, resolver: rs[0]}
+	}
+	return upstream{name: systemDNSName, resolver: &resolver.Race{Resolvers: rs}}
+}
+
+// addSystemDNSRoutes adds the SystemDNSDomains routes to routes, forwarded to
+// the system upstream u.
+func (p *Proxy) addSystemDNSRoutes(routes map[string]upstream, u upstream) map[string]upstream {
+	if len(p.SystemDNSDomains) == 0 {
+		return routes
+	}
+	if u.resolver == nil {
+		p.logErr(fmt.Errorf("no system DNS server to forward %v to", p.SystemDNSDomains))
+		return routes
+	}
+	if routes == nil {
+		routes = make(map[string]upstream, len(p.SystemDNSDomains))
+	}
+	for _, d := range p.SystemDNSDomains {
+		suffix := strings.ToLower(strings.Trim(d, ".")) + "."
+		if _, found := routes[suffix]; !found {
+			routes[suffix] = u
+		}
+	}
+	return routes
+}
@@ -0,0 +1,413 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nextdns/windows/dnsmsg"
+)
+
+const (
+	tcpHeaderLen = 20
+
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+
+	// tcpDefaultMSS is the MSS to assume when the client does not advertise
+	// one (RFC 1122).
+	tcpDefaultMSS = 536
+
+	// tcpMinMSS is the smallest MSS accepted from a client, below it the
+	// default one is assumed. A zero MSS would never get a response sent.
+	tcpMinMSS = 64
+
+	// tcpIdleTimeout is the time after which an inactive connection is
+	// forgotten.
+	tcpIdleTimeout = 2 * time.Minute
+)
+
+// tcpStack terminates the DNS over TCP connections opened by clients on the
+// tun interface. It only implements what is needed to exchange DNS messages
+// on a local link: there is no retransmission, no reordering and the peer
+// window is ignored. Segments received for an unknown connection, like after
+// the proxy restarted, are answered with a reset.
+type tcpStack struct {
+	ctx      context.Context
+	proxy    *Proxy
+	limiter  queryLimiter
+	bpool    *bufferPool
+	size     int // size of the pool buffers
+	out      chan<- []byte
+	stop     <-chan struct{}
+	inflight *sync.WaitGroup // queries in flight
+
+	mu    sync.Mutex
+	conns map[tcpConnKey]*tcpConn
+}
+
+type tcpConnKey struct {
+	addr [4]byte
+	port uint16
+}
+
+type tcpConn struct {
+	key   tcpConnKey
+	local [4]byte
+	lport uint16
+	mss   int
+
+	mu          sync.Mutex
+	sndNext     uint32 // next sequence number to send
+	rcvNext     uint32 // next sequence number expected from the client
+	buf         []byte // received data not yet parsed as DNS messages
+	pending     int    // number of queries in flight
+	finReceived bool
+	closed      bool
+	lastActive  time.Time
+}
+
+type tcpSegment struct {
+	src, dst     [4]byte
+	sport, dport uint16
+	seq, ack     uint32
+	flags        uint8
+	mss          int
+	payload      []byte
+}
+
+// parseTCPSegment parses the IPv4/TCP packet in pkt.
+func parseTCPSegment(pkt []byte) (s tcpSegment, ok bool) {
+	if len(pkt) < ipv4HeaderLen {
+		return s, false
+	}
+	ihl := int(pkt[0]&0xf) * 4
+	totalLen := int(binary.BigEndian.Uint16(pkt[2:4]))
+	if ihl < ipv4HeaderLen || totalLen > len(pkt) || ihl+tcpHeaderLen > totalLen {
+		return s, false
+	}
+	// Ignore trailing bytes like ethernet padding.
+	pkt = pkt[:totalLen]
+	copy(s.src[:], pkt[12:16])
+	copy(s.dst[:], pkt[16:20])
+	tcp := pkt[ihl:]
+	dataOff := int(tcp[12]>>4) * 4
+	if dataOff < tcpHeaderLen || dataOff > len(tcp) {
+		return s, false
+	}
+	s.sport = binary.BigEndian.Uint16(tcp[0:])
+	s.dport = binary.BigEndian.Uint16(tcp[2:])
+	s.seq = binary.BigEndian.Uint32(tcp[4:])
+	s.ack = binary.BigEndian.Uint32(tcp[8:])
+	s.flags = tcp[13]
+	s.payload = tcp[dataOff:]
+	s.mss = tcpDefaultMSS
+	for opts := tcp[tcpHeaderLen:dataOff]; len(opts) > 0; {
+		switch opts[0] {
+		case 0: // end of options
+			opts = nil
+			continue
+		case 1: // nop
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			break
+		}
+		if opts[0] == 2 && opts[1] == 4 {
+			if mss := int(binary.BigEndian.Uint16(opts[2:4])); mss >= tcpMinMSS {
+				s.mss = mss
+			}
+		}
+		opts = opts[opts[1]:]
+	}
+	return s, true
+}
+
+// handle processes the TCP packet pkt. The buffer is always returned to the
+// pool.
+func (s *tcpStack) handle(pkt []byte) {
+	defer s.bpool.put(pkt)
+	defer s.proxy.recoverPanic("tcp")
+	seg, ok := parseTCPSegment(pkt)
+	if !ok || seg.dport != 53 {
+		return
+	}
+	key := tcpConnKey{addr: seg.src, port: seg.sport}
+
+	if seg.flags&tcpFlagRST != 0 {
+		s.remove(key)
+		return
+	}
+	if seg.flags&tcpFlagSYN != 0 {
+		s.accept(seg)
+		return
+	}
+
+	s.mu.Lock()
+	c := s.conns[key]
+	s.mu.Unlock()
+	if c == nil {
+		if len(seg.payload) > 0 || seg.flags&tcpFlagFIN != 0 {
+			s.reset(seg)
+		}
+		return
+	}
+	for _, q := range s.receive(c, seg) {
+		s.startQuery(c, q)
+	}
+}
+
+// receive processes the segment seg of c and returns the DNS messages it
+// completed, counted as pending on c.
+func (s *tcpStack) receive(c *tcpConn, seg tcpSegment) (queries [][]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastActive = time.Now()
+	if len(seg.payload) == 0 && seg.flags&tcpFlagFIN == 0 {
+		// Pure ACK.
+		return nil
+	}
+	if seg.seq != c.rcvNext {
+		// Retransmission or out of order segment, acknowledge what we have.
+		s.sendLocked(c, tcpFlagACK, nil)
+		return nil
+	}
+	c.rcvNext += uint32(len(seg.payload))
+	c.buf = append(c.buf, seg.payload...)
+	for len(c.buf) >= 2 {
+		l := int(binary.BigEndian.Uint16(c.buf))
+		if len(c.buf) < 2+l {
+			break
+		}
+		q := make([]byte, l)
+		copy(q, c.buf[2:2+l])
+		c.buf = c.buf[2+l:]
+		c.pending++
+		queries = append(queries, q)
+	}
+	if len(c.buf) == 0 {
+		c.buf = nil
+	}
+	if seg.flags&tcpFlagFIN != 0 {
+		c.rcvNext++
+		c.finReceived = true
+		if c.pending == 0 {
+			s.closeLocked(c)
+			return nil
+		}
+	}
+	s.sendLocked(c, tcpFlagACK, nil)
+	return queries
+}
+
+// startQuery resolves the pending query q of c in a new goroutine once the
+// limiter gave it a slot, so a client sending many messages does not get a
+// goroutine waiting for a slot for each.
+func (s *tcpStack) startQuery(c *tcpConn, q []byte) {
+	if !s.limiter.acquire(s.stop) {
+		s.proxy.queryDropped(dnsmsg.ID(q))
+		s.queryDone(c)
+		return
+	}
+	s.inflight.Add(1)
+	go s.query(c, q)
+}
+
+// queryDone accounts the end of a pending query of c, closing c if it was
+// the last one after the client sent its FIN.
+func (s *tcpStack) queryDone(c *tcpConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending--
+	if c.finReceived && c.pending == 0 {
+		s.closeLocked(c)
+	}
+}
+
+// accept creates a new connection for the SYN segment seg and answers it.
+func (s *tcpStack) accept(seg tcpSegment) {
+	mss := seg.mss
+	if max := s.maxSegmentPayload(); mss > max {
+		mss = max
+	}
+	c := &tcpConn{
+		key:        tcpConnKey{addr: seg.src, port: seg.sport},
+		local:      seg.dst,
+		lport:      seg.dport,
+		mss:        mss,
+		sndNext:    rand.Uint32(),
+		rcvNext:    seg.seq + 1,
+		lastActive: time.Now(),
+	}
+	s.mu.Lock()
+	if s.conns == nil {
+		s.conns = map[tcpConnKey]*tcpConn{}
+	}
+	for k, c2 := range s.conns {
+		if time.Since(c2.lastActive) > tcpIdleTimeout {
+			delete(s.conns, k)
+		}
+	}
+	s.conns[c.key] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.sendLocked(c, tcpFlagSYN|tcpFlagACK, nil)
+	c.sndNext++ // SYN consumes one sequence number
+}
+
+func (s *tcpStack) remove(key tcpConnKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, key)
+}
+
+// closeLocked sends our FIN and forgets about c.
+func (s *tcpStack) closeLocked(c *tcpConn) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	s.sendLocked(c, tcpFlagFIN|tcpFlagACK, nil)
+	c.sndNext++
+	s.remove(c.key)
+}
+
+// resetAll sends a RST on the connections still open and forgets about them,
+// so their clients reconnect right away rather than waiting for responses
+// on a connection unknown to the next run.
+func (s *tcpStack) resetAll() {
+	s.mu.Lock()
+	conns := s.conns
+	s.conns = nil
+	s.mu.Unlock()
+	for _, c := range conns {
+		c.mu.Lock()
+		if !c.closed {
+			c.closed = true
+			s.sendLocked(c, tcpFlagRST|tcpFlagACK, nil)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// query resolves q, holding a slot of the limiter, and writes the response
+// back on c.
+func (s *tcpStack) query(c *tcpConn, q []byte) {
+	defer s.inflight.Done()
+	defer s.proxy.recoverPanic("tcp query")
+	defer s.queryDone(c)
+	defer s.limiter.release()
+	p := s.proxy
+	msgID := dnsmsg.ID(q)
+	qname := queryName(q)
+	p.logQuery(msgID, qname, q)
+	p.stats.incr(&p.stats.queries)
+	p.stats.observeQuery(len(q))
+	ctx, cancel := p.queryContext(s.ctx)
+	defer cancel()
+	var qi queryInfo
+	if p.LogProcessNames {
+		qi.process = processName(true, net.IP(c.key.addr[:]), c.key.port)
+	}
+	ctx = withQueryInfo(ctx, &qi)
+	msg, err := p.handle(ctx, q)
+	if err == nil {
+		err = checkResponseID(msg, msgID)
+	}
+	if err != nil {
+		if !p.resolveFailed(ctx, msgID, qname, err) {
+			return
+		}
+		msg = servfail(q)
+	}
+	p.stats.observeResponse(len(msg))
+	p.logResponse(ctx, q, msg, len(msg))
+	data := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(data, uint16(len(msg)))
+	copy(data[2:], msg)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > c.mss {
+			n = c.mss
+		}
+		if !s.sendLocked(c, tcpFlagPSH|tcpFlagACK, data[:n]) {
+			return
+		}
+		c.sndNext += uint32(n)
+		data = data[n:]
+	}
+}
+
+// maxSegmentPayload returns the maximum TCP payload fitting in a pool buffer.
+func (s *tcpStack) maxSegmentPayload() int {
+	return s.size - ipv4HeaderLen - tcpHeaderLen
+}
+
+// sendLocked sends a segment with the given flags and payload on c. It
+// returns false if the proxy is stopping.
+func (s *tcpStack) sendLocked(c *tcpConn, flags uint8, payload []byte) bool {
+	return s.send(c.local, c.key.addr, c.lport, c.key.port, c.sndNext, c.rcvNext, flags, payload)
+}
+
+// reset answers the segment seg received for an unknown connection with a
+// RST.
+func (s *tcpStack) reset(seg tcpSegment) {
+	if seg.flags&tcpFlagACK != 0 {
+		s.send(seg.dst, seg.src, seg.dport, seg.sport, seg.ack, 0, tcpFlagRST, nil)
+		return
+	}
+	ack := seg.seq + uint32(len(seg.payload))
+	if seg.flags&tcpFlagFIN != 0 {
+		ack++
+	}
+	s.send(seg.dst, seg.src, seg.dport, seg.sport, 0, ack, tcpFlagRST|tcpFlagACK, nil)
+}
+
+func (s *tcpStack) send(src, dst [4]byte, sport, dport uint16, seq, ack uint32, flags uint8, payload []byte) bool {
+	buf := s.bpool.get()
+	hlen := tcpHeaderLen
+	if flags&tcpFlagSYN != 0 {
+		hlen += 4 // MSS option
+	}
+	pkt := buf[:ipv4HeaderLen+hlen+len(payload)]
+	writeIPv4Header(pkt, src[:], dst[:], protoTCP, len(pkt))
+	tcp := pkt[ipv4HeaderLen:]
+	binary.BigEndian.PutUint16(tcp[0:], sport)
+	binary.BigEndian.PutUint16(tcp[2:], dport)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = uint8(hlen/4) << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535) // window
+	binary.BigEndian.PutUint16(tcp[16:], 0)     // checksum
+	binary.BigEndian.PutUint16(tcp[18:], 0)     // urgent pointer
+	if flags&tcpFlagSYN != 0 {
+		tcp[20], tcp[21] = 2, 4
+		binary.BigEndian.PutUint16(tcp[22:], uint16(s.maxSegmentPayload()))
+	}
+	copy(tcp[hlen:], payload)
+	sum := pseudoHeaderSum(src[:], dst[:], protoTCP, len(tcp))
+	binary.BigEndian.PutUint16(tcp[16:], checksum(sum, tcp))
+	select {
+	case s.out <- pkt:
+		return true
+	case <-s.stop:
+		s.bpool.put(buf)
+		return false
+	}
+}
@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nextdns/windows/resolver"
+)
+
+// leakState tracks whether dnsunleak is running.
+type leakState struct {
+	mu        sync.Mutex
+	gen       uint64 // incremented at each start
+	protected bool
+}
+
+// started returns the generation of a new dnsunleak process.
+func (l *leakState) started() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.gen++
+	return l.gen
+}
+
+// unleakRun controls the dnsunleak process of a run of the proxy, stopped
+// while suspended, like while a captive portal is bypassed or the proxy is
+// paused.
+type unleakRun struct {
+	mu      sync.Mutex
+	ctx     context.Context    // context of the run, nil if none
+	stop    context.CancelFunc // stops the current process, nil if none
+	suspend int                // number of reasons to keep it stopped
+}
+
+// runUnleak starts dnsunleak for the run of the proxy bound to ctx, unless
+// the proxy is paused. Failures are reported to ErrorLog.
+func (p *Proxy) runUnleak(ctx context.Context) error {
+	u := &p.unleakRun
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.ctx, u.stop, u.suspend = ctx, nil, 0
+	if p.Paused() {
+		u.suspend = 1
+		return nil
+	}
+	return p.startUnleakLocked()
+}
+
+func (p *Proxy) startUnleakLocked() error {
+	u := &p.unleakRun
+	ctx, cancel := context.WithCancel(u.ctx)
+	if err := p.unleak(ctx); err != nil {
+		cancel()
+		err = &UnleakError{Err: err}
+		p.logErr(err)
+		return err
+	}
+	u.stop = cancel
+	return nil
+}
+
+// suspendUnleak stops dnsunleak until resumeUnleak is called as many times.
+func (p *Proxy) suspendUnleak() {
+	p.unleakRun.mu.Lock()
+	defer p.unleakRun.mu.Unlock()
+	p.suspendUnleakLocked()
+}
+
+func (p *Proxy) suspendUnleakLocked() {
+	u := &p.unleakRun
+	u.suspend++
+	if u.stop != nil {
+		u.stop()
+		u.stop = nil
+	}
+}
+
+// resumeUnleak starts dnsunleak again if it is not suspended anymore.
+func (p *Proxy) resumeUnleak() error {
+	p.unleakRun.mu.Lock()
+	defer p.unleakRun.mu.Unlock()
+	return p.resumeUnleakLocked()
+}
+
+func (p *Proxy) resumeUnleakLocked() error {
+	u := &p.unleakRun
+	if u.suspend > 0 {
+		u.suspend--
+	}
+	if u.suspend > 0 || u.stop != nil || u.ctx == nil || u.ctx.Err() != nil {
+		return nil
+	}
+	return p.startUnleakLocked()
+}
+
+// setPaused records whether the proxy is paused, suspending dnsunleak while it
+// is. changed is false if it was already in this state.
+func (p *Proxy) setPaused(paused bool) (changed bool, err error) {
+	p.unleakRun.mu.Lock()
+	defer p.unleakRun.mu.Unlock()
+	if p.Paused() == paused {
+		return false, nil
+	}
+	if paused {
+		atomic.StoreInt32(&p.paused, 1)
+		p.suspendUnleakLocked()
+		return true, nil
+	}
+	atomic.StoreInt32(&p.paused, 0)
+	return true, p.resumeUnleakLocked()
+}
+
+// LeakProtected reports if dnsunleak is running, blocking the DNS queries
+// sent outside of the proxy.
+func (p *Proxy) LeakProtected() bool {
+	p.leak.mu.Lock()
+	defer p.leak.mu.Unlock()
+	return p.leak.protected
+}
+
+// setLeakProtected records whether the dnsunleak process of generation gen
+// runs, ignoring the previous processes, and reports the changes to
+// OnLeakProtectionChange.
+func (p *Proxy) setLeakProtected(gen uint64, protected bool) {
+	p.leak.mu.Lock()
+	if gen != p.leak.gen || p.leak.protected == protected {
+		p.leak.mu.Unlock()
+		return
+	}
+	p.leak.protected = protected
+	p.leak.mu.Unlock()
+	if p.OnLeakProtectionChange != nil {
+		p.OnLeakProtectionChange(protected)
+	}
+}
+
+// unleakArgs returns the dnsunleak arguments for the current configuration.
+// The addresses of the upstreams reached on a port blocked by dnsunleak and
+// the bootstrap IPs are always allowed so the proxy is not locked out of its
+// own upstreams. They are only allowed for the service executable so other
+// processes, like ones querying the system resolvers directly, remain blocked.
+func (p *Proxy) unleakArgs() []string {
+	var args []string
+	if p.StrictUnleak {
+		args = append(args, "-strict")
+	}
+	if ex, err := os.Executable(); err == nil {
+		args = append(args, "-app", ex)
+	}
+	seen := map[string]bool{}
+	allow := func(ip net.IP) {
+		if ip == nil || seen[ip.String()] {
+			return
+		}
+		seen[ip.String()] = true
+		args = append(args, "-allow", ip.String())
+	}
+	for _, ip := range p.Bootstrap {
+		allow(ip)
+	}
+	if u, ok := p.systemUpstream(); ok {
+		// Used by SystemDNSDomains and captive portal probes.
+		for _, ip := range upstreamIPs(u.resolver) {
+			allow(ip)
+		}
+	}
+	routes, ups := p.currentUpstreams()
+	for _, u := range routes {
+		for _, ip := range upstreamIPs(u.resolver) {
+			allow(ip)
+		}
+	}
+	for _, u := range ups {
+		for _, ip := range upstreamIPs(u.resolver) {
+			allow(ip)
+		}
+	}
+	return args
+}
+
+// upstreamIPs returns the IPs r connects to when they are known in advance.
+// DoH upstreams are ignored as dnsunleak does not block HTTPS.
+func upstreamIPs(r resolver.Resolver) []net.IP {
+	type serverAddrser interface {
+		ServerAddrs() []string
+	}
+	switch r := r.(type) {
+	case *resolver.Race:
+		var ips []net.IP
+		for _, r := range r.Resolvers {
+			ips = append(ips, upstreamIPs(r)...)
+		}
+		return ips
+	case serverAddrser:
+		var ips []net.IP
+		for _, addr := range r.ServerAddrs() {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				host = addr
+			}
+			if ip := net.ParseIP(host); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+		return ips
+	}
+	return nil
+}
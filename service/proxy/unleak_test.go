@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestUnleakArgs(t *testing.T) {
+	ex, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		p    *Proxy
+		want []string
+	}{
+		{
+			name: "default",
+			p:    &Proxy{},
+			want: []string{"-app", ex},
+		},
+		{
+			name: "strict",
+			p:    &Proxy{StrictUnleak: true},
+			want: []string{"-strict", "-app", ex},
+		},
+		{
+			name: "bootstrap",
+			p:    &Proxy{Bootstrap: []net.IP{net.ParseIP("45.90.28.0"), net.ParseIP("2a07:a8c0::")}},
+			want: []string{"-app", ex, "-allow", "45.90.28.0", "-allow", "2a07:a8c0::"},
+		},
+		{
+			name: "route",
+			p:    &Proxy{Routes: map[string]string{"corp.example": "10.0.0.53"}},
+			want: []string{"-app", ex, "-allow", "10.0.0.53"},
+		},
+		{
+			name: "fallbacks",
+			p: &Proxy{FallbackUpstreams: []string{
+				"tls://dns.example#192.0.2.1,2001:db8::1",
+				"https://dns.example/dns-query",
+				"192.0.2.2:5353",
+			}},
+			want: []string{"-app", ex, "-allow", "192.0.2.1", "-allow", "2001:db8::1", "-allow", "192.0.2.2"},
+		},
+		{
+			name: "system dns",
+			p:    &Proxy{systemDNS: []net.IP{net.ParseIP("192.168.1.1"), net.ParseIP("192.168.1.2")}},
+			want: []string{"-app", ex, "-allow", "192.168.1.1", "-allow", "192.168.1.2"},
+		},
+		{
+			name: "duplicates",
+			p: &Proxy{
+				StrictUnleak:      true,
+				Bootstrap:         []net.IP{net.ParseIP("192.0.2.1")},
+				Routes:            map[string]string{"corp.example": "192.0.2.1"},
+				FallbackUpstreams: []string{"192.0.2.1", "tls://dns.example#192.0.2.1"},
+			},
+			want: []string{"-strict", "-app", ex, "-allow", "192.0.2.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.p.setupUpstreams()
+			if got := tt.p.unleakArgs(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unleakArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nextdns/nextdns/resolver/endpoint"
+	"github.com/nextdns/windows/resolver"
+)
+
+const (
+	// upstreamTimeout is the time given to each upstream before trying the
+	// next one when fallback upstreams are configured.
+	upstreamTimeout = 2 * time.Second
+
+	// upstreamRetryPrimary is the time after which the primary upstream is
+	// tried again first after a fallback took over.
+	upstreamRetryPrimary = time.Minute
+
+	// upstreamRetries is the number of times a query failing with a
+	// transport error or a 5xx status is retried, waiting upstreamBackoff,
+	// doubled at each retry, in between.
+	upstreamRetries = 2
+	upstreamBackoff = 50 * time.Millisecond
+)
+
+// upstream is a named resolver queries can be sent to.
+type upstream struct {
+	name     string
+	resolver resolver.Resolver
+	breaker  *breaker // nil without BreakerThreshold
+}
+
+// upstreamSelector remembers the last working upstream so queries do not pay
+// the latency of a failing primary each time.
+type upstreamSelector struct {
+	mu        sync.Mutex
+	preferred int
+	since     time.Time
+}
+
+func (s *upstreamSelector) get() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.preferred != 0 && time.Since(s.since) > upstreamRetryPrimary {
+		s.preferred = 0
+	}
+	return s.preferred
+}
+
+// set records idx as working and returns true if it changed.
+func (s *upstreamSelector) set(idx int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.preferred == idx {
+		return false
+	}
+	s.preferred = idx
+	s.since = time.Now()
+	return true
+}
+
+// shouldFallback returns true if err justifies trying the next upstream.
+func shouldFallback(err error) bool {
+	if errors.Is(err, resolver.ErrResponseTooLarge) {
+		return false
+	}
+	var code resolver.StatusError
+	if errors.As(err, &code) {
+		return code >= 500
+	}
+	return true
+}
+
+// exchange sends the DNS query q upstream, retrying on transient errors
+// until ctx is done.
+func (p *Proxy) exchange(ctx context.Context, q []byte) ([]byte, error) {
+	backoff := upstreamBackoff
+	for retry := 0; ; retry++ {
+		msg, err := p.exchangeOnce(ctx, q)
+		if err == nil || retry == upstreamRetries || ctx.Err() != nil || !shouldFallback(err) {
+			return msg, err
+		}
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, err
+		}
+		backoff *= 2
+		p.logWarn(fmt.Sprintf("Retrying query after error: %v", err))
+	}
+}
+
+// exchangeOnce sends the DNS query q to the system DNS servers in Passthrough
+// mode, while paused or while a captive portal is bypassed, to the upstream
+// routed for its name if any, or to the preferred upstream, falling back to the
+// next upstreams on transport errors or 5xx responses. Upstreams with an open
+// circuit breaker are skipped, unless no other one is left to try.
+func (p *Proxy) exchangeOnce(ctx context.Context, q []byte) ([]byte, error) {
+	if p.Passthrough {
+		u, err := p.passthrough(q)
+		if err != nil {
+			return nil, err
+		}
+		return p.exchangeUpstream(ctx, u, q)
+	}
+	if p.captivePortalBypassed() || p.Paused() {
+		if u, ok := p.systemUpstream(); ok {
+			return p.exchangeUpstream(ctx, u, q)
+		}
+	}
+	routes, ups := p.currentUpstreams()
+	if u, ok := route(routes, q); ok {
+		return p.exchangeUpstream(ctx, u, q)
+	}
+	if len(ups) == 0 {
+		return nil, errors.New("no upstream")
+	}
+	if len(ups) == 1 {
+		msg, err := p.exchangeUpstream(ctx, ups[0], q)
+		p.connectionFailed(ctx, err)
+		return msg, err
+	}
+	start := p.selector.get()
+	var err error
+	for i := range ups {
+		idx := (start + i) % len(ups)
+		if i < len(ups)-1 && !breakerAllows(ups[idx]) {
+			continue
+		}
+		uctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+		var msg []byte
+		msg, err = p.exchangeUpstream(uctx, ups[idx], q)
+		cancel()
+		if ctx.Err() == nil && (err == nil || shouldFallback(err)) {
+			p.breakerRecord(ups[idx], err)
+		}
+		if err == nil {
+			if p.selector.set(idx) {
+				p.logInfo(fmt.Sprintf("Using upstream %s", ups[idx].name))
+			}
+			return msg, nil
+		}
+		if ctx.Err() != nil || !shouldFallback(err) {
+			break
+		}
+		err = fmt.Errorf("%s: %w", ups[idx].name, err)
+	}
+	p.connectionFailed(ctx, err)
+	return nil, err
+}
+
+func (p *Proxy) exchangeUpstream(ctx context.Context, u upstream, q []byte) ([]byte, error) {
+	addedOPT := false
+	if _, plain := u.resolver.(*resolver.DNS53); p.Pad && !plain {
+		q, addedOPT = padQuery(q)
+	}
+	orig, randomized := q, false
+	if p.RandomizeCase {
+		q, randomized = randomizeCase(q)
+	}
+	qi := queryInfoFrom(ctx)
+	var timing resolver.Timing
+	if qi != nil {
+		ctx = resolver.WithTiming(ctx, &timing)
+	}
+	start := time.Now()
+	msg, err := u.resolver.Resolve(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	latency := time.Since(start)
+	p.stats.observeLatency(latency)
+	p.stats.setLastExchange(start.Add(latency))
+	if qi != nil {
+		qi.upstream = u.name
+		qi.latency = latency
+		qi.timing = timing
+		// Read before the OPT record is removed.
+		qi.ede, _ = extendedError(msg)
+	}
+	if randomized {
+		if err := restoreCase(msg, q, orig); err != nil {
+			return nil, err
+		}
+	}
+	if p.MinTTL > 0 || p.MaxTTL > 0 {
+		clampTTLs(msg, uint32(p.MinTTL/time.Second), uint32(p.MaxTTL/time.Second))
+	}
+	if addedOPT {
+		// The client did not use EDNS, do not send it an OPT record.
+		msg = removeOPT(msg)
+	}
+	return msg, nil
+}
+
+// closeIdleConnections closes the idle connections of the upstreams
+// supporting it.
+func closeIdleConnections(routes map[string]upstream, ups []upstream) {
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+	for _, u := range routes {
+		if c, ok := u.resolver.(closeIdler); ok {
+			c.CloseIdleConnections()
+		}
+	}
+	for _, u := range ups {
+		if c, ok := u.resolver.(closeIdler); ok {
+			c.CloseIdleConnections()
+		}
+	}
+}
+
+// newDOH returns a DoH resolver for NextDNS selecting its endpoint with do.
+func (p *Proxy) newDOH(do func(ctx context.Context, action func(e endpoint.Endpoint) error) error) *resolver.DOH {
+	r := &resolver.DOH{Do: do}
+	p.setupDOH(r)
+	if len(p.PinnedSPKI) > 0 {
+		r.VerifyConnection = p.verifyPins
+	}
+	return r
+}
+
+// setupDOT configures the NextDNS DoT resolver r.
+func (p *Proxy) setupDOT(r *resolver.DOT) {
+	r.MaxIdleConns = p.MaxIdleConns
+	r.Pipeline = p.DOTPipeline
+	if p.OutboundInterface != "" {
+		r.Dialer = p.dialer()
+	}
+	if len(p.PinnedSPKI) > 0 {
+		r.VerifyConnection = p.verifyPins
+	}
+}
+
+// setupDOH sets the proxy hooks on the DoH resolver r.
+func (p *Proxy) setupDOH(r *resolver.DOH) {
+	r.Prepare = p.prepareRequest
+	r.ContentType = p.DOHContentType
+	r.UseGET = p.DOHGet
+	r.MaxResponseSize = p.MaxResponseSize
+	if p.proxyTrans != nil {
+		r.Transport = p.proxyTrans
+	}
+	if p.TraceConnections {
+		r.Trace = p.traceConnection
+	}
+}
+
+func (p *Proxy) traceConnection(ti resolver.TraceInfo) {
+	conn := "new connection"
+	if ti.Reused {
+		conn = fmt.Sprintf("reused connection (idle %dms)", ti.IdleTime/time.Millisecond)
+	}
+	tls := "no handshake"
+	if ti.Handshake {
+		tls = fmt.Sprintf("handshake resumed=%v alpn=%s", ti.TLSResumed, ti.ALPN)
+	}
+	p.logInfo(fmt.Sprintf("DoH query: %s, %s, %s", conn, tls, ti.Protocol))
+}
+
+// prepareRequest sets the configuration ID, the User-Agent and extra headers
+// on the DoH request req.
+func (p *Proxy) prepareRequest(req *http.Request) {
+	if req.URL.Path == "/" {
+		req.URL.Path = "/" + p.configID()
+	}
+	req.Header.Set("User-Agent", p.userAgent())
+	for name, hdrs := range p.extraHeaders() {
+		req.Header[name] = hdrs
+	}
+}
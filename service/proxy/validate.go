@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nextdns/windows/dnsmsg"
+)
+
+var (
+	errNotQuery = errors.New("not a query")
+
+	// errShortQuery is reported for messages too short to be answered.
+	errShortQuery = errors.New("shorter than a header")
+)
+
+// opcodeQuery is the opcode of standard queries, the only ones supported.
+const opcodeQuery = 0
+
+// validateQuery checks the header and the questions of the DNS query q so
+// malformed queries are not sent upstream.
+func validateQuery(q []byte) error {
+	if len(q) < dnsmsg.HeaderLen {
+		return errShortQuery
+	}
+	if q[2]&0x80 != 0 {
+		return errNotQuery
+	}
+	if opcode := q[2] >> 3 & 0xf; opcode != opcodeQuery {
+		return fmt.Errorf("unsupported opcode %d", opcode)
+	}
+	if dnsmsg.Count(q, dnsmsg.SectionAnswer) != 0 || dnsmsg.Count(q, dnsmsg.SectionAuthority) != 0 {
+		return errors.New("records in the answer or authority section")
+	}
+	switch dnsmsg.QuestionCount(q) {
+	case 0:
+		return errors.New("no question")
+	case 1:
+		if _, _, _, _, ok := dnsmsg.ParseQuestion(q); !ok {
+			return errors.New("malformed question")
+		}
+	default:
+		if _, ok := dnsmsg.Questions(q); !ok {
+			return errors.New("malformed questions")
+		}
+	}
+	return nil
+}
+
+// refuseInvalid returns the response to the query q found invalid with err:
+// REFUSED, or errDropped if q cannot be answered, like a response that could
+// otherwise bounce between the client and the proxy.
+func (p *Proxy) refuseInvalid(q []byte, err error) ([]byte, error) {
+	if p.logEnabled(LogLevelDebug) {
+		p.logDebug(fmt.Sprintf("Invalid query %x: %v", dnsmsg.ID(q), err))
+	}
+	if err == errShortQuery || err == errNotQuery {
+		return nil, errDropped
+	}
+	return reply(q, dnsmsg.RCodeRefused), nil
+}
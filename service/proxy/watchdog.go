@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/nextdns/windows/dnsmsg"
+)
+
+const (
+	// DefaultHealthCheckInterval defines the default value for Proxy
+	// HealthCheckInterval.
+	DefaultHealthCheckInterval = time.Minute
+
+	// DefaultHealthCheckFailures defines the default value for Proxy
+	// HealthCheckFailures.
+	DefaultHealthCheckFailures = 3
+
+	// healthCheckName is the name queried by the health check.
+	healthCheckName = "probe-test.dns.nextdns.io."
+)
+
+// errHealthCheckServFail is returned by healthCheck when the proxy answered
+// with a SERVFAIL.
+var errHealthCheckServFail = errors.New("SERVFAIL")
+
+// watchdog periodically sends a query to the proxy through the tun interface,
+// like any client would do, and restarts the proxy when it fails to answer
+// HealthCheckFailures times in a row. It returns when ctx is done.
+//
+// Only the failures showing the tun pipeline is stuck are counted: not the
+// SERVFAIL answers, which came back through the tun, nor the checks made
+// while the upstreams are down or while other responses were written to the
+// tun, so that the interface is not recreated over and over while offline.
+func (p *Proxy) watchdog(ctx context.Context, addr string) {
+	interval := p.HealthCheckInterval
+	if interval <= 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	maxFailures := p.HealthCheckFailures
+	if maxFailures <= 0 {
+		maxFailures = DefaultHealthCheckFailures
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	failures := 0
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		writes := atomic.LoadUint64(&p.stats.tunWrites)
+		down := p.upstreamsDown()
+		err := p.healthCheck(ctx, addr)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			failures = 0
+			p.stats.setLastHealthCheck(time.Now())
+			continue
+		}
+		if err == errHealthCheckServFail || down || p.upstreamsDown() ||
+			atomic.LoadUint64(&p.stats.tunWrites) != writes {
+			p.logDebug(fmt.Sprintf("health check failed with the tun pipeline working: %v", err))
+			continue
+		}
+		failures++
+		p.logErr(fmt.Errorf("health check failed (%d/%d): %v", failures, maxFailures, err))
+		if failures >= maxFailures {
+			p.logWarn("Health check failed, restarting")
+			p.restart()
+			return
+		}
+	}
+}
+
+// healthCheck sends a query to the DNS server at addr and waits for its
+// response.
+func (p *Proxy) healthCheck(ctx context.Context, addr string) error {
+	timeout := p.QueryTimeout
+	if timeout <= 0 {
+		timeout = DefaultQueryTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	id := uint16(rand.Uint32())
+	q := newQuery(id, healthCheckName, dnsmsg.TypeA)
+	msg := make([]byte, 512)
+	deadline, _ := ctx.Deadline()
+	c.SetDeadline(deadline)
+	if _, err := c.Write(q); err != nil {
+		return err
+	}
+	for {
+		n, err := c.Read(msg)
+		if err != nil {
+			return err
+		}
+		if checkResponseID(msg[:n], id) == nil {
+			msg = msg[:n]
+			break
+		}
+	}
+	if dnsmsg.RCode(msg) == dnsmsg.RCodeServFail {
+		return errHealthCheckServFail
+	}
+	return nil
+}
+
+// restart stops the running proxy loop so it gets started again with a new tun
+// and new upstreams.
+func (p *Proxy) restart() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stateLocked() != StateStarted {
+		return
+	}
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+	if p.tun != nil {
+		p.tun.Close()
+		p.tun = nil
+	}
+}
@@ -0,0 +1,65 @@
+package resolver
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheControl is the HTTP caching metadata of a DoH response, which bounds
+// the time the response can be cached for (RFC 8484 section 5.1).
+type CacheControl struct {
+	// MaxAge is the remaining freshness lifetime of the response, its
+	// Cache-Control max-age minus its Age. It is zero for responses that
+	// must not be cached. Valid only if Set is true.
+	MaxAge time.Duration
+
+	// Set reports if the response had a freshness lifetime.
+	Set bool
+}
+
+type cacheControlKey struct{}
+
+// WithCacheControl returns a context collecting the HTTP caching metadata of
+// the response to the query resolved with it in cc. Only DoH resolvers fill
+// cc.
+func WithCacheControl(ctx context.Context, cc *CacheControl) context.Context {
+	return context.WithValue(ctx, cacheControlKey{}, cc)
+}
+
+// cacheControlFrom returns the CacheControl attached to ctx, or nil.
+func cacheControlFrom(ctx context.Context) *CacheControl {
+	cc, _ := ctx.Value(cacheControlKey{}).(*CacheControl)
+	return cc
+}
+
+// parseCacheControl returns the caching metadata of the response headers h.
+func parseCacheControl(h http.Header) CacheControl {
+	var cc CacheControl
+	for _, v := range h["Cache-Control"] {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.ToLower(strings.TrimSpace(d))
+			switch {
+			case d == "no-store" || d == "no-cache":
+				return CacheControl{Set: true}
+			case strings.HasPrefix(d, "max-age="):
+				sec, err := strconv.ParseUint(strings.Trim(d[len("max-age="):], `"`), 10, 32)
+				if err != nil {
+					continue
+				}
+				cc = CacheControl{MaxAge: time.Duration(sec) * time.Second, Set: true}
+			}
+		}
+	}
+	if !cc.Set {
+		return cc
+	}
+	if age, err := strconv.ParseUint(h.Get("Age"), 10, 32); err == nil {
+		if cc.MaxAge -= time.Duration(age) * time.Second; cc.MaxAge < 0 {
+			cc.MaxAge = 0
+		}
+	}
+	return cc
+}
@@ -0,0 +1,129 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// happyEyeballsDelay is the delay before trying the next address while the
+// connection to the previous one is pending, the Connection Attempt Delay of
+// RFC 8305.
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// DialAddrs connects to the first of the host:port addresses addrs accepting
+// the connection with d, or a zero net.Dialer if nil. The IPv6 and IPv4
+// addresses are interleaved, IPv6 first, and tried happyEyeballsDelay apart
+// (RFC 8305) so IPv6 is used when it works while a broken family does not
+// delay the connection by a full dial timeout. A failing address makes the
+// next one start right away.
+func DialAddrs(ctx context.Context, d *net.Dialer, network string, addrs []string) (net.Conn, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no address")
+	}
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	if len(addrs) == 1 {
+		return d.DialContext(ctx, network, addrs[0])
+	}
+	addrs = interleaveFamilies(addrs)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	// Buffered so the slower attempts can always deliver their connection
+	// and exit.
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			c, err := d.DialContext(ctx, network, addr)
+			results <- result{c, err}
+		}()
+	}
+	// closeLosers closes the connections established after the winner.
+	closeLosers := func(n int) {
+		go func() {
+			for ; n > 0; n-- {
+				if res := <-results; res.c != nil {
+					res.c.Close()
+				}
+			}
+		}()
+	}
+	start()
+	t := time.NewTimer(happyEyeballsDelay)
+	defer t.Stop()
+	var err error
+	for {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				closeLosers(pending)
+				return res.c, nil
+			}
+			err = res.err
+			if next < len(addrs) {
+				start()
+				if !t.Stop() {
+					<-t.C
+				}
+				t.Reset(happyEyeballsDelay)
+			} else if pending == 0 {
+				return nil, err
+			}
+		case <-t.C:
+			if next < len(addrs) {
+				start()
+				t.Reset(happyEyeballsDelay)
+			}
+		case <-ctx.Done():
+			closeLosers(pending)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// interleaveFamilies returns addrs with the IPv6 and IPv4 addresses
+// alternating, IPv6 first, keeping the order within each family. Host names
+// go with the IPv4 addresses.
+func interleaveFamilies(addrs []string) []string {
+	var v6, v4 []string
+	for _, addr := range addrs {
+		if isIPv6Addr(addr) {
+			v6 = append(v6, addr)
+		} else {
+			v4 = append(v4, addr)
+		}
+	}
+	res := make([]string, 0, len(addrs))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			res = append(res, v6[i])
+		}
+		if i < len(v4) {
+			res = append(res, v4[i])
+		}
+	}
+	return res
+}
+
+// isIPv6Addr reports if the host of the host:port address addr is an IPv6
+// address.
+func isIPv6Addr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
@@ -0,0 +1,113 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInterleaveFamilies(t *testing.T) {
+	tests := []struct {
+		name  string
+		addrs []string
+		want  []string
+	}{
+		{"ipv4 only", []string{"192.0.2.1:53", "192.0.2.2:53"}, []string{"192.0.2.1:53", "192.0.2.2:53"}},
+		{"ipv6 first", []string{"192.0.2.1:53", "[2001:db8::1]:53"}, []string{"[2001:db8::1]:53", "192.0.2.1:53"}},
+		{"alternating", []string{"192.0.2.1:53", "192.0.2.2:53", "192.0.2.3:53", "[2001:db8::1]:53", "[2001:db8::2]:53"},
+			[]string{"[2001:db8::1]:53", "192.0.2.1:53", "[2001:db8::2]:53", "192.0.2.2:53", "192.0.2.3:53"}},
+		{"host name", []string{"dns.example:53", "[2001:db8::1]:53"}, []string{"[2001:db8::1]:53", "dns.example:53"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := interleaveFamilies(tt.addrs)
+			if len(got) != len(tt.want) {
+				t.Fatalf("interleaveFamilies() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("interleaveFamilies() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// listen returns a local listener closed at the end of the test.
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// slowDialer returns a dialer taking delay before connecting to addr.
+func slowDialer(addr string, delay time.Duration) *net.Dialer {
+	return &net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		if address == addr {
+			time.Sleep(delay)
+		}
+		return nil
+	}}
+}
+
+func TestDialAddrsSlow(t *testing.T) {
+	slow, fast := listen(t), listen(t)
+	d := slowDialer(slow.Addr().String(), time.Second)
+	start := time.Now()
+	c, err := DialAddrs(context.Background(), d, "tcp", []string{slow.Addr().String(), fast.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	elapsed := time.Since(start)
+	if c.RemoteAddr().String() != fast.Addr().String() {
+		t.Errorf("connected to %v, want %v", c.RemoteAddr(), fast.Addr())
+	}
+	if elapsed < happyEyeballsDelay || elapsed >= time.Second {
+		t.Errorf("connected after %v, want the second address tried after %v", elapsed, happyEyeballsDelay)
+	}
+
+	// The connection to the slow address, established after the winner, is
+	// closed.
+	loser, err := slow.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loser.Close()
+	loser.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var b [1]byte
+	if _, err := loser.Read(b[:]); err == nil {
+		t.Error("losing connection not closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("losing connection left open")
+	}
+}
+
+func TestDialAddrsFailure(t *testing.T) {
+	// A closed listener gives an address refusing the connections.
+	refused := listen(t)
+	refused.Close()
+	l := listen(t)
+	start := time.Now()
+	c, err := DialAddrs(context.Background(), nil, "tcp", []string{refused.Addr().String(), l.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.RemoteAddr().String() != l.Addr().String() {
+		t.Errorf("connected to %v, want %v", c.RemoteAddr(), l.Addr())
+	}
+	if elapsed := time.Since(start); elapsed >= happyEyeballsDelay {
+		t.Errorf("connected after %v, want the next address tried right away", elapsed)
+	}
+
+	if _, err := DialAddrs(context.Background(), nil, "tcp", []string{refused.Addr().String(), refused.Addr().String()}); err == nil {
+		t.Error("DialAddrs() succeeded with no address accepting the connection")
+	}
+}
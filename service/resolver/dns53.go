@@ -0,0 +1,79 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// DNS53 is a plain DNS resolver. Queries are sent over UDP and retried over TCP
+// when the response is truncated or UDP fails, like when blocked by the DNS
+// leak protection firewall rules.
+type DNS53 struct {
+	// Addr is the host:port address of the server.
+	Addr string
+
+	// Dialer is the dialer used to open connections. If nil, a zero
+	// net.Dialer is used.
+	Dialer *net.Dialer
+}
+
+// ServerAddrs returns the address of the server.
+func (r *DNS53) ServerAddrs() []string {
+	return []string{r.Addr}
+}
+
+// Resolve implements the Resolver interface.
+func (r *DNS53) Resolve(ctx context.Context, q []byte) ([]byte, error) {
+	if len(q) < 2 {
+		return nil, errors.New("query too short")
+	}
+	d := r.Dialer
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	msg, err := r.resolveUDP(ctx, d, q)
+	if err == nil && msg[2]&0x2 == 0 {
+		return msg, nil
+	}
+	if ctx.Err() != nil {
+		return nil, &TransportError{Err: ctx.Err()}
+	}
+
+	// Truncated or failed, retry over TCP.
+	c, err := d.DialContext(ctx, "tcp", r.Addr)
+	if err != nil {
+		return nil, &TransportError{Err: err}
+	}
+	defer c.Close()
+	if msg, err = exchangeStream(ctx, c, q); err != nil {
+		return nil, &TransportError{Err: err}
+	}
+	return msg, nil
+}
+
+func (r *DNS53) resolveUDP(ctx context.Context, d *net.Dialer, q []byte) (msg []byte, err error) {
+	c, err := d.DialContext(ctx, "udp", r.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	err = withContext(ctx, c, func() error {
+		if _, err := c.Write(q); err != nil {
+			return err
+		}
+		buf := make([]byte, maxMessageSize)
+		for {
+			n, err := c.Read(buf)
+			if err != nil {
+				return err
+			}
+			// Ignore stray datagrams not answering our query.
+			if n >= 3 && buf[0] == q[0] && buf[1] == q[1] {
+				msg = buf[:n]
+				return nil
+			}
+		}
+	})
+	return msg, err
+}
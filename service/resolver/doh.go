@@ -0,0 +1,227 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+
+	"github.com/nextdns/nextdns/resolver/endpoint"
+)
+
+// DefaultDOHContentType defines the default value for DOH ContentType, the
+// media type defined by RFC 8484.
+const DefaultDOHContentType = "application/dns-message"
+
+// ErrResponseTooLarge is returned when a DoH response exceeds the DOH
+// MaxResponseSize.
+var ErrResponseTooLarge = errors.New("response too large")
+
+// DOH is a DNS over HTTPS (RFC 8484) resolver. Queries are sent using the POST
+// method, or GET when UseGET is set.
+type DOH struct {
+	// Do calls action with the endpoint to send the query to, like
+	// endpoint.Manager.Do does.
+	Do func(ctx context.Context, action func(e endpoint.Endpoint) error) error
+
+	// Prepare is an optional function called to modify each request before it
+	// is sent. The request URL path is the one of the endpoint, and "/" if the
+	// endpoint has none.
+	Prepare func(req *http.Request)
+
+	// Trace is an optional function called after each successful round trip
+	// with information about the connection used.
+	Trace func(TraceInfo)
+
+	// Transport is an optional transport used instead of the one of the
+	// endpoint, like to go through an HTTP proxy. Requests are then sent to
+	// the endpoint hostname as resolved by Transport, ignoring the endpoint
+	// bootstrap IPs.
+	Transport http.RoundTripper
+
+	// VerifyConnection is an optional function called with the TLS state of
+	// the connection used by each request before it is sent. If it returns an
+	// error, the connection is closed and the query fails with this error.
+	VerifyConnection func(tls.ConnectionState) error
+
+	// ContentType is the media type of the queries, also sent as the
+	// accepted type of the responses. Some legacy servers only support
+	// application/dns-udpwireformat or application/dns-packet. If empty,
+	// DefaultDOHContentType is used.
+	ContentType string
+
+	// UseGET makes the queries sent with the GET method, the query being
+	// base64url encoded in the dns parameter, for networks breaking POST
+	// requests. The message ID is set to 0 so the responses can be cached by
+	// HTTP intermediaries (RFC 8484 section 4.1).
+	UseGET bool
+
+	// MaxResponseSize is the maximum size of a response body. Larger
+	// responses are not read and fail with ErrResponseTooLarge. If zero or
+	// above the maximum DNS message size, 65535 is used.
+	MaxResponseSize int
+}
+
+// TraceInfo describes the connection used by a DoH round trip.
+type TraceInfo struct {
+	// Reused reports if the connection was previously used for another
+	// request. IdleTime is how long it was idle before, if it was.
+	Reused   bool
+	IdleTime time.Duration
+
+	// Handshake reports if a TLS handshake was performed for this request,
+	// and TLSResumed if that handshake resumed a previous session.
+	Handshake  bool
+	TLSResumed bool
+
+	// ALPN is the protocol negotiated during the TLS handshake, if one was
+	// performed, and Protocol the protocol of the response.
+	ALPN     string
+	Protocol string
+}
+
+// Resolve implements the Resolver interface.
+func (r *DOH) Resolve(ctx context.Context, q []byte) (msg []byte, err error) {
+	if len(q) < 2 {
+		return nil, errors.New("query too short")
+	}
+	err = r.Do(ctx, func(e endpoint.Endpoint) error {
+		rt, ok := e.(*endpoint.DOHEndpoint)
+		if !ok {
+			return fmt.Errorf("%T :unsupported endpoint", e)
+		}
+		path := rt.Path
+		if path == "" {
+			path = "/"
+		}
+		var rtt http.RoundTripper = rt
+		host := "server" // replaced by the endpoint transport
+		if r.Transport != nil {
+			rtt = r.Transport
+			host = rt.Hostname
+		}
+		ct := r.ContentType
+		if ct == "" {
+			ct = DefaultDOHContentType
+		}
+		var req *http.Request
+		var err error
+		if r.UseGET {
+			gq := append([]byte(nil), q...)
+			gq[0], gq[1] = 0, 0
+			u := "https://" + host + path + "?dns=" + base64.RawURLEncoding.EncodeToString(gq)
+			req, err = http.NewRequestWithContext(ctx, "GET", u, nil)
+		} else {
+			req, err = http.NewRequestWithContext(ctx, "POST", "https://"+host+path, bytes.NewReader(q))
+		}
+		if err != nil {
+			return err
+		}
+		if !r.UseGET {
+			req.Header.Set("Content-Type", ct)
+		}
+		req.Header.Set("Accept", ct)
+		if r.Prepare != nil {
+			r.Prepare(req)
+		}
+		var ti TraceInfo
+		var verifyErr error
+		if r.Trace != nil || r.VerifyConnection != nil {
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+				GotConn: func(info httptrace.GotConnInfo) {
+					ti.Reused = info.Reused
+					ti.IdleTime = info.IdleTime
+					if r.VerifyConnection != nil {
+						verifyErr = verifyConn(info.Conn, r.VerifyConnection)
+					}
+				},
+				TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
+					if err == nil {
+						ti.Handshake = true
+						ti.TLSResumed = cs.DidResume
+						ti.ALPN = cs.NegotiatedProtocol
+					}
+				},
+			}))
+		}
+		start := time.Now()
+		res, err := rtt.RoundTrip(req)
+		roundTrip := time.Since(start)
+		if verifyErr != nil {
+			if err == nil {
+				res.Body.Close()
+			}
+			return &TransportError{Err: verifyErr}
+		}
+		if err != nil {
+			return &TransportError{Err: err}
+		}
+		defer res.Body.Close()
+		if r.Trace != nil {
+			ti.Protocol = res.Proto
+			r.Trace(ti)
+		}
+		if res.StatusCode != http.StatusOK {
+			return StatusError(res.StatusCode)
+		}
+		max := r.MaxResponseSize
+		if max <= 0 || max > maxMessageSize {
+			max = maxMessageSize
+		}
+		if res.ContentLength > int64(max) {
+			return fmt.Errorf("%w: %d bytes", ErrResponseTooLarge, res.ContentLength)
+		}
+		start = time.Now()
+		msg, err = ioutil.ReadAll(io.LimitReader(res.Body, int64(max)+1))
+		if err != nil {
+			return &TransportError{Err: err}
+		}
+		if len(msg) > max {
+			return fmt.Errorf("%w: more than %d bytes", ErrResponseTooLarge, max)
+		}
+		if r.UseGET && len(msg) >= 2 {
+			msg[0], msg[1] = q[0], q[1]
+		}
+		if t := timingFrom(ctx); t != nil {
+			t.RoundTrip = roundTrip
+			t.Read = time.Since(start)
+		}
+		if cc := cacheControlFrom(ctx); cc != nil {
+			*cc = parseCacheControl(res.Header)
+		}
+		return nil
+	})
+	return msg, err
+}
+
+// CloseIdleConnections closes the idle connections of Transport, if it
+// supports it. The connections of the endpoints are managed by their
+// endpoint.Manager.
+func (r *DOH) CloseIdleConnections() {
+	if c, ok := r.Transport.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// verifyConn calls verify with the state of the TLS connection c, closing c
+// if c is not a TLS connection or verify fails.
+func verifyConn(c net.Conn, verify func(tls.ConnectionState) error) error {
+	tc, ok := c.(*tls.Conn)
+	if !ok {
+		c.Close()
+		return fmt.Errorf("%T: cannot verify connection", c)
+	}
+	if err := verify(tc.ConnectionState()); err != nil {
+		tc.Close()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// doqNoError is the DOQ_NO_ERROR error code of RFC 9250.
+const doqNoError = 0x0
+
+// quicKeepAlivePeriod is the interval of the keep-alive packets sent on idle
+// QUIC connections so they are not dropped by NATs and firewalls.
+const quicKeepAlivePeriod = 15 * time.Second
+
+// DOQ is a DNS over QUIC (RFC 9250) resolver. A single QUIC connection is kept
+// open and each query is sent on its own stream.
+//
+// As client connection migration is not supported, a new connection is opened
+// when the current one fails, like after a network change.
+type DOQ struct {
+	// ServerName is the name used to verify the server certificate.
+	ServerName string
+
+	// Addrs is the list of host:port addresses of the server, tried in order
+	// when connecting.
+	Addrs []string
+
+	mu   sync.Mutex
+	conn quic.Connection
+}
+
+func newDOQ(host string, addrs []string) (Resolver, error) {
+	return &DOQ{ServerName: host, Addrs: addrs}, nil
+}
+
+// ServerAddrs returns the addresses of the server.
+func (r *DOQ) ServerAddrs() []string {
+	return r.Addrs
+}
+
+// Resolve implements the Resolver interface.
+func (r *DOQ) Resolve(ctx context.Context, q []byte) ([]byte, error) {
+	if len(q) < 2 || len(q) > maxMessageSize {
+		return nil, errors.New("invalid query size")
+	}
+	for {
+		conn, reused, err := r.connection(ctx)
+		if err != nil {
+			return nil, &TransportError{Err: err}
+		}
+		msg, err := r.exchange(ctx, conn, q)
+		if err != nil {
+			r.discard(conn)
+			if reused && ctx.Err() == nil {
+				// The connection may be broken by a network change, try
+				// again on a new one.
+				continue
+			}
+			return nil, &TransportError{Err: err}
+		}
+		return msg, nil
+	}
+}
+
+func (r *DOQ) exchange(ctx context.Context, conn quic.Connection, q []byte) ([]byte, error) {
+	st, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// The message ID must be 0 over DoQ, restore the one of the query in the
+	// response.
+	id := binary.BigEndian.Uint16(q)
+	b := make([]byte, 2+len(q))
+	binary.BigEndian.PutUint16(b, uint16(len(q)))
+	copy(b[2:], q)
+	binary.BigEndian.PutUint16(b[2:], 0)
+	if d, ok := ctx.Deadline(); ok {
+		_ = st.SetDeadline(d)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			st.CancelRead(doqNoError)
+			st.CancelWrite(doqNoError)
+		case <-done:
+		}
+	}()
+	if _, err := st.Write(b); err != nil {
+		return nil, err
+	}
+	// Closing the stream signals the end of the query.
+	if err := st.Close(); err != nil {
+		return nil, err
+	}
+	res, err := ioutil.ReadAll(io.LimitReader(st, 2+maxMessageSize))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if len(res) < 2 || int(binary.BigEndian.Uint16(res)) != len(res)-2 {
+		return nil, errors.New("invalid response length")
+	}
+	msg := res[2:]
+	if len(msg) >= 2 {
+		binary.BigEndian.PutUint16(msg, id)
+	}
+	return msg, nil
+}
+
+// connection returns the current connection, or opens a new one.
+func (r *DOQ) connection(ctx context.Context) (conn quic.Connection, reused bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn != nil {
+		select {
+		case <-r.conn.Context().Done():
+			// Connection closed.
+			r.conn = nil
+		default:
+			return r.conn, true, nil
+		}
+	}
+	if len(r.Addrs) == 0 {
+		return nil, false, errors.New("no address")
+	}
+	tlsConf := &tls.Config{
+		ServerName: r.ServerName,
+		NextProtos: []string{"doq"},
+	}
+	conf := &quic.Config{
+		HandshakeIdleTimeout: 3 * time.Second,
+		KeepAlivePeriod:      quicKeepAlivePeriod,
+	}
+	for _, addr := range r.Addrs {
+		if conn, err = quic.DialAddr(ctx, addr, tlsConf, conf); err == nil {
+			r.conn = conn
+			return conn, false, nil
+		}
+	}
+	return nil, false, err
+}
+
+// discard closes conn if it is still the current connection.
+func (r *DOQ) discard(conn quic.Connection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == conn {
+		r.conn = nil
+	}
+	_ = conn.CloseWithError(doqNoError, "")
+}
+
+// CloseIdleConnections closes the current connection. Queries in flight on it
+// fail.
+func (r *DOQ) CloseIdleConnections() {
+	r.mu.Lock()
+	conn := r.conn
+	r.conn = nil
+	r.mu.Unlock()
+	if conn != nil {
+		_ = conn.CloseWithError(doqNoError, "")
+	}
+}
@@ -0,0 +1,221 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDOTMaxIdleConns defines the default value for DOT MaxIdleConns.
+	DefaultDOTMaxIdleConns = 4
+
+	// dotIdleTimeout is the time after which an idle connection is closed.
+	// Servers commonly close idle connections after a few seconds, so there
+	// is no point keeping them longer.
+	dotIdleTimeout = 30 * time.Second
+)
+
+// DOT is a DNS over TLS (RFC 7858) resolver. Connections are kept open and
+// reused for the following queries, one query at a time per connection, or
+// shared by concurrent queries with Pipeline.
+type DOT struct {
+	// ServerName is the name used to verify the server certificate.
+	ServerName string
+
+	// Addrs is the list of host:port addresses of the server, tried in order
+	// when connecting.
+	Addrs []string
+
+	// Dialer is the dialer used to open connections. If nil, a zero
+	// net.Dialer is used.
+	Dialer *net.Dialer
+
+	// MaxIdleConns is the maximum number of idle connections kept open. If
+	// zero, DefaultDOTMaxIdleConns is used.
+	MaxIdleConns int
+
+	// VerifyConnection is an optional function called with the TLS state of
+	// each new connection. If it returns an error, the connection is closed
+	// and the query fails with this error.
+	VerifyConnection func(tls.ConnectionState) error
+
+	// Pipeline sends the concurrent queries on a single connection without
+	// waiting for the previous responses, which servers may send in any
+	// order (RFC 7766). The query IDs are rewritten to connection-unique
+	// ones so the ones chosen by the clients cannot collide, and restored in
+	// the responses. MaxIdleConns is not used.
+	Pipeline bool
+
+	mu   sync.Mutex
+	idle []*dotConn
+	pipe *dotPipe // shared connection with Pipeline
+}
+
+type dotConn struct {
+	net.Conn
+	lastUsed time.Time
+}
+
+// ServerAddrs returns the addresses of the server.
+func (r *DOT) ServerAddrs() []string {
+	return r.Addrs
+}
+
+// Resolve implements the Resolver interface.
+func (r *DOT) Resolve(ctx context.Context, q []byte) ([]byte, error) {
+	if len(q) > maxMessageSize {
+		return nil, errors.New("query too large")
+	}
+	if r.Pipeline {
+		if len(q) < 2 {
+			return nil, errors.New("query too short")
+		}
+		return r.resolvePipelined(ctx, q)
+	}
+	for {
+		c, reused, err := r.conn(ctx)
+		if err != nil {
+			return nil, &TransportError{Err: err}
+		}
+		msg, err := exchangeStream(ctx, c, q)
+		if err != nil {
+			c.Close()
+			if reused && ctx.Err() == nil {
+				// The server may have closed the idle connection, try again
+				// with another one.
+				continue
+			}
+			return nil, &TransportError{Err: err}
+		}
+		r.release(c)
+		return msg, nil
+	}
+}
+
+// conn returns an idle connection if any, or a new one.
+func (r *DOT) conn(ctx context.Context) (c *dotConn, reused bool, err error) {
+	r.mu.Lock()
+	for len(r.idle) > 0 {
+		c = r.idle[len(r.idle)-1]
+		r.idle = r.idle[:len(r.idle)-1]
+		if time.Since(c.lastUsed) < dotIdleTimeout {
+			r.mu.Unlock()
+			return c, true, nil
+		}
+		c.Close()
+	}
+	r.mu.Unlock()
+	c, err = r.dial(ctx)
+	return c, false, err
+}
+
+// release puts c back in the idle pool, or closes it if the pool is full.
+func (r *DOT) release(c *dotConn) {
+	max := r.MaxIdleConns
+	if max <= 0 {
+		max = DefaultDOTMaxIdleConns
+	}
+	c.lastUsed = time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.idle) >= max {
+		c.Close()
+		return
+	}
+	r.idle = append(r.idle, c)
+}
+
+// CloseIdleConnections closes the connections kept open for reuse.
+// With Pipeline, the shared connection is closed, the queries in flight on it
+// being retried on a new one.
+func (r *DOT) CloseIdleConnections() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range r.idle {
+		c.Close()
+	}
+	r.idle = nil
+	if r.pipe != nil {
+		r.pipe.close(errPipeClosed)
+		r.pipe = nil
+	}
+}
+
+func (r *DOT) dial(ctx context.Context) (*dotConn, error) {
+	d := r.Dialer
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	if len(r.Addrs) == 0 {
+		return nil, errors.New("no address")
+	}
+	var err error
+	for _, addr := range r.Addrs {
+		var nc net.Conn
+		if nc, err = d.DialContext(ctx, "tcp", addr); err != nil {
+			continue
+		}
+		tc := tls.Client(nc, &tls.Config{ServerName: r.ServerName})
+		err = withContext(ctx, tc, tc.Handshake)
+		if err != nil {
+			tc.Close()
+			continue
+		}
+		if r.VerifyConnection != nil {
+			if err = verifyConn(tc, r.VerifyConnection); err != nil {
+				return nil, err
+			}
+		}
+		return &dotConn{Conn: tc}, nil
+	}
+	return nil, err
+}
+
+// exchangeStream sends q on the stream c using the 2 bytes length framing and
+// reads the response.
+func exchangeStream(ctx context.Context, c net.Conn, q []byte) (msg []byte, err error) {
+	err = withContext(ctx, c, func() error {
+		b := make([]byte, 2+len(q))
+		binary.BigEndian.PutUint16(b, uint16(len(q)))
+		copy(b[2:], q)
+		if _, err := c.Write(b); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, b[:2]); err != nil {
+			return err
+		}
+		msg = make([]byte, binary.BigEndian.Uint16(b))
+		_, err := io.ReadFull(c, msg)
+		return err
+	})
+	return msg, err
+}
+
+// withContext runs fn, making I/O on c fail as soon as ctx is done.
+func withContext(ctx context.Context, c net.Conn, fn func() error) error {
+	if d, ok := ctx.Deadline(); ok {
+		c.SetDeadline(d)
+	} else {
+		c.SetDeadline(time.Time{})
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	err := fn()
+	if ctxErr := ctx.Err(); ctxErr != nil && err != nil {
+		return ctxErr
+	}
+	return err
+}
@@ -0,0 +1,174 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// errPipeClosed is returned by the queries in flight on a pipelined DoT
+// connection closed by CloseIdleConnections.
+var errPipeClosed = errors.New("connection closed")
+
+// dotPipe is a DoT connection shared by concurrent queries. Their IDs are
+// rewritten with an idTable and the responses dispatched as they come.
+type dotPipe struct {
+	c   *dotConn
+	ids idTable
+	wmu sync.Mutex // serializes the writes
+
+	done chan struct{} // closed when the connection failed
+	err  error         // set before done is closed
+
+	mu       sync.Mutex
+	lastUsed time.Time
+	closed   bool
+}
+
+func newDOTPipe(c *dotConn) *dotPipe {
+	// Clear the handshake deadline, the reads wait for the responses of any
+	// query.
+	c.SetDeadline(time.Time{})
+	pc := &dotPipe{c: c, done: make(chan struct{}), lastUsed: time.Now()}
+	go pc.readLoop()
+	return pc
+}
+
+// readLoop dispatches the responses read from the connection until it fails.
+func (pc *dotPipe) readLoop() {
+	var hdr [2]byte
+	for {
+		if _, err := io.ReadFull(pc.c, hdr[:]); err != nil {
+			pc.close(err)
+			return
+		}
+		msg := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+		if _, err := io.ReadFull(pc.c, msg); err != nil {
+			pc.close(err)
+			return
+		}
+		// Responses to queries that timed out are dropped.
+		pc.ids.dispatch(msg)
+	}
+}
+
+// close closes the connection, failing the queries in flight with err.
+func (pc *dotPipe) close(err error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.closed {
+		return
+	}
+	pc.closed = true
+	pc.err = err
+	pc.c.Close()
+	close(pc.done)
+}
+
+// usable reports if new queries can be sent on the connection.
+func (pc *dotPipe) usable() bool {
+	pc.mu.Lock()
+	closed, idle := pc.closed, time.Since(pc.lastUsed) >= dotIdleTimeout
+	pc.mu.Unlock()
+	if !closed && idle && pc.ids.inflight() == 0 {
+		// Likely closed by the server already.
+		pc.close(errPipeClosed)
+		return false
+	}
+	return !closed
+}
+
+// exchange sends q with a connection-unique ID and waits for its response,
+// returned with the ID of q.
+func (pc *dotPipe) exchange(ctx context.Context, q []byte) ([]byte, error) {
+	id, ch, err := pc.ids.add(binary.BigEndian.Uint16(q))
+	if err != nil {
+		return nil, err
+	}
+	defer pc.ids.remove(id)
+	pc.mu.Lock()
+	pc.lastUsed = time.Now()
+	pc.mu.Unlock()
+
+	b := make([]byte, 2+len(q))
+	binary.BigEndian.PutUint16(b, uint16(len(q)))
+	copy(b[2:], q)
+	binary.BigEndian.PutUint16(b[2:], id)
+	pc.wmu.Lock()
+	d, _ := ctx.Deadline()
+	pc.c.SetWriteDeadline(d)
+	_, err = pc.c.Write(b)
+	pc.wmu.Unlock()
+	if err != nil {
+		// A partial write breaks the framing for all the queries.
+		pc.close(err)
+		return nil, err
+	}
+	select {
+	case msg := <-ch:
+		return msg, nil
+	case <-pc.done:
+		// The response may have been dispatched right before the failure.
+		select {
+		case msg := <-ch:
+			return msg, nil
+		default:
+		}
+		return nil, pc.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resolvePipelined resolves q on the shared connection, opening a new one
+// when there is none or it failed.
+func (r *DOT) resolvePipelined(ctx context.Context, q []byte) ([]byte, error) {
+	for {
+		pc, reused, err := r.pipeConn(ctx)
+		if err != nil {
+			return nil, &TransportError{Err: err}
+		}
+		msg, err := pc.exchange(ctx, q)
+		if err != nil {
+			if err == errIDsExhausted {
+				return nil, err
+			}
+			if reused && ctx.Err() == nil {
+				// The server may have closed the connection, try again on a
+				// new one.
+				r.discardPipe(pc)
+				continue
+			}
+			return nil, &TransportError{Err: err}
+		}
+		return msg, nil
+	}
+}
+
+// pipeConn returns the shared connection, or opens a new one.
+func (r *DOT) pipeConn(ctx context.Context) (pc *dotPipe, reused bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pipe != nil && r.pipe.usable() {
+		return r.pipe, true, nil
+	}
+	c, err := r.dial(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	r.pipe = newDOTPipe(c)
+	return r.pipe, false, nil
+}
+
+// discardPipe closes pc and forgets it if it is still the shared connection.
+func (r *DOT) discardPipe(pc *dotPipe) {
+	r.mu.Lock()
+	if r.pipe == pc {
+		r.pipe = nil
+	}
+	r.mu.Unlock()
+	pc.close(errPipeClosed)
+}
@@ -0,0 +1,99 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDOTPipeOutOfOrder(t *testing.T) {
+	const n = 3
+	client, server := net.Pipe()
+	defer server.Close()
+	pc := newDOTPipe(&dotConn{Conn: client})
+	defer pc.close(errPipeClosed)
+
+	// The server reads all the queries before answering them in reverse
+	// order, echoing them.
+	serverErr := make(chan error, 1)
+	go func() {
+		var queries [][]byte
+		ids := map[uint16]bool{}
+		for len(queries) < n {
+			var hdr [2]byte
+			if _, err := io.ReadFull(server, hdr[:]); err != nil {
+				serverErr <- err
+				return
+			}
+			q := make([]byte, 2+binary.BigEndian.Uint16(hdr[:]))
+			copy(q, hdr[:])
+			if _, err := io.ReadFull(server, q[2:]); err != nil {
+				serverErr <- err
+				return
+			}
+			id := binary.BigEndian.Uint16(q[2:])
+			if ids[id] {
+				t.Errorf("ID %#x sent twice on the connection", id)
+			}
+			ids[id] = true
+			queries = append(queries, q)
+		}
+		for i := len(queries) - 1; i >= 0; i-- {
+			if _, err := server.Write(queries[i]); err != nil {
+				serverErr <- err
+				return
+			}
+		}
+		serverErr <- nil
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// All the queries use the same ID, like clients picking theirs.
+			q := append(idMsg(0x1234), byte(i))
+			msg, err := pc.exchange(ctx, q)
+			if err != nil {
+				t.Errorf("query %d: %v", i, err)
+				return
+			}
+			if id := binary.BigEndian.Uint16(msg); id != 0x1234 || msg[len(msg)-1] != byte(i) {
+				t.Errorf("query %d got the response % x", i, msg)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := <-serverErr; err != nil {
+		t.Fatal(err)
+	}
+	if n := pc.ids.inflight(); n != 0 {
+		t.Errorf("%d IDs still in use", n)
+	}
+}
+
+func TestDOTPipeClosed(t *testing.T) {
+	client, server := net.Pipe()
+	pc := newDOTPipe(&dotConn{Conn: client})
+	go func() {
+		// Read the query and close the connection without answering.
+		var buf [64]byte
+		server.Read(buf[:])
+		server.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := pc.exchange(ctx, idMsg(1)); err == nil || ctx.Err() != nil {
+		t.Errorf("exchange() err = %v, want the connection error", err)
+	}
+	if pc.usable() {
+		t.Error("failed connection still usable")
+	}
+}
@@ -0,0 +1,132 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// H3Transport is a DoH transport sending the requests over HTTP/3. When
+// HTTP/3 fails, like on networks blocking UDP, the requests are sent with
+// Fallback instead for h3RetryInterval before HTTP/3 is tried again.
+type H3Transport struct {
+	// Addrs is the list of host:port addresses dialed, tried in order,
+	// instead of resolving the request host, like bootstrap IPs. Fallback
+	// connects to them with DialAddrs.
+	Addrs []string
+
+	// VerifyConnection is an optional function called with the TLS state of
+	// each new connection. If it returns an error, the connection is closed
+	// and the request fails with this error.
+	VerifyConnection func(tls.ConnectionState) error
+
+	// Fallback is the HTTP/1.1 and HTTP/2 transport used while HTTP/3 fails.
+	Fallback http.RoundTripper
+
+	mu          sync.Mutex
+	h3          *http3.Transport
+	brokenUntil time.Time
+}
+
+// NewH3Transport returns an HTTP/3 transport dialing addrs, falling back to
+// HTTP/2 over TCP to the same addresses. The connections are verified with
+// verify when not nil.
+func NewH3Transport(addrs []string, verify func(tls.ConnectionState) error) (http.RoundTripper, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no address")
+	}
+	d := &net.Dialer{Timeout: 5 * time.Second}
+	return &H3Transport{
+		Addrs:            addrs,
+		VerifyConnection: verify,
+		Fallback: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return DialAddrs(ctx, d, network, addrs)
+			},
+			TLSClientConfig:     &tls.Config{VerifyConnection: verify},
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: 5 * time.Second,
+			IdleConnTimeout:     dotIdleTimeout,
+		},
+	}, nil
+}
+
+// h3RetryInterval is the time during which Fallback is used after HTTP/3
+// failed.
+const h3RetryInterval = 5 * time.Minute
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *H3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	h3 := t.roundTripper()
+	if h3 == nil {
+		return t.Fallback.RoundTrip(req)
+	}
+	res, err := h3.RoundTrip(req)
+	if err == nil || req.Context().Err() != nil {
+		return res, err
+	}
+	t.mu.Lock()
+	t.brokenUntil = time.Now().Add(h3RetryInterval)
+	t.mu.Unlock()
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	return t.Fallback.RoundTrip(req)
+}
+
+// roundTripper returns the HTTP/3 round tripper, or nil while HTTP/3 is
+// considered broken.
+func (t *H3Transport) roundTripper() *http3.Transport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Now().Before(t.brokenUntil) {
+		return nil
+	}
+	if t.h3 == nil {
+		t.h3 = &http3.Transport{
+			TLSClientConfig: &tls.Config{VerifyConnection: t.VerifyConnection},
+			QUICConfig: &quic.Config{
+				HandshakeIdleTimeout: 3 * time.Second,
+				KeepAlivePeriod:      quicKeepAlivePeriod,
+			},
+			Dial: t.dial,
+		}
+	}
+	return t.h3
+}
+
+func (t *H3Transport) dial(ctx context.Context, _ string, tlsCfg *tls.Config, cfg *quic.Config) (conn quic.EarlyConnection, err error) {
+	for _, addr := range t.Addrs {
+		if conn, err = quic.DialAddrEarly(ctx, addr, tlsCfg, cfg); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// CloseIdleConnections closes the HTTP/3 connections and the idle fallback
+// ones.
+func (t *H3Transport) CloseIdleConnections() {
+	t.mu.Lock()
+	h3 := t.h3
+	t.h3 = nil
+	t.mu.Unlock()
+	if h3 != nil {
+		_ = h3.Close()
+	}
+	if c, ok := t.Fallback.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
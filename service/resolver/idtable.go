@@ -0,0 +1,90 @@
+package resolver
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"sync"
+)
+
+// errIDsExhausted is returned when all the 16-bit IDs of a connection are in
+// use.
+var errIDsExhausted = errors.New("too many queries in flight")
+
+// idTable maps the IDs of the queries sent on a connection shared by
+// concurrent queries to their original IDs and waiting callers, so the client
+// chosen IDs cannot collide and responses, possibly out of order (RFC 7766
+// section 6.2.1.1), reach the right query. IDs are allocated sequentially from
+// a random start so an ID freed by a query that timed out is not reused until
+// the whole ID space has been, limiting the risk of a late response being
+// taken for the one of a newer query.
+type idTable struct {
+	mu      sync.Mutex
+	next    uint16
+	pending map[uint16]idWaiter
+}
+
+type idWaiter struct {
+	orig uint16
+	ch   chan []byte
+}
+
+// add allocates a connection-unique ID for a query with the ID orig. The
+// response is received on the returned channel by dispatch. The caller must
+// call remove with the ID once done, including on timeout.
+func (t *idTable) add(orig uint16) (id uint16, ch <-chan []byte, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending == nil {
+		t.pending = map[uint16]idWaiter{}
+		t.next = uint16(rand.Uint32())
+	}
+	if len(t.pending) > 0xffff {
+		return 0, nil, errIDsExhausted
+	}
+	for {
+		if _, used := t.pending[t.next]; !used {
+			break
+		}
+		t.next++
+	}
+	id = t.next
+	t.next++
+	w := idWaiter{orig: orig, ch: make(chan []byte, 1)}
+	t.pending[id] = w
+	return id, w.ch, nil
+}
+
+// remove frees id. Responses received for it afterwards are dropped.
+func (t *idTable) remove(id uint16) {
+	t.mu.Lock()
+	delete(t.pending, id)
+	t.mu.Unlock()
+}
+
+// dispatch hands the response msg to the query waiting for its ID, restoring
+// the original ID of the query. It returns false if no query waits for it,
+// like a late response to a query that timed out.
+func (t *idTable) dispatch(msg []byte) bool {
+	if len(msg) < 2 {
+		return false
+	}
+	id := binary.BigEndian.Uint16(msg)
+	t.mu.Lock()
+	w, ok := t.pending[id]
+	delete(t.pending, id)
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+	binary.BigEndian.PutUint16(msg, w.orig)
+	w.ch <- msg
+	return true
+}
+
+// inflight returns the number of queries waiting for their response.
+func (t *idTable) inflight() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.pending)
+}
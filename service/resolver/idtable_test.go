@@ -0,0 +1,101 @@
+package resolver
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestIDTableAdd(t *testing.T) {
+	all := make([]uint16, 0, 0x10000)
+	for id := 0; id <= 0xffff; id++ {
+		all = append(all, uint16(id))
+	}
+	tests := []struct {
+		name    string
+		next    uint16
+		pending []uint16
+		want    uint16
+		wantErr error
+	}{
+		{"sequential", 10, nil, 10, nil},
+		{"last ID", 0xffff, nil, 0xffff, nil},
+		{"wraparound", 0xffff, []uint16{0xffff}, 0, nil},
+		{"pending skipped", 10, []uint16{10, 11}, 12, nil},
+		{"pending skipped across wraparound", 0xfffe, []uint16{0xfffe, 0xffff, 0}, 1, nil},
+		{"exhausted", 0, all, 0, errIDsExhausted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tab := idTable{next: tt.next, pending: map[uint16]idWaiter{}}
+			for _, id := range tt.pending {
+				tab.pending[id] = idWaiter{}
+			}
+			id, ch, err := tab.add(0x1234)
+			if err != tt.wantErr {
+				t.Fatalf("add() err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if tab.inflight() != len(tt.pending) {
+					t.Errorf("%d IDs in use after a failed add, want %d", tab.inflight(), len(tt.pending))
+				}
+				return
+			}
+			if id != tt.want || ch == nil {
+				t.Errorf("add() = %#x, want %#x", id, tt.want)
+			}
+			if tab.next != tt.want+1 {
+				t.Errorf("next = %#x, want %#x", tab.next, tt.want+1)
+			}
+			if tab.inflight() != len(tt.pending)+1 {
+				t.Errorf("%d IDs in use, want %d", tab.inflight(), len(tt.pending)+1)
+			}
+		})
+	}
+}
+
+// idMsg returns a 12 bytes message with the ID id.
+func idMsg(id uint16) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg, id)
+	return msg
+}
+
+func TestIDTableDispatch(t *testing.T) {
+	var tab idTable
+	id, ch, err := tab.add(0x1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tab.dispatch([]byte{0}) {
+		t.Error("dispatch() of a message without ID succeeded")
+	}
+	if tab.dispatch(idMsg(id + 1)) {
+		t.Error("dispatch() of an unknown ID succeeded")
+	}
+	if !tab.dispatch(idMsg(id)) {
+		t.Fatal("dispatch() failed")
+	}
+	if msg := <-ch; binary.BigEndian.Uint16(msg) != 0x1234 {
+		t.Errorf("response ID %#x, want the original 0x1234", binary.BigEndian.Uint16(msg))
+	}
+	// The ID is freed by the response, a duplicate one is dropped.
+	if tab.dispatch(idMsg(id)) {
+		t.Error("dispatch() of a duplicate response succeeded")
+	}
+	tab.remove(id)
+
+	// A late response, after its query gave up, is dropped.
+	id, ch, _ = tab.add(0x5678)
+	tab.remove(id)
+	if tab.dispatch(idMsg(id)) {
+		t.Error("dispatch() after remove succeeded")
+	}
+	select {
+	case <-ch:
+		t.Error("late response delivered")
+	default:
+	}
+	if n := tab.inflight(); n != 0 {
+		t.Errorf("%d IDs in use, want 0", n)
+	}
+}
@@ -0,0 +1,93 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// DefaultRaceStagger defines the default value for Race Stagger.
+const DefaultRaceStagger = 50 * time.Millisecond
+
+// Race sends queries to all its resolvers and returns the first successful
+// response, canceling the slower queries. Resolvers are started Stagger apart,
+// in order, so a fast first resolver answers alone. A failing resolver makes
+// the next one start right away.
+type Race struct {
+	Resolvers []Resolver
+
+	// Stagger is the delay before starting the next resolver while no
+	// response has been received. If zero, DefaultRaceStagger is used.
+	Stagger time.Duration
+}
+
+// Resolve implements the Resolver interface.
+func (r *Race) Resolve(ctx context.Context, q []byte) ([]byte, error) {
+	if len(r.Resolvers) == 0 {
+		return nil, errors.New("no resolver")
+	}
+	stagger := r.Stagger
+	if stagger <= 0 {
+		stagger = DefaultRaceStagger
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// The slower resolvers may still be reading q after we returned, and the
+	// caller is free to reuse it.
+	q = append([]byte(nil), q...)
+
+	type result struct {
+		msg    []byte
+		err    error
+		timing Timing
+	}
+	// Each resolver gets its own Timing, the one of the winner is reported.
+	timing := timingFrom(ctx)
+	// Buffered so canceled resolvers can always deliver their result and
+	// exit.
+	results := make(chan result, len(r.Resolvers))
+	next, pending := 0, 0
+	start := func() {
+		res := r.Resolvers[next]
+		next++
+		pending++
+		go func() {
+			var t Timing
+			rctx := ctx
+			if timing != nil {
+				rctx = WithTiming(ctx, &t)
+			}
+			msg, err := res.Resolve(rctx, q)
+			results <- result{msg, err, t}
+		}()
+	}
+	start()
+	t := time.NewTimer(stagger)
+	defer t.Stop()
+	var err error
+	for {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if timing != nil {
+					*timing = res.timing
+				}
+				return res.msg, nil
+			}
+			err = res.err
+			if next < len(r.Resolvers) {
+				start()
+			} else if pending == 0 {
+				return nil, err
+			}
+		case <-t.C:
+			if next < len(r.Resolvers) {
+				start()
+				t.Reset(stagger)
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Package resolver implements the transports used to send DNS queries to an
+// upstream server.
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/nextdns/nextdns/resolver/endpoint"
+)
+
+// maxMessageSize is the maximum size of a DNS message on the wire.
+const maxMessageSize = 65535
+
+// Resolver sends DNS queries in wire format to an upstream and returns its
+// response.
+type Resolver interface {
+	Resolve(ctx context.Context, q []byte) ([]byte, error)
+}
+
+// StatusError is returned when a DoH upstream answers with a non 200 status
+// code.
+type StatusError int
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("error code: %d", int(e))
+}
+
+// TransportError is returned when a query could not be sent or its response
+// could not be received, like on connection, TLS handshake or certificate
+// verification failures. Err is the underlying error.
+type TransportError struct {
+	Err error
+}
+
+func (e *TransportError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports if the transport failed because it timed out.
+func (e *TransportError) Timeout() bool {
+	if errors.Is(e.Err, context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(e.Err, &ne) && ne.Timeout()
+}
+
+// New returns a resolver for the upstream URL u. Supported forms are:
+//
+//	https://host/path#bootstrap-ip,...   DNS over HTTPS
+//	tls://host[:port]#bootstrap-ip,...   DNS over TLS
+//	quic://host[:port]#bootstrap-ip,...  DNS over QUIC
+//	ip[:port]                            plain DNS over UDP and TCP
+//
+// Bootstrap IPs are optional. Without them, host is resolved using the system
+// resolver when connecting.
+func New(u string) (Resolver, error) {
+	switch {
+	case strings.HasPrefix(u, "https://"):
+		e, err := endpoint.New(u)
+		if err != nil {
+			return nil, err
+		}
+		return &DOH{
+			Do: func(ctx context.Context, action func(e endpoint.Endpoint) error) error {
+				return action(e)
+			},
+		}, nil
+	case strings.HasPrefix(u, "tls://"):
+		host, addrs, err := parseURL(u, "853")
+		if err != nil {
+			return nil, err
+		}
+		return &DOT{ServerName: host, Addrs: addrs}, nil
+	case strings.HasPrefix(u, "quic://"):
+		host, addrs, err := parseURL(u, "853")
+		if err != nil {
+			return nil, err
+		}
+		return newDOQ(host, addrs)
+	case !strings.Contains(u, "://"):
+		addr := u
+		if ip := net.ParseIP(u); ip != nil {
+			addr = net.JoinHostPort(u, "53")
+		} else if host, _, err := net.SplitHostPort(u); err != nil || net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("%s: invalid address", u)
+		}
+		return &DNS53{Addr: addr}, nil
+	default:
+		return nil, fmt.Errorf("%s: unsupported protocol", u)
+	}
+}
+
+// parseURL parses the scheme://host[:port]#bootstrap-ip,... URL u and returns
+// the host and the list of addresses to connect to.
+func parseURL(u, defaultPort string) (host string, addrs []string, err error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return "", nil, err
+	}
+	host = pu.Hostname()
+	if host == "" {
+		return "", nil, fmt.Errorf("%s: missing host", u)
+	}
+	port := pu.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	if pu.Fragment == "" {
+		return host, []string{net.JoinHostPort(host, port)}, nil
+	}
+	for _, ip := range strings.Split(pu.Fragment, ",") {
+		// IPv6 addresses may be given in brackets.
+		ip = strings.Trim(ip, "[]")
+		if net.ParseIP(ip) == nil {
+			return "", nil, fmt.Errorf("%s: invalid bootstrap IP %q", u, ip)
+		}
+		addrs = append(addrs, net.JoinHostPort(ip, port))
+	}
+	return host, addrs, nil
+}
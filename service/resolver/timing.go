@@ -0,0 +1,30 @@
+package resolver
+
+import (
+	"context"
+	"time"
+)
+
+// Timing collects the time spent in the steps of a DoH query.
+type Timing struct {
+	// RoundTrip is the time spent waiting for the response headers, from
+	// the connection setup to the first response byte.
+	RoundTrip time.Duration
+
+	// Read is the time spent reading the response body.
+	Read time.Duration
+}
+
+type timingKey struct{}
+
+// WithTiming returns a context collecting the timing of the query resolved
+// with it in t. Only DoH resolvers fill t.
+func WithTiming(ctx context.Context, t *Timing) context.Context {
+	return context.WithValue(ctx, timingKey{}, t)
+}
+
+// timingFrom returns the Timing attached to ctx, or nil.
+func timingFrom(ctx context.Context) *Timing {
+	t, _ := ctx.Value(timingKey{}).(*Timing)
+	return t
+}
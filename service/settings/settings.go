@@ -7,6 +7,7 @@ type Settings struct {
 	ReportDeviceName bool
 	CheckUpdates     bool
 	UpdateChannel    string
+	UserAgent        string
 }
 
 func FromMap(m map[string]interface{}) Settings {
@@ -29,5 +30,8 @@ func FromMap(m map[string]interface{}) Settings {
 	if v, ok := m["updateChannel"].(string); ok {
 		s.UpdateChannel = v
 	}
+	if v, ok := m["userAgent"].(string); ok {
+		s.UserAgent = v
+	}
 	return s
 }
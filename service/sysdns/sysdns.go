@@ -0,0 +1,3 @@
+// Package sysdns reads the DNS servers configured on the system network
+// interfaces.
+package sysdns
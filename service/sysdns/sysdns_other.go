@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package sysdns
+
+import (
+	"errors"
+	"net"
+)
+
+// Servers returns the DNS servers of the interfaces that are up, except the
+// one named exclude.
+func Servers(exclude string) ([]net.IP, error) {
+	return nil, errors.New("not implemented")
+}
@@ -0,0 +1,47 @@
+package sysdns
+
+import (
+	"net"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	gaaFlagSkipUnicast   = 0x1
+	gaaFlagSkipAnycast   = 0x2
+	gaaFlagSkipMulticast = 0x4
+)
+
+// Servers returns the DNS servers of the interfaces that are up, except the
+// one named exclude.
+func Servers(exclude string) ([]net.IP, error) {
+	size := uint32(15000)
+	for {
+		b := make([]byte, size)
+		first := (*windows.IpAdapterAddresses)(unsafe.Pointer(&b[0]))
+		err := windows.GetAdaptersAddresses(windows.AF_UNSPEC,
+			gaaFlagSkipUnicast|gaaFlagSkipAnycast|gaaFlagSkipMulticast, 0, first, &size)
+		if err == windows.ERROR_BUFFER_OVERFLOW {
+			continue
+		}
+		if err != nil {
+			return nil, os.NewSyscallError("GetAdaptersAddresses", err)
+		}
+		var ips []net.IP
+		for aa := first; aa != nil; aa = aa.Next {
+			if aa.OperStatus != windows.IfOperStatusUp || windows.UTF16PtrToString(aa.FriendlyName) == exclude {
+				continue
+			}
+			for dns := aa.FirstDnsServerAddress; dns != nil; dns = dns.Next {
+				ip := dns.Address.IP()
+				if ip == nil {
+					continue
+				}
+				ips = append(ips, ip)
+			}
+		}
+		return ips, nil
+	}
+}
@@ -0,0 +1,105 @@
+package tun
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	etherHeaderLen = 14
+
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+
+	icmpv6NeighborSolicitation  = 135
+	icmpv6NeighborAdvertisement = 136
+)
+
+// gwMAC is the link-layer address advertised for the IPv6 gateway addresses.
+// The TAP driver only handles ARP for IPv4, neighbor discovery for IPv6 is
+// answered here.
+var gwMAC = net.HardwareAddr{0x02, 0x00, 0x5e, 0x10, 0x00, 0x42}
+
+// handleNeighborSolicitation answers the frame f with a neighbor advertisement
+// if it is a neighbor solicitation for one of the IPv6 gateway addresses. It
+// returns true if f was handled.
+func (dev *winTapDev) handleNeighborSolicitation(f []byte) bool {
+	// ethernet(14) + ipv6(40) + icmpv6 ns(24)
+	if len(f) < 14+40+24 {
+		return false
+	}
+	ip := f[14:]
+	icmp := ip[40:]
+	if ip[6] != 58 || icmp[0] != icmpv6NeighborSolicitation {
+		return false
+	}
+	target := net.IP(icmp[8:24])
+	found := false
+	for _, gw := range dev.gw6IPs {
+		if gw.Equal(target) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+
+	var na [14 + 40 + 32]byte
+	// Ethernet header
+	copy(na[0:6], f[6:12])
+	copy(na[6:12], gwMAC)
+	binary.BigEndian.PutUint16(na[12:], etherTypeIPv6)
+	// IPv6 header
+	nip := na[14:54]
+	nip[0] = 0x60
+	binary.BigEndian.PutUint16(nip[4:], 32) // payload length
+	nip[6] = 58                             // ICMPv6
+	nip[7] = 255                            // hop limit
+	copy(nip[8:24], target)
+	src := net.IP(ip[8:24])
+	if src.IsUnspecified() {
+		// Duplicate address detection, answer to all-nodes.
+		copy(nip[24:40], net.IPv6linklocalallnodes)
+	} else {
+		copy(nip[24:40], src)
+	}
+	// ICMPv6 neighbor advertisement
+	nicmp := na[54:]
+	nicmp[0] = icmpv6NeighborAdvertisement
+	if src.IsUnspecified() {
+		nicmp[4] = 0x20 // override
+	} else {
+		nicmp[4] = 0x60 // solicited, override
+	}
+	copy(nicmp[8:24], target)
+	nicmp[24] = 2 // target link-layer address option
+	nicmp[25] = 1 // length in units of 8 bytes
+	copy(nicmp[26:32], gwMAC)
+	binary.BigEndian.PutUint16(nicmp[2:], icmpv6Checksum(nip[8:24], nip[24:40], nicmp))
+
+	dev.wMu.Lock()
+	defer dev.wMu.Unlock()
+	_, _ = dev.writeFrameLocked(na[:])
+	return true
+}
+
+func icmpv6Checksum(src, dst, msg []byte) uint16 {
+	var sum uint32
+	for i := 0; i < 16; i += 2 {
+		sum += uint32(src[i])<<8 | uint32(src[i+1])
+		sum += uint32(dst[i])<<8 | uint32(dst[i+1])
+	}
+	sum += uint32(len(msg))
+	sum += 58
+	for i := 0; i+1 < len(msg); i += 2 {
+		sum += uint32(msg[i])<<8 | uint32(msg[i+1])
+	}
+	if len(msg)%2 == 1 {
+		sum += uint32(msg[len(msg)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
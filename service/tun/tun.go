@@ -0,0 +1,5 @@
+package tun
+
+// DefaultMTU is the MTU of the tun device when none is given to
+// OpenTunDevice.
+const DefaultMTU = 1500
@@ -7,6 +7,6 @@ import (
 	"io"
 )
 
-func OpenTunDevice(name, addr, gw, mask string, dns []string) (io.ReadWriteCloser, error) {
+func OpenTunDevice(name, addr, gw, mask string, dns []string, addr6 string, dns6 []string, mtu int) (io.ReadWriteCloser, error) {
 	return nil, errors.New("not implemented")
 }
@@ -1,7 +1,6 @@
 package tun
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -10,6 +9,7 @@ import (
 	"net"
 	"os/exec"
 	"strings"
+	"sync"
 	"syscall"
 	"unsafe"
 
@@ -160,7 +160,10 @@ func getTuntapComponentId() (string, error) {
 	return "", errors.New("not found component id")
 }
 
-func OpenTunDevice(name, addr, gw, mask string, dns []string) (io.ReadWriteCloser, error) {
+func OpenTunDevice(name, addr, gw, mask string, dns []string, addr6 string, dns6 []string, mtu int) (io.ReadWriteCloser, error) {
+	if mtu <= 0 {
+		mtu = DefaultMTU
+	}
 	componentId, err := getTuntapComponentId()
 	if err != nil {
 		return nil, fmt.Errorf("getTuntapComponentId: %v", err)
@@ -175,8 +178,19 @@ func OpenTunDevice(name, addr, gw, mask string, dns []string) (io.ReadWriteClose
 	netsh("interface", "ip", "set", "address", TUNTAP_NAME, "dhcp")
 	netsh("interface", "ip", "set", "dns", TUNTAP_NAME, "dhcp")
 
-	// Set a v6 IP so windaube send AAAA queries
-	netsh("interface", "ipv6", "set", "address", "interface="+TUNTAP_NAME, "fd42:dead:beef::", "store=active")
+	netsh("interface", "ipv4", "set", "subinterface", TUNTAP_NAME, fmt.Sprintf("mtu=%d", mtu), "store=active")
+	netsh("interface", "ipv6", "set", "subinterface", TUNTAP_NAME, fmt.Sprintf("mtu=%d", mtu), "store=active")
+
+	// Set a v6 IP so windaube send AAAA queries, and v6 DNS servers so
+	// queries are also sent over IPv6 on dual-stack networks.
+	netsh("interface", "ipv6", "set", "address", "interface="+TUNTAP_NAME, addr6, "store=active")
+	for i, ip := range dns6 {
+		if i == 0 {
+			netsh("interface", "ipv6", "set", "dnsservers", "name="+TUNTAP_NAME, "source=static", "address="+ip, "register=none", "validate=no")
+		} else {
+			netsh("interface", "ipv6", "add", "dnsservers", "name="+TUNTAP_NAME, "address="+ip, fmt.Sprintf("index=%d", i+1), "validate=no")
+		}
+	}
 
 	// Open.
 	fd, err := windows.CreateFile(
@@ -262,23 +276,30 @@ func OpenTunDevice(name, addr, gw, mask string, dns []string) (io.ReadWriteClose
 		windows.Close(fd)
 		return nil, fmt.Errorf("windows.DeviceIoControl(TAP_IOCTL_SET_MEDIA_STATUS): %v", err)
 	}
-	return newWinTapDev(fd, addr, gw), nil
+	return newWinTapDev(fd, dns6, mtu), nil
 }
 
 type winTapDev struct {
-	fd          windows.Handle
-	addr        string
-	addrIP      net.IP
-	gw          string
-	gwIP        net.IP
-	rBuf        [2048]byte
-	wBuf        [2048]byte
-	wInitiated  bool
+	fd     windows.Handle
+	gw6IPs []net.IP // IPv6 addresses we answer neighbor solicitations for
+
+	// closeEvent is signaled by Close to interrupt a blocking Read or Write.
+	closeEvent windows.Handle
+	closeOnce  sync.Once
+
+	rMu         sync.Mutex // held during Read, protects rBuf, rOverlapped and closed
+	rBuf        []byte     // ethernet frame of an MTU sized packet
 	rOverlapped windows.Overlapped
+	closed      bool
+
+	wMu         sync.Mutex // held during Write, protects wBuf, wOverlapped and wClosed
+	wBuf        []byte
+	wInitiated  bool
 	wOverlapped windows.Overlapped
+	wClosed     bool
 }
 
-func newWinTapDev(fd windows.Handle, addr string, gw string) *winTapDev {
+func newWinTapDev(fd windows.Handle, gw6 []string, mtu int) *winTapDev {
 	rOverlapped := windows.Overlapped{}
 	rEvent, _ := windows.CreateEvent(nil, 0, 0, nil)
 	rOverlapped.HEvent = windows.Handle(rEvent)
@@ -287,22 +308,32 @@ func newWinTapDev(fd windows.Handle, addr string, gw string) *winTapDev {
 	wEvent, _ := windows.CreateEvent(nil, 0, 0, nil)
 	wOverlapped.HEvent = windows.Handle(wEvent)
 
+	closeEvent, _ := windows.CreateEvent(nil, 1, 0, nil)
+
 	dev := &winTapDev{
 		fd:          fd,
+		closeEvent:  closeEvent,
+		rBuf:        make([]byte, etherHeaderLen+mtu),
 		rOverlapped: rOverlapped,
+		wBuf:        make([]byte, etherHeaderLen+mtu),
 		wOverlapped: wOverlapped,
 		wInitiated:  false,
-
-		addr:   addr,
-		addrIP: net.ParseIP(addr).To4(),
-		gw:     gw,
-		gwIP:   net.ParseIP(gw).To4(),
+	}
+	for _, ip := range gw6 {
+		if ip := net.ParseIP(ip); ip != nil {
+			dev.gw6IPs = append(dev.gw6IPs, ip)
+		}
 	}
 	return dev
 }
 
 func (dev *winTapDev) Read(data []byte) (int, error) {
+	dev.rMu.Lock()
+	defer dev.rMu.Unlock()
 	for {
+		if dev.closed {
+			return 0, io.EOF
+		}
 		var done uint32
 		var nr int
 
@@ -311,7 +342,15 @@ func (dev *winTapDev) Read(data []byte) (int, error) {
 			if err != windows.ERROR_IO_PENDING {
 				return 0, err
 			} else {
-				windows.WaitForSingleObject(dev.rOverlapped.HEvent, windows.INFINITE)
+				ev, _ := windows.WaitForMultipleObjects([]windows.Handle{dev.rOverlapped.HEvent, dev.closeEvent}, false, windows.INFINITE)
+				if ev == windows.WAIT_OBJECT_0+1 {
+					// Closing: cancel the pending read and wait for its
+					// completion so the driver is done with rBuf.
+					_ = windows.CancelIoEx(dev.fd, &dev.rOverlapped)
+					_, _ = getOverlappedResult(dev.fd, &dev.rOverlapped)
+					dev.closed = true
+					return 0, io.EOF
+				}
 				nr, err = getOverlappedResult(dev.fd, &dev.rOverlapped)
 				if err != nil {
 					return 0, err
@@ -321,21 +360,18 @@ func (dev *winTapDev) Read(data []byte) (int, error) {
 			nr = int(done)
 		}
 		if nr > 14 {
-			if isStopMarker(dev.rBuf[14:nr], dev.addrIP, dev.gwIP) {
-				return 0, io.EOF
-			}
-
-			if dev.rBuf[14]&0xf0 == 0x60 {
-				// discard IPv6 packets
-				continue
-			} else if dev.rBuf[14]&0xf0 == 0x40 {
+			if v := dev.rBuf[14] & 0xf0; v == 0x40 || v == 0x60 {
+				if v == 0x60 && dev.handleNeighborSolicitation(dev.rBuf[:nr]) {
+					continue
+				}
+				dev.wMu.Lock()
 				if !dev.wInitiated {
 					// copy ether header for writing
 					copy(dev.wBuf[:], dev.rBuf[6:12])
 					copy(dev.wBuf[6:], dev.rBuf[0:6])
-					copy(dev.wBuf[12:], dev.rBuf[12:14])
 					dev.wInitiated = true
 				}
+				dev.wMu.Unlock()
 				copy(data, dev.rBuf[14:nr])
 				return nr - 14, nil
 			}
@@ -344,17 +380,42 @@ func (dev *winTapDev) Read(data []byte) (int, error) {
 }
 
 func (dev *winTapDev) Write(data []byte) (int, error) {
+	dev.wMu.Lock()
+	defer dev.wMu.Unlock()
+	if len(data) > 0 && data[0]&0xf0 == 0x60 {
+		binary.BigEndian.PutUint16(dev.wBuf[12:], etherTypeIPv6)
+	} else {
+		binary.BigEndian.PutUint16(dev.wBuf[12:], etherTypeIPv4)
+	}
+	payloadL := copy(dev.wBuf[14:], data)
+	return dev.writeFrameLocked(dev.wBuf[:payloadL+14])
+}
+
+// writeFrameLocked writes the ethernet frame f on the device and returns the
+// number of payload bytes written. dev.wMu must be held.
+func (dev *winTapDev) writeFrameLocked(f []byte) (int, error) {
 	var done uint32
 	var nw int
 
-	payloadL := copy(dev.wBuf[14:], data)
-	packetL := payloadL + 14
-	err := windows.WriteFile(dev.fd, dev.wBuf[:packetL], &done, &dev.wOverlapped)
+	if dev.wClosed {
+		return 0, io.ErrClosedPipe
+	}
+	packetL := len(f)
+	payloadL := packetL - 14
+	err := windows.WriteFile(dev.fd, f, &done, &dev.wOverlapped)
 	if err != nil {
 		if err != windows.ERROR_IO_PENDING {
 			return 0, err
 		} else {
-			windows.WaitForSingleObject(dev.wOverlapped.HEvent, windows.INFINITE)
+			ev, _ := windows.WaitForMultipleObjects([]windows.Handle{dev.wOverlapped.HEvent, dev.closeEvent}, false, windows.INFINITE)
+			if ev == windows.WAIT_OBJECT_0+1 {
+				// Closing: cancel the stalled write and wait for its
+				// completion so the driver is done with f.
+				_ = windows.CancelIoEx(dev.fd, &dev.wOverlapped)
+				_, _ = getOverlappedResult(dev.fd, &dev.wOverlapped)
+				dev.wClosed = true
+				return 0, io.ErrClosedPipe
+			}
 			nw, err = getOverlappedResult(dev.fd, &dev.wOverlapped)
 			if err != nil {
 				return 0, err
@@ -382,40 +443,30 @@ func getOverlappedResult(h windows.Handle, overlapped *windows.Overlapped) (int,
 	return n, nil
 }
 
+// Close closes the device. A blocking Read is interrupted and returns io.EOF,
+// a blocking Write, like on a stalled driver, is canceled and returns
+// io.ErrClosedPipe.
 func (dev *winTapDev) Close() error {
-	if err := sendStopMarker(dev.addr, dev.gw); err != nil {
-		return err
-	}
-	return windows.Close(dev.fd)
-}
-
-var stopMarker = []byte{2, 2, 2, 2, 2, 2, 2, 2}
-
-// Close of Windows and Linux tun/tap device do not interrupt blocking Read.
-// sendStopMarker is used to issue a specific packet to notify threads blocking
-// on Read.
-func sendStopMarker(src, dst string) error {
-	l, _ := net.ResolveUDPAddr("udp", src+":2222")
-	r, _ := net.ResolveUDPAddr("udp", dst+":2222")
-	conn, err := net.DialUDP("udp", l, r)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-	_, err = conn.Write(stopMarker)
+	var err error
+	dev.closeOnce.Do(func() {
+		// Signal before taking the locks, held by the reader and the writer
+		// while they wait on the device.
+		_ = windows.SetEvent(dev.closeEvent)
+		// Wait for the reader and writer to be done with the handle.
+		dev.rMu.Lock()
+		dev.closed = true
+		dev.wMu.Lock()
+		dev.wClosed = true
+		err = windows.Close(dev.fd)
+		windows.Close(dev.rOverlapped.HEvent)
+		windows.Close(dev.wOverlapped.HEvent)
+		windows.Close(dev.closeEvent)
+		dev.wMu.Unlock()
+		dev.rMu.Unlock()
+	})
 	return err
 }
 
-func isStopMarker(pkt []byte, src, dst net.IP) bool {
-	n := len(pkt)
-	// at least should be 20(ip) + 8(udp) + 8(stopmarker)
-	if n < 20+8+8 {
-		return false
-	}
-	return pkt[0]&0xf0 == 0x40 && pkt[9] == 0x11 && src.Equal(pkt[12:16]) &&
-		dst.Equal(pkt[16:20]) && bytes.Compare(pkt[n-8:n], stopMarker) == 0
-}
-
 func netsh(args ...string) (string, error) {
 	cmd := exec.Command("netsh", args...)
 	b, err := cmd.Output()